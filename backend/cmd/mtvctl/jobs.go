@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+
+	"manhattan_tech_ventures/internal/repository"
+	services "manhattan_tech_ventures/internal/services"
+)
+
+// jobDetails is a job record with the name of its video, as shown by jobs show.
+type jobDetails struct {
+	repository.JobRecord
+	Filename string `json:"filename,omitempty"`
+}
+
+// listJobs prints the jobs, oldest first, optionally only those with a given status.
+func (c *cli) listJobs(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("jobs list", flag.ContinueOnError)
+	status := flags.String("status", "", "only list jobs with this status")
+	if _, err := parseArgs(flags, args, 0); err != nil {
+		return err
+	}
+
+	records, err := c.repos.Jobs.List(ctx, *status)
+	if err != nil {
+		return err
+	}
+	if records == nil {
+		records = []repository.JobRecord{} // Printed as an empty JSON list
+	}
+	return c.print(records, func(w io.Writer) {
+		fmt.Fprintln(w, "JOB\tSTATUS\tVIDEO\tKIND\tATTEMPTS\tCREATED\tFINISHED\tERROR")
+		for _, record := range records {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n", record.ID, record.Status, record.VideoID, jobKind(record),
+				record.Attempts, formatTime(record.CreatedAt), formatTime(record.FinishedAt), orDash(record.Error))
+		}
+	})
+}
+
+// showJob prints everything recorded about a job.
+func (c *cli) showJob(ctx context.Context, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("jobs show", flag.ContinueOnError), args, 1)
+	if err != nil {
+		return err
+	}
+
+	record, err := c.repos.Jobs.Get(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	details := jobDetails{JobRecord: *record}
+	if video, err := c.repos.Videos.Get(ctx, record.VideoID); err == nil {
+		details.Filename = video.Filename
+	}
+	return c.print(details, func(w io.Writer) {
+		fmt.Fprintf(w, "Job:\t%s\n", record.ID)
+		fmt.Fprintf(w, "Status:\t%s\n", record.Status)
+		fmt.Fprintf(w, "Video:\t%s (%s)\n", record.VideoID, orDash(details.Filename))
+		fmt.Fprintf(w, "Kind:\t%s\n", jobKind(*record))
+		if record.Clip != nil {
+			fmt.Fprintf(w, "Clip:\t%.3fs to %.3fs of %s\n", record.Clip.Start, record.Clip.End, record.Clip.ParentFilename)
+		}
+		if record.Concat != nil {
+			fmt.Fprintf(w, "Sources:\t%v\n", record.Concat.SourceFilenames)
+		}
+		fmt.Fprintf(w, "Attempts:\t%d\n", record.Attempts)
+		fmt.Fprintf(w, "Created:\t%s\n", formatTime(record.CreatedAt))
+		fmt.Fprintf(w, "Started:\t%s\n", formatTime(record.StartedAt))
+		fmt.Fprintf(w, "Finished:\t%s\n", formatTime(record.FinishedAt))
+		fmt.Fprintf(w, "Error:\t%s\n", orDash(record.Error))
+	})
+}
+
+// retryJob queues a failed or cancelled job again, as a new job.
+func (c *cli) retryJob(ctx context.Context, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("jobs retry", flag.ContinueOnError), args, 1)
+	if err != nil {
+		return err
+	}
+
+	record, err := services.RetryJob(ctx, c.repos, args[0])
+	if err != nil {
+		return err
+	}
+	return c.print(record, func(w io.Writer) {
+		fmt.Fprintf(w, "Queued job %s for video %s\n", record.ID, record.VideoID)
+	})
+}
+
+// cancelJob cancels a queued or running job.
+func (c *cli) cancelJob(ctx context.Context, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("jobs cancel", flag.ContinueOnError), args, 1)
+	if err != nil {
+		return err
+	}
+
+	if err := services.CancelJob(ctx, c.repos, args[0]); err != nil {
+		return err
+	}
+	record, err := c.repos.Jobs.Get(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return c.print(record, func(w io.Writer) {
+		fmt.Fprintf(w, "Cancelled job %s of video %s\n", record.ID, record.VideoID)
+	})
+}
+
+// jobKind names the work a job does.
+func jobKind(record repository.JobRecord) string {
+	switch {
+	case record.Clip != nil:
+		return "clip"
+	case record.Concat != nil:
+		return "concat"
+	}
+	return "transcode"
+}
@@ -0,0 +1,209 @@
+// Command mtvctl is the operations tool of the video service. It reads the same configuration
+// as the server and works on the MongoDB catalog, job queue and GridFS bucket directly, so it
+// can be used whether the server is running or not. Jobs it queues are picked up by a running
+// server within its job poll interval, or when the server next starts.
+//
+// Usage:
+//
+//	mtvctl [-config file] [-json] <command> [arguments]
+//
+// Run mtvctl without a command for the list of commands.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"manhattan_tech_ventures/internal/config"
+	database "manhattan_tech_ventures/internal/database"
+	"manhattan_tech_ventures/internal/repository"
+	services "manhattan_tech_ventures/internal/services"
+)
+
+// usageText lists the commands of mtvctl.
+const usageText = `Usage: mtvctl [-config file] [-json] <command> [arguments]
+
+Jobs:
+  jobs list [-status queued|running|succeeded|failed|cancelled]
+  jobs show <job id>
+  jobs retry <job id>              queue a failed or cancelled job again
+  jobs cancel <job id>             stop a queued or running job
+
+Videos:
+  videos list [-status status]
+  videos delete [-force] <video id> delete a video, its stored files and its source
+  videos retranscode <video id>    transcode a video again from its source
+  videos verify <video id>         read back the stored files of a video and check them
+  videos usage [video id...]       report the storage every video takes
+
+Flags:
+`
+
+// errUsage is returned for command lines mtvctl does not understand.
+var errUsage = errors.New("invalid usage")
+
+// errProblems is returned by commands that completed but found something wrong, so scripts
+// can tell from the exit status.
+var errProblems = errors.New("problems found")
+
+// cli holds what every command needs.
+type cli struct {
+	cfg        config.Config
+	repos      *repository.Repositories
+	renditions []services.RenditionSpec
+	json       bool      // Whether results are printed as JSON
+	out        io.Writer // Where results are printed
+}
+
+// main parses the global flags, connects to MongoDB and runs the command. It exits with 1 if
+// the command failed or found problems and with 2 if the command line is invalid.
+func main() {
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML configuration file")
+	jsonOutput := flag.Bool("json", false, "print results as JSON")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usageText)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fail(fmt.Errorf("failed to load configuration: %v", err))
+	}
+	if cfg.StorageBackend != config.StorageGridFS {
+		fail(fmt.Errorf("mtvctl needs the %s storage backend, the configuration uses %s", config.StorageGridFS, cfg.StorageBackend))
+	}
+
+	// Stop at Ctrl+C between files of long commands such as verify
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	client, _, err := database.ConnectMongoDB(cfg.MongoURI)
+	if err != nil {
+		fail(err)
+	}
+	pingCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	err = client.Ping(pingCtx, nil)
+	cancel()
+	if err != nil {
+		fail(fmt.Errorf("failed to reach MongoDB at %s: %v", cfg.MongoURI, err))
+	}
+	repos, err := repository.NewMongoRepositories(ctx, client.Database(cfg.DBName), "media")
+	if err != nil {
+		fail(err)
+	}
+
+	c := &cli{
+		cfg:        cfg,
+		repos:      repos,
+		renditions: services.RenditionsFromConfig(cfg.Renditions),
+		json:       *jsonOutput,
+		out:        os.Stdout,
+	}
+	err = c.run(ctx, flag.Arg(0), flag.Arg(1), flag.Args()[2:])
+	client.Disconnect(context.Background())
+	switch {
+	case errors.Is(err, errUsage):
+		fmt.Fprintf(os.Stderr, "mtvctl: %v\n\n", err)
+		flag.Usage()
+		os.Exit(2)
+	case errors.Is(err, errProblems):
+		os.Exit(1)
+	case err != nil:
+		fail(err)
+	}
+}
+
+// run runs the command named by group and name with the given arguments.
+func (c *cli) run(ctx context.Context, group string, name string, args []string) error {
+	commands := map[string]func(context.Context, []string) error{
+		"jobs list":          c.listJobs,
+		"jobs show":          c.showJob,
+		"jobs retry":         c.retryJob,
+		"jobs cancel":        c.cancelJob,
+		"videos list":        c.listVideos,
+		"videos delete":      c.deleteVideo,
+		"videos retranscode": c.retranscodeVideo,
+		"videos verify":      c.verifyVideo,
+		"videos usage":       c.storageUsage,
+	}
+	command, ok := commands[group+" "+name]
+	if !ok {
+		return fmt.Errorf("unknown command %q: %w", group+" "+name, errUsage)
+	}
+	return command(ctx, args)
+}
+
+// parseArgs parses the flags of a command and checks the number of remaining arguments, which
+// must be exactly want unless want is negative.
+func parseArgs(flags *flag.FlagSet, args []string, want int) ([]string, error) {
+	flags.SetOutput(io.Discard)
+	if err := flags.Parse(args); err != nil {
+		return nil, fmt.Errorf("%s: %v: %w", flags.Name(), err, errUsage)
+	}
+	if want >= 0 && flags.NArg() != want {
+		return nil, fmt.Errorf("%s takes %d argument(s), got %d: %w", flags.Name(), want, flags.NArg(), errUsage)
+	}
+	return flags.Args(), nil
+}
+
+// print writes v as JSON in JSON mode, and calls text with a tab-aligned writer otherwise.
+func (c *cli) print(v any, text func(w io.Writer)) error {
+	if c.json {
+		encoder := json.NewEncoder(c.out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	}
+	w := tabwriter.NewWriter(c.out, 0, 8, 2, ' ', 0)
+	text(w)
+	return w.Flush()
+}
+
+// formatTime formats a time for the text output, "-" if it is not set.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.DateTime)
+}
+
+// formatBytes formats a size in bytes for the text output, e.g. "1.5 GiB".
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	value, exponent := float64(size)/unit, 0
+	for value >= unit && exponent < 4 {
+		value /= unit
+		exponent++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGTP"[exponent])
+}
+
+// orDash returns s, or "-" if it is empty.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// fail prints an error and exits with status 1.
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "mtvctl: %v\n", err)
+	os.Exit(1)
+}
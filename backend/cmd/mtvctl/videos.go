@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"manhattan_tech_ventures/internal/repository"
+	services "manhattan_tech_ventures/internal/services"
+)
+
+// deleteResult is what videos delete removed.
+type deleteResult struct {
+	VideoID     string `json:"video_id"`
+	MediaFiles  int    `json:"media_files"`  // Stored files deleted
+	MediaBytes  int64  `json:"media_bytes"`  // Size of the stored files deleted
+	SourceBytes int64  `json:"source_bytes"` // Size of the source files deleted from the upload path
+}
+
+// listVideos prints the videos in the catalog, newest first, optionally only those with a given status.
+func (c *cli) listVideos(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("videos list", flag.ContinueOnError)
+	status := flags.String("status", "", "only list videos with this status")
+	if _, err := parseArgs(flags, args, 0); err != nil {
+		return err
+	}
+
+	videos, err := c.repos.Videos.List(ctx)
+	if err != nil {
+		return err
+	}
+	if videos == nil {
+		videos = []repository.Video{} // Printed as an empty JSON list
+	}
+	if *status != "" {
+		videos = slices.DeleteFunc(videos, func(video repository.Video) bool { return video.Status != *status })
+	}
+	return c.print(videos, func(w io.Writer) {
+		fmt.Fprintln(w, "VIDEO\tSTATUS\tFILENAME\tSIZE\tCREATED\tTITLE\tERROR")
+		for _, video := range videos {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", video.ID, video.Status, video.Filename, formatBytes(video.Size),
+				formatTime(video.CreatedAt), orDash(video.Title), orDash(video.Error))
+		}
+	})
+}
+
+// deleteVideo deletes a video's stored files, its source files in the upload path and its
+// catalog record. Its job records are kept. A video with a queued or running job is only
+// deleted with -force, which cancels the job first; a video other jobs still read from is
+// never deleted.
+func (c *cli) deleteVideo(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("videos delete", flag.ContinueOnError)
+	force := flags.Bool("force", false, "cancel the video's queued or running job first")
+	args, err := parseArgs(flags, args, 1)
+	if err != nil {
+		return err
+	}
+	videoID := args[0]
+
+	if _, err := c.repos.Videos.Get(ctx, videoID); err != nil {
+		return err
+	}
+	for _, status := range []string{repository.JobStatusQueued, repository.JobStatusRunning} {
+		records, err := c.repos.Jobs.List(ctx, status)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			switch {
+			case record.VideoID == videoID && *force:
+				if err := services.CancelJob(ctx, c.repos, record.ID); err != nil {
+					return err
+				}
+			case record.VideoID == videoID:
+				return fmt.Errorf("video %s has %s job %s, use -force to cancel it: %w", videoID, record.Status, record.ID, services.ErrJobState)
+			case (record.Clip != nil && record.Clip.ParentFilename == videoID) ||
+				(record.Concat != nil && slices.Contains(record.Concat.SourceFilenames, videoID)):
+				return fmt.Errorf("%s job %s of video %s reads from video %s: %w", record.Status, record.ID, record.VideoID, videoID, services.ErrJobState)
+			}
+		}
+	}
+
+	result := deleteResult{VideoID: videoID}
+	result.MediaFiles, result.MediaBytes, err = services.DeleteVideoMedia(ctx, c.repos.Media, c.cfg.TranscodedFilePath, c.renditions, videoID)
+	if err != nil {
+		return fmt.Errorf("deleted %d stored files before failing: %v", result.MediaFiles, err)
+	}
+	for _, name := range []string{videoID, videoID + ".info", videoID + ".part"} {
+		path := filepath.Join(c.cfg.UploadPath, name)
+		stat, err := os.Stat(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		result.SourceBytes += stat.Size()
+	}
+	if err := c.repos.Videos.Delete(ctx, videoID); err != nil {
+		return err
+	}
+
+	return c.print(result, func(w io.Writer) {
+		fmt.Fprintf(w, "Deleted video %s: %d stored files (%s), %s of source files\n",
+			videoID, result.MediaFiles, formatBytes(result.MediaBytes), formatBytes(result.SourceBytes))
+	})
+}
+
+// retranscodeVideo queues a job transcoding a video again.
+func (c *cli) retranscodeVideo(ctx context.Context, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("videos retranscode", flag.ContinueOnError), args, 1)
+	if err != nil {
+		return err
+	}
+
+	record, err := services.RetranscodeVideo(ctx, c.repos, c.cfg.UploadPath, args[0])
+	if err != nil {
+		return err
+	}
+	return c.print(record, func(w io.Writer) {
+		fmt.Fprintf(w, "Queued job %s for video %s\n", record.ID, record.VideoID)
+	})
+}
+
+// verifyVideo checks the stored files of a video, failing with errProblems if any are missing
+// or damaged.
+func (c *cli) verifyVideo(ctx context.Context, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("videos verify", flag.ContinueOnError), args, 1)
+	if err != nil {
+		return err
+	}
+	check, err := services.VerifyStream(ctx, c.repos.Media, c.cfg.TranscodedFilePath, c.renditions, args[0])
+	if err != nil {
+		return err
+	}
+	err = c.print(check, func(w io.Writer) {
+		fmt.Fprintf(w, "Video %s: %d files (%s) read", check.VideoID, check.Files, formatBytes(check.Bytes))
+		if check.Unchecked > 0 {
+			fmt.Fprintf(w, ", %d without a recorded checksum", check.Unchecked)
+		}
+		fmt.Fprintf(w, ", %d problems\n", len(check.Problems))
+		for _, problem := range check.Problems {
+			fmt.Fprintf(w, "%s\t%s\n", problem.File, problem.Problem)
+		}
+	})
+	if err == nil && len(check.Problems) > 0 {
+		return errProblems
+	}
+	return err
+}
+
+// storageUsage prints the storage taken by the given videos, or by every video and by the
+// stored files of deleted ones.
+func (c *cli) storageUsage(ctx context.Context, args []string) error {
+	videoIDs, err := parseArgs(flag.NewFlagSet("videos usage", flag.ContinueOnError), args, -1)
+	if err != nil {
+		return err
+	}
+
+	report, err := services.StorageUsage(ctx, c.repos, c.cfg.UploadPath, c.cfg.TranscodedFilePath)
+	if err != nil {
+		return err
+	}
+	if len(videoIDs) > 0 {
+		report = slices.DeleteFunc(report, func(entry services.VideoStorage) bool { return !slices.Contains(videoIDs, entry.VideoID) })
+	}
+	return c.print(report, func(w io.Writer) {
+		var source, media int64
+		fmt.Fprintln(w, "VIDEO\tSTATUS\tFILENAME\tSOURCE\tFILES\tSTORED\tTOTAL")
+		for _, entry := range report {
+			status := entry.Status
+			if entry.Orphaned {
+				status = "orphaned"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", entry.VideoID, status, orDash(entry.Filename),
+				formatBytes(entry.SourceBytes), entry.MediaFiles, formatBytes(entry.MediaBytes), formatBytes(entry.SourceBytes+entry.MediaBytes))
+			source += entry.SourceBytes
+			media += entry.MediaBytes
+		}
+		fmt.Fprintf(w, "TOTAL\t\t\t%s\t\t%s\t%s\n", formatBytes(source), formatBytes(media), formatBytes(source+media))
+	})
+}
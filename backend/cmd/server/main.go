@@ -1,52 +1,292 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
 	"manhattan_tech_ventures/internal/api"
 	"manhattan_tech_ventures/internal/config"
 	database "manhattan_tech_ventures/internal/database"
+	"manhattan_tech_ventures/internal/logging"
+	"manhattan_tech_ventures/internal/metrics"
+	"manhattan_tech_ventures/internal/repository"
 	services "manhattan_tech_ventures/internal/services"
 	"manhattan_tech_ventures/internal/storage"
+	"manhattan_tech_ventures/internal/tracing"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 // main is the entry point of the application. It initializes the necessary services,
-// sets up the router, and starts the HTTP server.
+// sets up the router, starts the HTTP server and shuts everything down gracefully on
+// SIGINT or SIGTERM.
 func main() {
-	// Load configuration settings from environment variables or default values.
-	cfg := config.LoadConfig()
+	// Load the configuration once, from the optional YAML file given with -config (or CONFIG_FILE)
+	// and the environment. It is passed explicitly to every component that needs it.
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML configuration file")
+	flag.Parse()
 
-	// Connect to MongoDB using the provided URI from the configuration.
-	client, ctx, dberr := database.ConnectMongoDB(cfg.MongoURI)
-	if dberr != nil {
-		log.Fatalf("Error connecting to MongoDB: %v", dberr) // Log and terminate if the database connection fails.
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fatal("Error loading configuration", "error", err)
+	}
+
+	// Log structured lines in the configured format, from the configured level up.
+	if err := logging.Setup(cfg.LogFormat, cfg.LogLevel); err != nil {
+		fatal("Invalid logging configuration", "error", err)
 	}
 
-	// Access the specified MongoDB database using the database name from the configuration.
-	db := client.Database(cfg.DBName)
+	// Set up tracing, exporting spans over OTLP or to stdout when configured.
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.TraceExporter, cfg.TraceEndpoint)
+	if err != nil {
+		fatal("Error setting up tracing", "error", err)
+	}
 
-	// Ensure that the MongoDB client disconnects properly when the application terminates.
-	defer client.Disconnect(ctx)
+	// Create the upload and output directories up front, so uploads and the readiness checks
+	// work before the first video has been transcoded.
+	for _, dir := range []string{cfg.UploadPath, cfg.TranscodedFilePath} {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			fatal("Error creating directory", "path", dir, "error", err)
+		}
+	}
+
+	// Set up the repositories for the video catalog, jobs and media files in the configured backend.
+	repos, client, err := openRepositories(cfg)
+	if err != nil {
+		fatal("Error setting up repositories", "storage_backend", cfg.StorageBackend, "error", err)
+	}
 
 	// Initialize local storage for file uploads using the base path from the configuration.
 	storageService := &storage.LocalStorage{BasePath: cfg.UploadPath}
 
-	// Set up the TUS upload handler using the storage service and MongoDB client.
-	// This handler manages file uploads and integrates with the transcoding and storage services.
-	tusHandler := services.HandleUpload(storageService, db)
+	// Create channels for jobs and results to manage the worker pool.
+	jobs := make(chan services.Job, 100) // Buffered channel for jobs to process
+	results := make(chan error, 100)     // Buffered channel for results from workers
 
-	// Set up the HTTP router with the configured routes and TUS handler.
-	// The router manages endpoints for uploads, HLS streaming, and status updates.
-	http.Handle("/", api.SetupRouter(tusHandler, db))
+	// Start the worker pool to handle transcoding and uploading tasks, transcoding with ffmpeg.
+	pool := services.NewWorkerPool(cfg.WorkerProcessCount, services.RenditionsFromConfig(cfg.Renditions),
+		jobs, results, services.NewFFmpegTranscoder(), repos, services.OutputOptions{
+			UploadWorkers: cfg.MediaUploadWorkers,
+			UploadRetries: cfg.MediaUploadRetries,
+			KeepFiles:     cfg.KeepTranscodedFiles,
+		})
+	pool.Start()
 
-	// Log that the server is running.
-	log.Default().Printf("Server Running")
+	// Drain job results so workers never block once the results buffer is full.
+	// The workers log the outcome of every job themselves.
+	go func() {
+		for range results {
+		}
+	}()
 
-	// Start the HTTP server on the specified address from the configuration.
-	err := http.ListenAndServe(cfg.ServerAddress, nil)
+	// Queue again any job a previous run left unfinished, e.g. because it was interrupted by a shutdown.
+	// Afterwards, pick up the jobs queued by mtvctl until shutdown.
+	pollCtx, stopPolling := context.WithCancel(context.Background())
+	go func() {
+		if err := services.RecoverJobs(context.Background(), repos, jobs, cfg.UploadPath, cfg.TranscodedFilePath); err != nil {
+			slog.Error("Failed to recover unfinished jobs", "error", err)
+		}
+		services.PollJobs(pollCtx, repos, jobs, cfg.UploadPath, cfg.TranscodedFilePath, cfg.JobPollInterval)
+	}()
+
+	// Set up the TUS upload handler using the storage service and repositories.
+	// This handler manages file uploads and queues completed uploads on the jobs channel.
+	// Uploads and imports are counted against the same per-user limits.
+	limits := services.NewUploadLimits(cfg, repos.Videos)
+	tusHandler, err := services.HandleUpload(cfg, storageService, repos, jobs, limits)
 	if err != nil {
-		log.Fatalf("unable to listen: %s", err) // Log and terminate if the server cannot start.
+		fatal("Error setting up uploads", "error", err)
+	}
+
+	// Download videos imported from URLs in the background. Imports a previous run left
+	// unfinished are failed before new ones can start.
+	importer := services.NewImporter(cfg, repos, jobs, limits)
+	if err := importer.Recover(context.Background()); err != nil {
+		slog.Error("Failed to recover unfinished imports", "error", err)
+	}
+
+	// Delete abandoned uploads and, if configured, the sources of transcoded videos in the background.
+	janitorCtx, stopJanitor := context.WithCancel(context.Background())
+	janitor := &services.UploadJanitor{
+		UploadPath:      cfg.UploadPath,
+		Expiry:          cfg.UploadExpiry,
+		SourceRetention: cfg.SourceRetention,
+		Interval:        cfg.JanitorInterval,
+		Repos:           repos,
+	}
+	go janitor.Run(janitorCtx)
+
+	// Ingest the videos dropped into the watch directory, if one is configured. It stops with the janitor.
+	if cfg.WatchPath != "" {
+		watcher := &services.WatchFolder{
+			Path:           cfg.WatchPath,
+			UploadPath:     cfg.UploadPath,
+			TranscodedPath: cfg.TranscodedFilePath,
+			Interval:       cfg.WatchInterval,
+			SettleTime:     cfg.WatchSettleTime,
+			RequireDone:    cfg.WatchRequireDone,
+			Concurrency:    cfg.WatchConcurrency,
+			Extensions:     cfg.UploadExtensions,
+			MaxSize:        int64(cfg.UploadMaxSizeMB) * 1024 * 1024,
+			Repos:          repos,
+			Jobs:           jobs,
+		}
+		go watcher.Run(janitorCtx)
+	}
+
+	// Export the tus handler's upload counters (uploads created and finished, bytes received) as metrics.
+	metrics.RegisterUploads(tusHandler)
+
+	// Start the live ingest, if enabled, transcoding pushed RTMP/SRT streams to live HLS
+	// and archiving them as VOD once they end.
+	var live *services.LiveIngest
+	liveCtx, stopLive := context.WithCancel(context.Background())
+	liveDone := make(chan struct{})
+	if cfg.LiveEnabled {
+		var partDuration time.Duration
+		if cfg.LiveLowLatency {
+			partDuration = cfg.LivePartDuration
+		}
+		live = &services.LiveIngest{
+			ListenURL:       services.LiveListenURL(cfg.LiveProtocol, cfg.LivePort),
+			OutputPath:      cfg.TranscodedFilePath,
+			UploadPath:      cfg.UploadPath,
+			Renditions:      services.RenditionsFromConfig(cfg.Renditions),
+			SegmentDuration: cfg.LiveSegmentSeconds,
+			DVRSegments:     cfg.LiveDVRSegments,
+			PartDuration:    partDuration,
+			Retranscode:     cfg.LiveRetranscode,
+			Jobs:            jobs,
+			Repos:           repos,
+		}
+		go func() {
+			live.Run(liveCtx)
+			close(liveDone)
+		}()
 	} else {
-		log.Default().Printf("Server Running") // Log that the server is running (redundant, already logged above).
+		close(liveDone)
+	}
+
+	// Set up the readiness checks for MongoDB, the working directories, ffmpeg and the worker pool.
+	health := &services.HealthChecker{
+		Pool:           pool,
+		UploadPath:     cfg.UploadPath,
+		TranscodedPath: cfg.TranscodedFilePath,
+		MinFreeBytes:   cfg.MinFreeDiskMB << 20,
+	}
+	if client != nil {
+		health.PingMongo = func(ctx context.Context) error { return client.Ping(ctx, nil) }
+	}
+
+	// Set up the HTTP server with the configured routes and TUS handler.
+	// The router manages endpoints for uploads, HLS streaming, status updates and derived videos.
+	// Every request gets an ID that is attached to the lines logged while serving it.
+	server := &http.Server{
+		Addr:     cfg.ServerAddress,
+		Handler:  logging.RequestID(api.SetupRouter(cfg, tusHandler, repos, jobs, health, live, importer)),
+		ErrorLog: slog.NewLogLogger(slog.Default().Handler(), slog.LevelError),
+	}
+
+	// Start the HTTP server on the specified address from the configuration.
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("Unable to listen", "address", cfg.ServerAddress, "error", err) // Log and terminate if the server cannot start.
+		}
+	}()
+
+	// Log that the server is running.
+	slog.Info("Server running", "address", cfg.ServerAddress)
+
+	// Wait for SIGINT (Ctrl+C) or SIGTERM (docker stop) before shutting down.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	slog.Info("Shutting down", "signal", sig.String(), "grace_period", cfg.ShutdownGrace.String())
+
+	// Everything below has to fit in the grace period. Running jobs and the live stream get
+	// all of it but the last quarter, which is kept for draining the HTTP requests.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownGrace)
+	defer cancel()
+	jobsCtx, cancelJobs := context.WithTimeout(shutdownCtx, cfg.ShutdownGrace-cfg.ShutdownGrace/4)
+	defer cancelJobs()
+
+	// Stop accepting new uploads; uploads in progress keep running while the workers drain.
+	// Live streams are ended, letting ffmpeg finish their playlists, the janitor stops and
+	// running imports are interrupted. Jobs queued by mtvctl are left for the next start.
+	services.StopAcceptingUploads()
+	stopPolling()
+	stopLive()
+	stopJanitor()
+	importer.Shutdown()
+
+	// Let running jobs finish. Jobs still running when their share of the grace period ends are
+	// interrupted and left queued, to be recovered on the next start.
+	if err := pool.Shutdown(jobsCtx); err != nil {
+		slog.Warn("Grace period over, interrupted running jobs", "error", err)
 	}
+
+	// Wait for the live stream to end and be archived, so its events are sent before the status streams close.
+	select {
+	case <-liveDone:
+	case <-jobsCtx.Done():
+	}
+
+	// End the status streams with a final event, then wait for the remaining requests until the
+	// end of the grace period, which leaves them at least its last quarter.
+	services.CloseStatusStreams()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("Forcing HTTP server to close", "error", err)
+		server.Close()
+	}
+
+	// Disconnect from MongoDB once nothing can use it anymore.
+	disconnectCtx, cancelDisconnect := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelDisconnect()
+	if client != nil {
+		if err := client.Disconnect(disconnectCtx); err != nil {
+			slog.Error("Error disconnecting from MongoDB", "error", err)
+		}
+	}
+
+	// Flush the spans that have not been exported yet.
+	if err := shutdownTracing(disconnectCtx); err != nil {
+		slog.Error("Error flushing traces", "error", err)
+	}
+
+	slog.Info("Server stopped")
+}
+
+// openRepositories creates the repositories of the configured storage backend. For the GridFS
+// backend it also returns the MongoDB client, which has to be disconnected on shutdown.
+func openRepositories(cfg config.Config) (*repository.Repositories, *mongo.Client, error) {
+	if cfg.StorageBackend == config.StorageMemory {
+		slog.Warn("Using in-memory storage, nothing is kept across restarts")
+		return repository.NewMemoryRepositories(), nil, nil
+	}
+
+	// Connect to MongoDB using the provided URI from the configuration.
+	client, ctx, err := database.ConnectMongoDB(cfg.MongoURI)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Create the repositories in the configured database, storing media files in the "media"
+	// GridFS bucket. This is also where all MongoDB indexes are created.
+	repos, err := repository.NewMongoRepositories(ctx, client.Database(cfg.DBName), "media")
+	if err != nil {
+		return nil, nil, err
+	}
+	return repos, client, nil
+}
+
+// fatal logs an error that keeps the server from starting and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
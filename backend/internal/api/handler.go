@@ -1,34 +1,38 @@
 package api
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"manhattan_tech_ventures/internal/config"
+	"manhattan_tech_ventures/internal/logging"
+	"manhattan_tech_ventures/internal/metrics"
+	"manhattan_tech_ventures/internal/repository"
 	service "manhattan_tech_ventures/internal/services"
-
-	"go.mongodb.org/mongo-driver/mongo"
+	"manhattan_tech_ventures/internal/tracing"
 )
 
-// Load configuration settings using the LoadConfig function from the config package.
-// This configuration will be used to determine paths for serving HLS streams and other settings.
-var conf config.Config = config.LoadConfig()
-
-// ServeM3U8 handles requests to serve .m3u8 files (HLS playlists) from MongoDB GridFS.
+// ServeM3U8 handles requests to serve .m3u8 files (HLS playlists) from the media repository.
 // It retrieves the desired quality and stream ID from query parameters, constructs the path to the .m3u8 file,
-// and uses the ServeFileFromGridFS function to serve the file to the client.
-func ServeM3U8(dbClient *mongo.Database) http.HandlerFunc {
+// and uses the ServeMediaFile function to serve the file to the client. Paths and qualities come from the configuration.
+// Playlists of live streams are served from local disk by the live ingest instead, when live is not nil;
+// with Low-Latency HLS these support blocking reloads through the _HLS_msn and _HLS_part parameters.
+// With "iframes=true" the rendition's I-frame-only playlist is served instead, for trick play.
+func ServeM3U8(conf config.Config, media repository.MediaRepository, live *service.LiveIngest) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Parse query parameters from the URL
 		queryParams := r.URL.Query()
 
-		// Get the 'quality' parameter from the query, defaulting to "480p" if not provided
+		// Get the 'quality' parameter from the query, defaulting to the lowest configured rendition if not provided
 		quality := queryParams.Get("quality")
 		if quality == "" {
-			quality = "480p"
+			quality = conf.Renditions[0].Name
 		}
 
 		// Get the 'stream_id' parameter from the query
@@ -39,28 +43,82 @@ func ServeM3U8(dbClient *mongo.Database) http.HandlerFunc {
 			return
 		}
 
+		// Trace the playback request, continuing the player's trace if it sent one
+		ctx, span := tracing.StartRequest(r, "hls.playlist", tracing.UploadID.String(streamId), tracing.Rendition.String(quality))
+		defer span.End()
+		r = r.WithContext(ctx)
+
+		// I-frame playlists are only written for stored videos, never for live streams
+		iframes, _ := strconv.ParseBool(queryParams.Get("iframes"))
+		if iframes {
+			m3u8FilePath := "./" + filepath.Join(conf.TranscodedFilePath, quality, streamId, "m3u8", service.IFramePlaylistName(quality))
+			metrics.HLSRequests.WithLabelValues(qualityLabel(conf.Renditions, quality), "iframe_playlist").Inc()
+			service.ServeMediaFile(w, r, media, m3u8FilePath)
+			return
+		}
+
+		// Serve live streams from the live ingest's DVR window
+		if live != nil && live.ServePlaylist(w, r, streamId, quality) {
+			metrics.HLSRequests.WithLabelValues(qualityLabel(conf.Renditions, quality), "playlist").Inc()
+			return
+		}
+
 		// Construct the directory and file path for the .m3u8 playlist based on quality and stream ID
 		m3u8Dir := filepath.Join(conf.TranscodedFilePath, quality, streamId, "m3u8")
 		m3u8FilePath := "./" + filepath.Join(m3u8Dir, quality+".m3u8")
 
-		// Serve the .m3u8 file from GridFS using the constructed file path
-		service.ServeFileFromGridFS(w, r, dbClient, m3u8FilePath, "media")
+		// Count the request and serve the .m3u8 file from the media repository using the constructed file path
+		metrics.HLSRequests.WithLabelValues(qualityLabel(conf.Renditions, quality), "playlist").Inc()
+		service.ServeMediaFile(w, r, media, m3u8FilePath)
+	}
+}
+
+// ServeMasterPlaylist handles requests for the master playlist of a stored video. It lists
+// every stored rendition with its measured bandwidth, and the I-frame playlists used for
+// fast-forward and thumbnail scrubbing. Renditions come from the configuration.
+func ServeMasterPlaylist(conf config.Config, media repository.MediaRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the 'stream_id' parameter from the query
+		streamId := r.URL.Query().Get("stream_id")
+		if streamId == "" {
+			http.Error(w, "Missing stream parameter", http.StatusBadRequest)
+			return
+		}
+
+		// Trace the playback request, continuing the player's trace if it sent one
+		ctx, span := tracing.StartRequest(r, "hls.master", tracing.UploadID.String(streamId))
+		defer span.End()
+
+		metrics.HLSRequests.WithLabelValues("all", "master").Inc()
+		playlist, err := service.BuildMasterPlaylist(ctx, media, conf.TranscodedFilePath, service.RenditionsFromConfig(conf.Renditions), streamId)
+		if errors.Is(err, repository.ErrNotFound) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to build master playlist", http.StatusInternalServerError)
+			logging.FromContext(ctx).Error("Failed to build master playlist", "error", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/text")
+		io.WriteString(w, playlist)
 	}
 }
 
-// ServeHLS handles requests to serve HLS segments (.ts files) from MongoDB GridFS.
+// ServeHLS handles requests to serve HLS segments (.ts files) from the media repository.
 // It parses the URL path to extract the quality, stream ID, and filename of the .ts segment,
-// constructs the full path, and uses ServeFileFromGridFS to serve the file.
-func ServeHLS(dbClient *mongo.Database) http.HandlerFunc {
+// constructs the full path, and uses ServeMediaFile to serve the file. Segments of live streams
+// are served from local disk by the live ingest instead, when live is not nil.
+func ServeHLS(conf config.Config, media repository.MediaRepository, live *service.LiveIngest) http.HandlerFunc {
 	// Log the current client channel, primarily for debugging purposes
-	log.Print(service.GetCurrClientChan())
+	slog.Debug("Serving HLS segments", "client_channel", fmt.Sprint(service.GetCurrClientChan()))
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Split the URL path to extract variables such as quality, stream ID, and filename
 		parts := strings.Split(r.URL.Path, "/")
 
 		// Check if the path is in the expected format; if not, return a bad request error
-		if len(parts) < 5 {
+		if len(parts) < 6 {
 			http.Error(w, "Invalid URL format", http.StatusBadRequest)
 			return
 		}
@@ -70,10 +128,33 @@ func ServeHLS(dbClient *mongo.Database) http.HandlerFunc {
 		streamID := parts[3]
 		filename := parts[5]
 
+		// Trace the playback request, continuing the player's trace if it sent one
+		ctx, span := tracing.StartRequest(r, "hls.segment", tracing.UploadID.String(streamID), tracing.Rendition.String(quality))
+		defer span.End()
+		r = r.WithContext(ctx)
+
+		// Serve live streams from the live ingest's DVR window
+		if live != nil && live.ServeSegment(w, r, streamID, quality, filename) {
+			metrics.HLSRequests.WithLabelValues(qualityLabel(conf.Renditions, quality), "segment").Inc()
+			return
+		}
+
 		// Construct the full path to the .ts segment based on the extracted variables
 		filePath := fmt.Sprintf("%s/%s/%s/ts/%s", conf.TranscodedFilePath, quality, streamID, filename)
 
-		// Serve the .ts file from GridFS using the constructed file path
-		service.ServeFileFromGridFS(w, r, dbClient, filePath, "media")
+		// Count the request and serve the .ts file from the media repository using the constructed file path
+		metrics.HLSRequests.WithLabelValues(qualityLabel(conf.Renditions, quality), "segment").Inc()
+		service.ServeMediaFile(w, r, media, filePath)
+	}
+}
+
+// qualityLabel returns the quality to record in metrics for a requested quality. Unknown
+// qualities are grouped as "other", so arbitrary request paths cannot create new series.
+func qualityLabel(renditions []config.Rendition, quality string) string {
+	for _, rendition := range renditions {
+		if rendition.Name == quality {
+			return quality
+		}
 	}
+	return "other"
 }
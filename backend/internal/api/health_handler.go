@@ -0,0 +1,31 @@
+package api
+
+import (
+	"net/http"
+
+	service "manhattan_tech_ventures/internal/services"
+)
+
+// Healthz reports that the process is alive and able to serve HTTP requests.
+// It checks no dependencies, so a failing database never gets the process restarted.
+func Healthz() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": service.HealthStatusOK})
+	}
+}
+
+// Readyz reports whether the service can take traffic: MongoDB answers, the upload and output
+// directories are writable with enough free space, ffmpeg and ffprobe are installed and the
+// worker pool is running. It responds 200 with the details of every check when all of them
+// pass and 503 when any of them is degraded.
+func Readyz(checker *service.HealthChecker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := checker.Check(r.Context())
+
+		status := http.StatusOK
+		if report.Status != service.HealthStatusOK {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, report)
+	}
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"manhattan_tech_ventures/internal/config"
+	"manhattan_tech_ventures/internal/logging"
+	"manhattan_tech_ventures/internal/repository"
+	service "manhattan_tech_ventures/internal/services"
+
+	"github.com/tus/tusd/v2/pkg/handler"
+)
+
+// ImportRequest is the body accepted by the import endpoint. Everything but the URL is optional.
+type ImportRequest struct {
+	URL         string            `json:"url"`         // HTTP or HTTPS URL to download the source file from
+	Headers     map[string]string `json:"headers"`     // Headers to send with every request for the file, e.g. Authorization
+	Checksum    string            `json:"checksum"`    // Expected checksum of the file, e.g. "sha256:<hex>"
+	Size        int64             `json:"size"`        // Size of the file in bytes, checked against the storage quota before downloading
+	Filename    string            `json:"filename"`    // Name to register the file as; taken from the URL by default
+	Title       string            `json:"title"`       // Title of the video
+	Description string            `json:"description"` // Description of the video
+	Tags        []string          `json:"tags"`        // Tags of the video
+}
+
+// CreateImport handles POST /imports. It registers a video for a source file on another HTTP
+// server and starts downloading it in the background. Once the download is verified, the video
+// is queued for transcoding like a completed upload; progress is reported on the status stream.
+func CreateImport(conf config.Config, repos *repository.Repositories, importer *service.Importer) http.HandlerFunc {
+	users := service.NewRequestUsers(conf)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireMethod(w, r, http.MethodPost) {
+			return
+		}
+
+		var req ImportRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid import request: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		source := service.ImportSource{URL: req.URL, Header: make(http.Header), Checksum: req.Checksum}
+		for key, value := range req.Headers {
+			// The importer sets the range headers itself to resume downloads
+			if canonical := http.CanonicalHeaderKey(key); canonical != "Range" && canonical != "If-Range" {
+				source.Header.Set(canonical, value)
+			}
+		}
+		if err := service.ValidateImportSource(source); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid import request: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		if req.Size < 0 {
+			http.Error(w, "Invalid import request: size must not be negative", http.StatusBadRequest)
+			return
+		}
+
+		videoID, err := repository.NewID()
+		if err != nil {
+			http.Error(w, "Failed to create video", http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Error("Failed to create video", "error", err)
+			return
+		}
+
+		// Reserve the declared size before anything is downloaded; the download reserves the
+		// actual size once it is known
+		owner := users.User(r.Header, r.RemoteAddr)
+		if err := importer.Reserve(r.Context(), videoID, owner, req.Size); err != nil {
+			var rejection handler.Error
+			if errors.As(err, &rejection) {
+				http.Error(w, rejection.Error(), rejection.HTTPResponse.StatusCode)
+			} else {
+				http.Error(w, "Failed to check storage quota", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		// Clean the descriptive fields the same way as tus upload metadata
+		metadata := service.ParseUploadMetadata(map[string]string{
+			"filename":    req.Filename,
+			"title":       req.Title,
+			"description": req.Description,
+			"tags":        strings.Join(req.Tags, ","),
+		})
+		filename := metadata.Filename
+		if filename == "" {
+			filename = service.ImportFilename(req.URL)
+		}
+		if filename == "" {
+			filename = videoID
+		}
+
+		video := &repository.Video{
+			ID:          videoID,
+			Filename:    filename,
+			Title:       metadata.Title,
+			Description: metadata.Description,
+			Tags:        metadata.Tags,
+			Owner:       owner,
+			ImportURL:   service.ImportURL(req.URL),
+			Status:      repository.VideoStatusImporting,
+		}
+		if err := repos.Videos.Create(r.Context(), video); err != nil {
+			importer.Release(videoID)
+			http.Error(w, "Failed to create video", http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Error("Failed to create video", "error", err)
+			return
+		}
+
+		importer.Start(*video, source)
+		writeJSON(w, http.StatusAccepted, video)
+	}
+}
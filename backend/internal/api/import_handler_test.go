@@ -0,0 +1,71 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"manhattan_tech_ventures/internal/config"
+	"manhattan_tech_ventures/internal/repository"
+	service "manhattan_tech_ventures/internal/services"
+)
+
+func TestCreateImportRejectsImportsOverQuota(t *testing.T) {
+	conf := config.Default()
+	conf.UploadPath = t.TempDir()
+	conf.UploadQuotaMB = 1
+	repos := repository.NewMemoryRepositories()
+	// httptest requests come from 192.0.2.1, which names the user without a trusted proxy
+	used := &repository.Video{ID: "stored", Owner: "192.0.2.1", Size: 1024*1024 - 100, Status: repository.VideoStatusReady}
+	if err := repos.Videos.Create(context.Background(), used); err != nil {
+		t.Fatal(err)
+	}
+	handler := CreateImport(conf, repos, service.NewImporter(conf, repos, make(chan service.Job, 1), service.NewUploadLimits(conf, repos.Videos)))
+
+	post := func(body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest(http.MethodPost, "/imports", strings.NewReader(body)))
+		return recorder
+	}
+
+	response := post(`{"url": "https://example.com/talk.mp4", "size": 101}`)
+	if response.Code != http.StatusRequestEntityTooLarge || !strings.HasPrefix(response.Body.String(), "ERR_QUOTA_EXCEEDED: ") {
+		t.Errorf("import over the quota got status %d (%s), want the tus quota error", response.Code, strings.TrimSpace(response.Body.String()))
+	}
+	if response := post(`{"url": "https://example.com/talk.mp4", "size": -1}`); response.Code != http.StatusBadRequest {
+		t.Errorf("import with a negative size got status %d, want 400", response.Code)
+	}
+	if videos, _ := repos.Videos.List(context.Background()); len(videos) != 1 {
+		t.Errorf("catalog holds %d videos, want only the stored one", len(videos))
+	}
+}
+
+func TestCreateImportReservesDeclaredSize(t *testing.T) {
+	// The source never finishes, so the first import holds its reservation
+	release := make(chan struct{})
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer source.Close()
+	defer close(release)
+
+	conf := config.Default()
+	conf.UploadPath = t.TempDir()
+	conf.UploadQuotaMB = 1
+	conf.ImportAllowPrivate = true
+	repos := repository.NewMemoryRepositories()
+	importer := service.NewImporter(conf, repos, make(chan service.Job, 1), service.NewUploadLimits(conf, repos.Videos))
+	defer importer.Shutdown()
+	handler := CreateImport(conf, repos, importer)
+
+	body := `{"url": "` + source.URL + `/talk.mp4", "size": 600000}`
+	for i, want := range []int{http.StatusAccepted, http.StatusRequestEntityTooLarge} {
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest(http.MethodPost, "/imports", strings.NewReader(body)))
+		if recorder.Code != want {
+			t.Errorf("import %d got status %d (%s), want %d", i+1, recorder.Code, strings.TrimSpace(recorder.Body.String()), want)
+		}
+	}
+}
@@ -3,10 +3,12 @@ package api
 import (
 	"net/http"
 
+	"manhattan_tech_ventures/internal/config"
+	"manhattan_tech_ventures/internal/metrics"
+	"manhattan_tech_ventures/internal/repository"
 	service "manhattan_tech_ventures/internal/services"
 
 	"github.com/tus/tusd/v2/pkg/handler"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 // enableCORS is a middleware function that adds Cross-Origin Resource Sharing (CORS) headers
@@ -16,8 +18,9 @@ func enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Set CORS headers to allow all origins, methods, and specific headers.
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Request-ID, Range")
+		w.Header().Set("Access-Control-Expose-Headers", "Accept-Ranges, Content-Range, Content-Length")
 
 		// Handle preflight OPTIONS requests used by browsers to check CORS policy.
 		if r.Method == http.MethodOptions {
@@ -33,25 +36,47 @@ func enableCORS(next http.Handler) http.Handler {
 
 // SetupRouter configures the HTTP router for the application by setting up routes
 // for various endpoints such as file uploads, HLS streaming, and status updates.
-// It integrates the TUS handler for file uploads and serves HLS media from GridFS.
-func SetupRouter(tusHandler *handler.Handler, db *mongo.Database) *http.ServeMux {
+// It integrates the TUS handler for file uploads, serves HLS media from the media repository
+// and queues jobs for videos derived from existing uploads. The health checker backs the
+// readiness endpoint used by orchestrators. Paths and renditions are taken from the configuration.
+// Live streams are served from the live ingest, which is nil when live ingest is disabled, and
+// imports from URLs are downloaded by the importer.
+func SetupRouter(conf config.Config, tusHandler *handler.Handler, repos *repository.Repositories, jobs chan<- service.Job, health *service.HealthChecker, live *service.LiveIngest, importer *service.Importer) *http.ServeMux {
 	// Create a new ServeMux to handle routing.
 	api := http.NewServeMux()
 
+	// Set up liveness and readiness endpoints for orchestrators and load balancers.
+	api.Handle("/healthz", Healthz())
+	api.Handle("/readyz", Readyz(health))
+
+	// Expose upload, job, transcoding, status stream, GridFS and HLS metrics to Prometheus.
+	api.Handle("/metrics", metrics.Handler())
+
 	// Set up an endpoint for server-sent events to stream status updates to clients.
 	api.HandleFunc("/status/stream", func(w http.ResponseWriter, r *http.Request) {
 		service.StatusStreamHandler(w, r)
 	})
 
 	// Set up TUS file upload endpoints, allowing clients to upload files to "/files/".
-	// The uploaded files are managed by the TUS handler passed to the function.
-	api.Handle("/files/", http.StripPrefix("/files/", tusHandler))
-	api.Handle("/files", http.StripPrefix("/files", tusHandler))
+	// The uploaded files are managed by the TUS handler passed to the function; new uploads
+	// are refused once the server starts shutting down. Responses tell clients when unfinished
+	// uploads expire.
+	uploads := service.UploadGate(service.ExpireUploads(conf.UploadPath, conf.UploadExpiry, tusHandler))
+	api.Handle("/files/", http.StripPrefix("/files/", uploads))
+	api.Handle("/files", http.StripPrefix("/files", uploads))
 
-	// Set up endpoints for serving HLS playlists (.m3u8) and segments (.ts) from GridFS.
+	// Set up the endpoint importing videos from other HTTP servers; like uploads, new imports
+	// are refused once the server starts shutting down.
+	api.Handle("/imports", enableCORS(service.UploadGate(CreateImport(conf, repos, importer))))
+
+	// Set up endpoints for serving HLS playlists (.m3u8) and segments (.ts) from the media repository.
 	// CORS is enabled on these endpoints to allow requests from different origins.
-	api.Handle("/hls", enableCORS(ServeM3U8(db)))    // Serve .m3u8 playlists
-	api.Handle("/output/", enableCORS(ServeHLS(db))) // Serve HLS .ts segments
+	api.Handle("/hls", enableCORS(ServeM3U8(conf, repos.Media, live)))            // Serve .m3u8 playlists
+	api.Handle("/hls/master", enableCORS(ServeMasterPlaylist(conf, repos.Media))) // Serve master playlists with I-frame variants
+	api.Handle("/output/", enableCORS(ServeHLS(conf, repos.Media, live)))         // Serve HLS .ts segments
+
+	// Set up endpoints for working with videos in the catalog, such as creating clips.
+	api.Handle("/videos/", enableCORS(VideoRoutes(conf, repos, jobs)))
 
 	// Serve static files from the "./web/static" directory for the root path.
 	// This can be used for serving frontend assets like HTML, CSS, and JavaScript.
@@ -0,0 +1,365 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"manhattan_tech_ventures/internal/config"
+	"manhattan_tech_ventures/internal/logging"
+	"manhattan_tech_ventures/internal/repository"
+	service "manhattan_tech_ventures/internal/services"
+)
+
+// Timestamp is a position within a video in seconds. In JSON it accepts either a number of
+// seconds (e.g. 75.5) or a clock string in "HH:MM:SS(.mmm)" or "MM:SS(.mmm)" form.
+type Timestamp float64
+
+// UnmarshalJSON parses a Timestamp from a JSON number or clock string.
+func (t *Timestamp) UnmarshalJSON(data []byte) error {
+	var seconds float64
+	if err := json.Unmarshal(data, &seconds); err == nil {
+		*t = Timestamp(seconds)
+		return nil
+	}
+
+	var clock string
+	if err := json.Unmarshal(data, &clock); err != nil {
+		return fmt.Errorf("timestamp must be a number of seconds or a HH:MM:SS string")
+	}
+
+	parsed, err := parseClock(clock)
+	if err != nil {
+		return err
+	}
+	*t = Timestamp(parsed)
+	return nil
+}
+
+// parseClock converts "SS", "MM:SS" or "HH:MM:SS", each with optional fractional seconds, to seconds.
+func parseClock(clock string) (float64, error) {
+	parts := strings.Split(strings.TrimSpace(clock), ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("invalid timestamp %q", clock)
+	}
+
+	var seconds float64
+	for _, part := range parts {
+		value, err := strconv.ParseFloat(part, 64)
+		if err != nil || value < 0 {
+			return 0, fmt.Errorf("invalid timestamp %q", clock)
+		}
+		seconds = seconds*60 + value
+	}
+	return seconds, nil
+}
+
+// maxConcatSources limits how many videos a single concatenation request may join.
+const maxConcatSources = 50
+
+// ConcatRequest is the body accepted by the concatenation endpoint. The target format
+// fields are optional and default to the format of the first source video.
+type ConcatRequest struct {
+	Sources   []string `json:"sources"`    // IDs of the videos to join, in playback order
+	Width     int      `json:"width"`      // Target frame width in pixels
+	Height    int      `json:"height"`     // Target frame height in pixels
+	FrameRate float64  `json:"frame_rate"` // Target frame rate in frames per second
+}
+
+// ClipRequest is the body accepted by the clip creation endpoint.
+type ClipRequest struct {
+	Start Timestamp `json:"start"` // Start of the clip within the parent video
+	End   Timestamp `json:"end"`   // End of the clip within the parent video
+}
+
+// writeJSON encodes v as the JSON response body with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Failed to write JSON response", "error", err)
+	}
+}
+
+// VideoRoutes dispatches requests under "/videos/" to the matching video handler.
+// The path is split manually, in the same way ServeHLS parses segment URLs.
+func VideoRoutes(conf config.Config, repos *repository.Repositories, jobs chan<- service.Job) http.HandlerFunc {
+	createClip := CreateClip(conf, repos, jobs)
+	createConcat := CreateConcat(conf, repos, jobs)
+	downloadVideo := DownloadVideo(conf, repos, &service.MP4Exporter{Media: repos.Media, TranscodedPath: conf.TranscodedFilePath})
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Expected formats: /videos/concat and /videos/{id}/{action}
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+		switch {
+		case len(parts) == 2 && parts[1] == "concat":
+			if requireMethod(w, r, http.MethodPost) {
+				createConcat(w, r)
+			}
+		case len(parts) == 3 && parts[1] != "" && parts[2] == "clips":
+			if requireMethod(w, r, http.MethodPost) {
+				createClip(w, r, parts[1])
+			}
+		case len(parts) == 3 && parts[1] != "" && parts[2] == "download":
+			if r.Method == http.MethodHead || requireMethod(w, r, http.MethodGet) {
+				downloadVideo(w, r, parts[1])
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}
+}
+
+// requireMethod reports whether the request uses the given method, replying with
+// 405 Method Not Allowed when it does not.
+func requireMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+// lookupSourceVideo loads a video that is about to be used as the source of a derived video,
+// making sure its source file is still available in the upload path. On failure it writes
+// the error response and returns false.
+func lookupSourceVideo(w http.ResponseWriter, r *http.Request, repos *repository.Repositories, uploadPath string, id string) (*repository.Video, string, bool) {
+	video, err := repos.Videos.Get(r.Context(), id)
+	if errors.Is(err, repository.ErrNotFound) {
+		http.Error(w, fmt.Sprintf("Video %s not found", id), http.StatusNotFound)
+		return nil, "", false
+	} else if err != nil {
+		http.Error(w, "Failed to look up video", http.StatusInternalServerError)
+		logging.FromContext(r.Context()).Error("Failed to look up video", "error", err)
+		return nil, "", false
+	}
+
+	sourcePath := filepath.Join(uploadPath, video.ID)
+	if _, err := os.Stat(sourcePath); err != nil {
+		http.Error(w, fmt.Sprintf("Source file of video %s is no longer available", id), http.StatusConflict)
+		logging.FromContext(r.Context()).Warn("Source of video unavailable", logging.UploadIDKey, video.ID, "error", err)
+		return nil, "", false
+	}
+	return video, sourcePath, true
+}
+
+// DownloadVideo handles GET /videos/{id}/download?quality=720p. It serves the chosen rendition
+// (the highest configured one by default) as a single faststart MP4, which is generated on
+// the first request and cached in the media repository. Like playback through /hls, the
+// download needs no credentials. Range requests are supported, and the file is offered under
+// the name the video was uploaded with.
+func DownloadVideo(conf config.Config, repos *repository.Repositories, exporter *service.MP4Exporter) func(http.ResponseWriter, *http.Request, string) {
+	return func(w http.ResponseWriter, r *http.Request, videoID string) {
+		quality := r.URL.Query().Get("quality")
+		if quality == "" {
+			quality = conf.Renditions[len(conf.Renditions)-1].Name
+		}
+		var rendition service.RenditionSpec
+		for _, spec := range service.RenditionsFromConfig(conf.Renditions) {
+			if spec.Name == quality {
+				rendition = spec
+			}
+		}
+		if rendition.Name == "" {
+			http.Error(w, fmt.Sprintf("Unknown quality %s", quality), http.StatusBadRequest)
+			return
+		}
+
+		video, err := repos.Videos.Get(r.Context(), videoID)
+		if errors.Is(err, repository.ErrNotFound) {
+			http.Error(w, fmt.Sprintf("Video %s not found", videoID), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to look up video", http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Error("Failed to look up video", "error", err)
+			return
+		}
+		if video.Status != repository.VideoStatusReady {
+			http.Error(w, fmt.Sprintf("Video %s is not ready for download", videoID), http.StatusConflict)
+			return
+		}
+
+		name, err := exporter.Export(r.Context(), video.ID, rendition)
+		if errors.Is(err, repository.ErrNotFound) {
+			http.Error(w, fmt.Sprintf("Video %s has no %s rendition", videoID, quality), http.StatusNotFound)
+			return
+		} else if r.Context().Err() != nil {
+			return // The client went away; the export carries on for the next request
+		} else if err != nil {
+			http.Error(w, "Failed to export video", http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Error("Failed to export video", logging.UploadIDKey, video.ID, "error", err)
+			return
+		}
+
+		// Offer the file under its upload name, e.g. "holiday_720p.mp4"
+		uploadName := video.Filename
+		if uploadName == video.ID {
+			uploadName = service.UploadFilename(conf.UploadPath, video.ID)
+		}
+		stem := strings.TrimSuffix(uploadName, path.Ext(uploadName))
+		if stem == "" {
+			stem = video.ID
+		}
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": stem + "_" + quality + ".mp4"}))
+		service.ServeMediaFile(w, r, repos.Media, name)
+	}
+}
+
+// CreateClip handles POST /videos/{id}/clips. It validates the requested range against the
+// parent video, registers the clip as a new video that links back to its parent, and queues
+// a transcode job which cuts the range out of the parent's source file before transcoding it.
+func CreateClip(conf config.Config, repos *repository.Repositories, jobs chan<- service.Job) func(http.ResponseWriter, *http.Request, string) {
+	return func(w http.ResponseWriter, r *http.Request, parentID string) {
+		var req ClipRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid clip request: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		start, end := float64(req.Start), float64(req.End)
+		if start < 0 || end <= start {
+			http.Error(w, "Clip end must be after its start", http.StatusBadRequest)
+			return
+		}
+
+		// The parent must be a known video whose source file is still available
+		parent, sourcePath, ok := lookupSourceVideo(w, r, repos, conf.UploadPath, parentID)
+		if !ok {
+			return
+		}
+
+		duration, err := service.ProbeDuration(r.Context(), sourcePath)
+		if err != nil {
+			http.Error(w, "Failed to read video duration", http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Error("Failed to read video duration", "error", err)
+			return
+		}
+		if end > duration {
+			http.Error(w, fmt.Sprintf("Clip end exceeds video duration of %.3fs", duration), http.StatusBadRequest)
+			return
+		}
+
+		clipID, err := repository.NewID()
+		if err != nil {
+			http.Error(w, "Failed to create clip", http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Error("Failed to create clip", "error", err)
+			return
+		}
+
+		clip := &repository.Video{
+			ID:        clipID,
+			Filename:  clipID,
+			Status:    repository.VideoStatusQueued,
+			ParentID:  parent.ID,
+			ClipStart: start,
+			ClipEnd:   end,
+		}
+		if err := repos.Videos.Create(r.Context(), clip); err != nil {
+			http.Error(w, "Failed to create clip", http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Error("Failed to create clip", "error", err)
+			return
+		}
+
+		// Queue the clip on the regular transcode pipeline
+		err = service.EnqueueJob(r.Context(), repos, jobs, service.Job{
+			UploadPath:     conf.UploadPath,
+			TranscodedPath: conf.TranscodedFilePath,
+			Filename:       clipID,
+			ClientChan:     service.GetCurrClientChan(),
+			Clip: &repository.ClipSpec{
+				ParentFilename: parent.ID,
+				Start:          start,
+				End:            end,
+			},
+		})
+		if err != nil {
+			http.Error(w, "Failed to queue clip", http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Error("Failed to queue clip", "error", err)
+			return
+		}
+
+		writeJSON(w, http.StatusAccepted, clip)
+	}
+}
+
+// CreateConcat handles POST /videos/concat. It checks that every listed video can be used as a
+// source, registers the concatenation as a new video and queues a job that normalizes and joins
+// the sources before running them through the regular transcode pipeline.
+func CreateConcat(conf config.Config, repos *repository.Repositories, jobs chan<- service.Job) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ConcatRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid concat request: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		if len(req.Sources) < 2 || len(req.Sources) > maxConcatSources {
+			http.Error(w, fmt.Sprintf("Between 2 and %d source videos are required", maxConcatSources), http.StatusBadRequest)
+			return
+		}
+		if req.Width < 0 || req.Height < 0 || req.FrameRate < 0 || (req.Width == 0) != (req.Height == 0) {
+			http.Error(w, "Width and height must be given together and be positive", http.StatusBadRequest)
+			return
+		}
+
+		// Every source must be a known video whose source file is still available
+		sourceFilenames := make([]string, len(req.Sources))
+		for i, sourceID := range req.Sources {
+			source, _, ok := lookupSourceVideo(w, r, repos, conf.UploadPath, sourceID)
+			if !ok {
+				return
+			}
+			sourceFilenames[i] = source.ID
+		}
+
+		videoID, err := repository.NewID()
+		if err != nil {
+			http.Error(w, "Failed to create video", http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Error("Failed to create video", "error", err)
+			return
+		}
+
+		video := &repository.Video{
+			ID:        videoID,
+			Filename:  videoID,
+			Status:    repository.VideoStatusQueued,
+			SourceIDs: req.Sources,
+		}
+		if err := repos.Videos.Create(r.Context(), video); err != nil {
+			http.Error(w, "Failed to create video", http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Error("Failed to create video", "error", err)
+			return
+		}
+
+		// Queue the concatenation on the regular transcode pipeline
+		err = service.EnqueueJob(r.Context(), repos, jobs, service.Job{
+			UploadPath:     conf.UploadPath,
+			TranscodedPath: conf.TranscodedFilePath,
+			Filename:       videoID,
+			ClientChan:     service.GetCurrClientChan(),
+			Concat: &repository.ConcatSpec{
+				SourceFilenames: sourceFilenames,
+				Width:           req.Width,
+				Height:          req.Height,
+				FrameRate:       req.FrameRate,
+			},
+		})
+		if err != nil {
+			http.Error(w, "Failed to queue concatenation", http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Error("Failed to queue concatenation", "error", err)
+			return
+		}
+
+		writeJSON(w, http.StatusAccepted, video)
+	}
+}
@@ -0,0 +1,231 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"manhattan_tech_ventures/internal/config"
+	"manhattan_tech_ventures/internal/repository"
+	service "manhattan_tech_ventures/internal/services"
+)
+
+// videoRoutesTest holds the handler under test and what it works on.
+type videoRoutesTest struct {
+	conf    config.Config
+	repos   *repository.Repositories
+	jobs    chan service.Job
+	handler http.HandlerFunc
+}
+
+// newVideoRoutesTest sets up VideoRoutes on in-memory repositories and a temporary upload path.
+func newVideoRoutesTest(t *testing.T) *videoRoutesTest {
+	t.Helper()
+	conf := config.Default()
+	conf.UploadPath = t.TempDir()
+	conf.TranscodedFilePath = t.TempDir()
+	repos := repository.NewMemoryRepositories()
+	jobs := make(chan service.Job, 10)
+	return &videoRoutesTest{conf: conf, repos: repos, jobs: jobs, handler: VideoRoutes(conf, repos, jobs)}
+}
+
+// addVideo registers a ready video and, unless contents is nil, writes its source file.
+func (v *videoRoutesTest) addVideo(t *testing.T, id string, contents []byte) {
+	t.Helper()
+	if err := v.repos.Videos.Create(context.Background(), &repository.Video{ID: id, Filename: id + ".mp4", Status: repository.VideoStatusReady}); err != nil {
+		t.Fatal(err)
+	}
+	if contents != nil {
+		if err := os.WriteFile(filepath.Join(v.conf.UploadPath, id), contents, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// do sends a request to the handler and returns the response.
+func (v *videoRoutesTest) do(method string, path string, body string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	v.handler(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return recorder
+}
+
+// queuedJob returns the job the handler queued, failing the test if there is none.
+func (v *videoRoutesTest) queuedJob(t *testing.T) service.Job {
+	t.Helper()
+	select {
+	case job := <-v.jobs:
+		return job
+	default:
+		t.Fatal("no job was queued")
+		return service.Job{}
+	}
+}
+
+// checkCreatedVideo decodes the video in a 202 response and checks it was recorded as queued.
+func (v *videoRoutesTest) checkCreatedVideo(t *testing.T, response *httptest.ResponseRecorder) repository.Video {
+	t.Helper()
+	if response.Code != http.StatusAccepted {
+		t.Fatalf("got status %d (%s), want 202", response.Code, strings.TrimSpace(response.Body.String()))
+	}
+	var video repository.Video
+	if err := json.NewDecoder(response.Body).Decode(&video); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := v.repos.Videos.Get(context.Background(), video.ID)
+	if err != nil {
+		t.Fatalf("created video is not in the catalog: %v", err)
+	}
+	if stored.Status != repository.VideoStatusQueued {
+		t.Errorf("created video has status %s, want queued", stored.Status)
+	}
+	return *stored
+}
+
+// checkJobRecord returns the only job record, checking that it is queued for the given job.
+func (v *videoRoutesTest) checkJobRecord(t *testing.T, job service.Job) repository.JobRecord {
+	t.Helper()
+	records, err := v.repos.Jobs.List(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("got %d job records, want 1", len(records))
+	}
+	record := records[0]
+	if record.ID != job.ID || record.VideoID != job.Filename || record.Status != repository.JobStatusQueued {
+		t.Errorf("job record is %+v, want a queued record of job %s", record, job.ID)
+	}
+	return record
+}
+
+func TestCreateConcat(t *testing.T) {
+	v := newVideoRoutesTest(t)
+	v.addVideo(t, "first", []byte("first source"))
+	v.addVideo(t, "second", []byte("second source"))
+
+	response := v.do(http.MethodPost, "/videos/concat", `{"sources": ["first", "second"], "width": 1280, "height": 720, "frame_rate": 30}`)
+	video := v.checkCreatedVideo(t, response)
+	if !slices.Equal(video.SourceIDs, []string{"first", "second"}) {
+		t.Errorf("created video has sources %v, want first and second", video.SourceIDs)
+	}
+
+	job := v.queuedJob(t)
+	if job.Filename != video.ID || job.Concat == nil || job.Clip != nil {
+		t.Fatalf("queued job %+v, want a concatenation producing %s", job, video.ID)
+	}
+	want := repository.ConcatSpec{SourceFilenames: []string{"first", "second"}, Width: 1280, Height: 720, FrameRate: 30}
+	if !slices.Equal(job.Concat.SourceFilenames, want.SourceFilenames) || job.Concat.Width != want.Width ||
+		job.Concat.Height != want.Height || job.Concat.FrameRate != want.FrameRate {
+		t.Errorf("queued concatenation is %+v, want %+v", *job.Concat, want)
+	}
+	if record := v.checkJobRecord(t, job); record.Concat == nil || !slices.Equal(record.Concat.SourceFilenames, want.SourceFilenames) {
+		t.Errorf("job record has concatenation %+v, want the sources of the request", record.Concat)
+	}
+}
+
+func TestCreateConcatRejectsInvalidRequests(t *testing.T) {
+	v := newVideoRoutesTest(t)
+	v.addVideo(t, "first", []byte("first source"))
+	v.addVideo(t, "second", []byte("second source"))
+	v.addVideo(t, "deleted", nil) // Its source file is gone
+
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		want   int
+	}{
+		{"invalid JSON", http.MethodPost, `{"sources": `, http.StatusBadRequest},
+		{"one source", http.MethodPost, `{"sources": ["first"]}`, http.StatusBadRequest},
+		{"width without height", http.MethodPost, `{"sources": ["first", "second"], "width": 1280}`, http.StatusBadRequest},
+		{"unknown source", http.MethodPost, `{"sources": ["first", "unknown"]}`, http.StatusNotFound},
+		{"source without file", http.MethodPost, `{"sources": ["first", "deleted"]}`, http.StatusConflict},
+		{"wrong method", http.MethodGet, "", http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if response := v.do(test.method, "/videos/concat", test.body); response.Code != test.want {
+				t.Errorf("got status %d (%s), want %d", response.Code, strings.TrimSpace(response.Body.String()), test.want)
+			}
+		})
+	}
+
+	// Only the three source videos are in the catalog and nothing was queued
+	if videos, _ := v.repos.Videos.List(context.Background()); len(videos) != 3 {
+		t.Errorf("catalog holds %d videos, want the 3 sources", len(videos))
+	}
+	if len(v.jobs) != 0 {
+		t.Errorf("%d jobs were queued for invalid requests", len(v.jobs))
+	}
+}
+
+func TestCreateClipRejectsInvalidRequests(t *testing.T) {
+	v := newVideoRoutesTest(t)
+	v.addVideo(t, "deleted", nil) // Its source file is gone
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{"invalid JSON", http.MethodPost, "/videos/deleted/clips", `{"start": `, http.StatusBadRequest},
+		{"invalid timestamp", http.MethodPost, "/videos/deleted/clips", `{"start": "1:x", "end": 5}`, http.StatusBadRequest},
+		{"end before start", http.MethodPost, "/videos/deleted/clips", `{"start": "00:01:00", "end": 30}`, http.StatusBadRequest},
+		{"unknown parent", http.MethodPost, "/videos/unknown/clips", `{"start": 0, "end": 5}`, http.StatusNotFound},
+		{"parent without file", http.MethodPost, "/videos/deleted/clips", `{"start": 0, "end": 5}`, http.StatusConflict},
+		{"wrong method", http.MethodGet, "/videos/deleted/clips", "", http.StatusMethodNotAllowed},
+		{"unknown action", http.MethodPost, "/videos/deleted/frames", "", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if response := v.do(test.method, test.path, test.body); response.Code != test.want {
+				t.Errorf("got status %d (%s), want %d", response.Code, strings.TrimSpace(response.Body.String()), test.want)
+			}
+		})
+	}
+	if len(v.jobs) != 0 {
+		t.Errorf("%d jobs were queued for invalid requests", len(v.jobs))
+	}
+}
+
+func TestCreateClip(t *testing.T) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		t.Skip("ffmpeg is not installed")
+	}
+	v := newVideoRoutesTest(t)
+	v.addVideo(t, "parent", nil)
+	// The clip's range is checked against the duration of the parent, so it needs a real video
+	cmd := exec.Command("ffmpeg", "-v", "error", "-f", "lavfi", "-i", "testsrc=duration=4:size=320x240:rate=25",
+		"-c:v", "libx264", "-f", "mp4", filepath.Join(v.conf.UploadPath, "parent"))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("failed to generate the parent video: %v: %s", err, out)
+	}
+
+	if response := v.do(http.MethodPost, "/videos/parent/clips", `{"start": 1, "end": 10}`); response.Code != http.StatusBadRequest {
+		t.Errorf("clip beyond the end of the parent got status %d, want 400", response.Code)
+	}
+
+	response := v.do(http.MethodPost, "/videos/parent/clips", `{"start": "00:01", "end": 2.5}`)
+	video := v.checkCreatedVideo(t, response)
+	if video.ParentID != "parent" || video.ClipStart != 1 || video.ClipEnd != 2.5 {
+		t.Errorf("created clip is %+v, want 1s to 2.5s of parent", video)
+	}
+
+	job := v.queuedJob(t)
+	want := repository.ClipSpec{ParentFilename: "parent", Start: 1, End: 2.5}
+	if job.Filename != video.ID || job.Clip == nil || *job.Clip != want {
+		t.Fatalf("queued job %+v, want a clip of %+v producing %s", job, want, video.ID)
+	}
+	if record := v.checkJobRecord(t, job); record.Clip == nil || *record.Clip != want {
+		t.Errorf("job record has clip %+v, want %+v", record.Clip, want)
+	}
+}
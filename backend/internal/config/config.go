@@ -1,53 +1,465 @@
 package config
 
 import (
-	"log"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
 )
 
+// Storage backends the catalog, jobs and media files can be kept in.
+const (
+	StorageGridFS = "gridfs" // MongoDB collections and a GridFS bucket
+	StorageMemory = "memory" // Process memory; nothing survives a restart
+)
+
+// Rendition describes one output quality of the HLS ladder.
+type Rendition struct {
+	Name       string `yaml:"name"`        // Name used in output paths, playlist names and the quality parameter, e.g. "480p"
+	Height     int    `yaml:"height"`      // Output frame height in pixels
+	StatusCode string `yaml:"status_code"` // Status category sent to clients when the rendition is done, e.g. "T4"
+}
+
 // Config struct holds configuration values for the application.
-// These values are loaded from environment variables, providing flexibility for different environments.
+// Values come from the defaults below, then an optional YAML file, then environment variables,
+// each overriding the previous one.
 type Config struct {
-	ServerAddress      string // Address where the server will listen, e.g., ":8080"
-	MongoURI           string // URI for connecting to MongoDB, e.g., "mongodb://localhost:27017"
-	UploadPath         string // Path where uploaded files will be stored
-	TranscodedFilePath string // Path where transcoded files will be stored
-	WorkerProcessCount string // Number of worker processes for handling jobs concurrently
-	DBName             string // Name of the MongoDB database used for storing media files
-}
-
-// LoadConfig loads configuration values from environment variables or uses default values if not set.
-// It first attempts to load variables from a .env file if it exists, providing a convenient way
-// to set environment variables for development.
-func LoadConfig() Config {
+	ServerAddress       string        `yaml:"server_address"`                // Address where the server will listen, e.g., ":8080"
+	MongoURI            string        `yaml:"mongo_uri"`                     // URI for connecting to MongoDB, e.g., "mongodb://localhost:27017"
+	DBName              string        `yaml:"db_name"`                       // Name of the MongoDB database used for storing media files
+	StorageBackend      string        `yaml:"storage_backend"`               // Where the catalog, jobs and media files are kept (see Storage* constants)
+	UploadPath          string        `yaml:"upload_path"`                   // Path where uploaded files will be stored
+	TranscodedFilePath  string        `yaml:"transcode_path"`                // Path where transcoded files will be stored
+	KeepTranscodedFiles bool          `yaml:"keep_transcoded_files"`         // Whether a job's transcoded files are kept in the transcode path after they were stored, for debugging
+	MediaUploadWorkers  int           `yaml:"media_upload_workers"`          // Transcoded files each job uploads to the media repository at once
+	MediaUploadRetries  int           `yaml:"media_upload_retries"`          // Further attempts for a transcoded file that could not be stored
+	JobPollInterval     time.Duration `yaml:"job_poll_interval"`             // How often the job repository is checked for jobs queued by another process, e.g. mtvctl
+	WorkerProcessCount  int           `yaml:"worker_count"`                  // Number of worker processes for handling jobs concurrently
+	Renditions          []Rendition   `yaml:"renditions"`                    // Qualities every video is transcoded to, lowest first
+	ShutdownGrace       time.Duration `yaml:"shutdown_grace_period"`         // How long running jobs and requests may take to finish on shutdown
+	MinFreeDiskMB       uint64        `yaml:"min_free_disk_mb"`              // Free disk space, in megabytes, the upload and output paths need for the service to be ready
+	UploadMaxSizeMB     uint64        `yaml:"upload_max_size_mb"`            // Largest upload accepted, in megabytes, 0 for no limit
+	UploadTypes         []string      `yaml:"upload_types"`                  // MIME types uploads may declare, e.g. "video/*"; empty allows any
+	UploadExtensions    []string      `yaml:"upload_extensions"`             // File name extensions uploads may have, e.g. ".mp4"; empty allows any
+	UploadQuotaMB       uint64        `yaml:"upload_quota_mb"`               // Storage each user's uploads may take, in megabytes, 0 for no limit
+	UploadConcurrency   int           `yaml:"upload_concurrency"`            // Uploads each user may have in progress at once, 0 for no limit
+	UploadUserHeader    string        `yaml:"upload_user_header"`            // Request header naming the uploading user, read only from TrustedProxies; the client address is used otherwise
+	TrustedProxies      []string      `yaml:"trusted_proxies"`               // Addresses or CIDR ranges of the proxies trusted to set UploadUserHeader
+	UploadExpiry        time.Duration `yaml:"upload_expiry"`                 // How long an unfinished upload may go without data before it is deleted, 0 to keep it
+	SourceRetention     time.Duration `yaml:"source_retention"`              // How long the source of a ready video is kept, 0 to keep it for good
+	JanitorInterval     time.Duration `yaml:"janitor_interval"`              // Time between sweeps of the upload path for expired uploads and sources
+	ImportConcurrency   int           `yaml:"import_concurrency"`            // URL imports downloaded at once; further imports wait for a free slot
+	ImportRetries       int           `yaml:"import_retries"`                // Times an interrupted import download is resumed before it fails
+	ImportAllowPrivate  bool          `yaml:"import_allow_private_networks"` // Whether imports may download from loopback and private network addresses
+	WatchPath           string        `yaml:"watch_path"`                    // Directory watched for video files to ingest, e.g. a share other teams drop files on; empty disables it
+	WatchInterval       time.Duration `yaml:"watch_interval"`                // Time between scans of the watch directory
+	WatchSettleTime     time.Duration `yaml:"watch_settle_time"`             // How long a file's size and modification time must stay unchanged before it is taken as fully written
+	WatchRequireDone    bool          `yaml:"watch_require_done"`            // Whether files are only taken once a <name>.done marker exists next to them
+	WatchConcurrency    int           `yaml:"watch_concurrency"`             // Videos from the watch directory that may be queued or transcoding at once; further files wait in the directory
+	LiveEnabled         bool          `yaml:"live_enabled"`                  // Whether to accept live streams pushed over RTMP or SRT
+	LiveProtocol        string        `yaml:"live_protocol"`                 // Protocol publishers push with: "rtmp" or "srt"
+	LivePort            int           `yaml:"live_port"`                     // Port the live ingest listens on
+	LiveSegmentSeconds  int           `yaml:"live_segment_seconds"`          // Target duration of live HLS segments in seconds
+	LiveDVRSegments     int           `yaml:"live_dvr_segments"`             // Number of segments viewers can seek back through in live playlists, 0 for the whole stream
+	LiveRetranscode     bool          `yaml:"live_retranscode"`              // Whether ended live streams are re-transcoded to the full VOD ladder
+	LiveLowLatency      bool          `yaml:"live_low_latency"`              // Whether live playlists are served as Low-Latency HLS with partial segments
+	LivePartDuration    time.Duration `yaml:"live_part_duration"`            // Duration of LL-HLS partial segments; must divide the segment duration
+	TraceExporter       string        `yaml:"trace_exporter"`                // Where traces are sent: "otlp", "stdout" or "none"
+	TraceEndpoint       string        `yaml:"trace_otlp_endpoint"`           // OTLP/HTTP endpoint traces are sent to when TraceExporter is "otlp"
+	LogFormat           string        `yaml:"log_format"`                    // Format of log lines: "text" or "json"
+	LogLevel            string        `yaml:"log_level"`                     // Lowest level that is logged: "debug", "info", "warn" or "error"
+}
+
+// Default returns the configuration used when neither a file nor the environment sets a value.
+func Default() Config {
+	return Config{
+		ServerAddress:       ":8080",                     // Default server address
+		MongoURI:            "mongodb://localhost:27017", // Default MongoDB URI
+		DBName:              "hls_media",                 // Default MongoDB database name
+		StorageBackend:      StorageGridFS,               // Default storage backend
+		UploadPath:          "./uploads",                 // Default upload path
+		TranscodedFilePath:  "./output",                  // Default transcoded files path
+		KeepTranscodedFiles: false,                       // Transcoded files are deleted once they are stored by default
+		MediaUploadWorkers:  4,                           // Default concurrent uploads per job
+		MediaUploadRetries:  3,                           // Default retries per transcoded file
+		WorkerProcessCount:  2,                           // Default number of worker processes
+		JobPollInterval:     10 * time.Second,            // Default time between checks for jobs queued by mtvctl
+		Renditions: []Rendition{ // Default HLS ladder
+			{Name: "480p", Height: 480, StatusCode: "T4"},
+			{Name: "720p", Height: 720, StatusCode: "T7"},
+		},
+		ShutdownGrace:   30 * time.Second,    // Default shutdown grace period
+		MinFreeDiskMB:   1024,                // Default free disk space threshold
+		UploadMaxSizeMB: 10240,               // Default upload size limit (10 GB)
+		UploadTypes:     []string{"video/*"}, // Only videos are accepted by default
+		UploadExtensions: []string{ // Default video container extensions
+			".mp4", ".m4v", ".mov", ".mkv", ".webm", ".avi", ".flv", ".wmv", ".ts", ".mts", ".m2ts", ".mpg", ".mpeg", ".3gp",
+		},
+		UploadQuotaMB:      0,                       // No storage quota by default
+		UploadConcurrency:  3,                       // Default concurrent uploads per user
+		UploadUserHeader:   "",                      // Users are told apart by their address by default
+		TrustedProxies:     nil,                     // No proxy is trusted to name users by default
+		UploadExpiry:       24 * time.Hour,          // Default time abandoned uploads are kept
+		SourceRetention:    0,                       // Sources are kept by default, as clips and concatenations need them
+		JanitorInterval:    10 * time.Minute,        // Default time between janitor sweeps
+		ImportConcurrency:  2,                       // Default concurrent import downloads
+		ImportRetries:      5,                       // Default resumes per import
+		ImportAllowPrivate: false,                   // Imports may only reach public addresses by default
+		WatchPath:          "",                      // The watch directory is disabled by default
+		WatchInterval:      15 * time.Second,        // Default time between watch directory scans
+		WatchSettleTime:    30 * time.Second,        // Default quiet period of files being written to the watch directory
+		WatchRequireDone:   false,                   // Files are taken once they are quiet by default
+		WatchConcurrency:   4,                       // Default watch directory videos in the pipeline at once
+		LiveEnabled:        false,                   // Live ingest is disabled by default
+		LiveProtocol:       "rtmp",                  // Default live ingest protocol
+		LivePort:           1935,                    // Default RTMP port
+		LiveSegmentSeconds: 2,                       // Default live segment duration
+		LiveDVRSegments:    900,                     // Default DVR window (30 minutes of 2 second segments)
+		LiveRetranscode:    false,                   // Ended live streams are only archived by default
+		LiveLowLatency:     false,                   // Live playlists use regular segments by default
+		LivePartDuration:   500 * time.Millisecond,  // Default LL-HLS part duration
+		TraceExporter:      "none",                  // Tracing is disabled by default
+		TraceEndpoint:      "http://localhost:4318", // Default OTLP collector endpoint
+		LogFormat:          "text",                  // Default log format
+		LogLevel:           "info",                  // Default log level
+	}
+}
+
+// Load builds the configuration once at startup. It starts from Default, applies the YAML file
+// at path (if path is not empty), then the environment, loading a .env file first if one exists.
+// The result is validated, and every problem found is reported in the returned error.
+func Load(path string) (Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return Config{}, fmt.Errorf("failed to read config file: %v", err)
+		}
+		defer file.Close()
+
+		decoder := yaml.NewDecoder(file)
+		decoder.KnownFields(true) // Reject misspelled keys instead of silently ignoring them
+		if err := decoder.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+			return Config{}, fmt.Errorf("failed to parse config file %s: %v", path, err)
+		}
+	}
+
 	// Load .env file if available
-	err := godotenv.Load()
-	if err != nil {
-		log.Println("No .env file found") // Log if the .env file is not found; continue using system environment variables
+	if err := godotenv.Load(); err != nil {
+		slog.Debug("No .env file found") // Continue using system environment variables
 	}
 
-	// Return a Config struct populated with values from environment variables or default values
-	return Config{
-		ServerAddress:      getEnv("SERVER_ADDRESS", ":8080"),                // Default server address
-		MongoURI:           getEnv("MONGO_URI", "mongodb://localhost:27017"), // Default MongoDB URI
-		UploadPath:         getEnv("UPLOAD_PATH", "./uploads"),               // Default upload path
-		TranscodedFilePath: getEnv("TRANSCODE_PATH", "./output"),             // Default transcoded files path
-		WorkerProcessCount: getEnv("WP_COUNT", "2"),                          // Default number of worker processes
-		DBName:             getEnv("DB_NAME", "hls_media"),                   // Default MongoDB database name
+	if err := cfg.applyEnv(); err != nil {
+		return Config{}, fmt.Errorf("invalid configuration:\n%w", err)
 	}
+	if err := cfg.Validate(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
 }
 
-// getEnv retrieves the value of an environment variable given by key.
-// If the environment variable is not set, it returns the specified default value.
-func getEnv(key, defaultValue string) string {
+// applyEnv overrides configuration values with the environment variables that are set.
+func (c *Config) applyEnv() error {
+	var errs []error
+
+	setString(&c.ServerAddress, "SERVER_ADDRESS")
+	setString(&c.MongoURI, "MONGO_URI")
+	setString(&c.DBName, "DB_NAME")
+	setString(&c.StorageBackend, "STORAGE_BACKEND")
+	setString(&c.UploadPath, "UPLOAD_PATH")
+	setString(&c.TranscodedFilePath, "TRANSCODE_PATH")
+	setString(&c.LiveProtocol, "LIVE_PROTOCOL")
+	setString(&c.TraceExporter, "TRACE_EXPORTER")
+	setString(&c.TraceEndpoint, "TRACE_OTLP_ENDPOINT")
+	setString(&c.LogFormat, "LOG_FORMAT")
+	setString(&c.LogLevel, "LOG_LEVEL")
+	setString(&c.UploadUserHeader, "UPLOAD_USER_HEADER")
+	setString(&c.WatchPath, "WATCH_PATH")
+	setList(&c.UploadTypes, "UPLOAD_TYPES")
+	setList(&c.UploadExtensions, "UPLOAD_EXTENSIONS")
+	setList(&c.TrustedProxies, "TRUSTED_PROXIES")
 
-	// Check if the environment variable exists and return its value if it does
-	if value, exists := os.LookupEnv(key); exists {
-		return value
+	setInt(&c.WorkerProcessCount, "WP_COUNT", &errs)
+	setInt(&c.LivePort, "LIVE_PORT", &errs)
+	setInt(&c.LiveSegmentSeconds, "LIVE_SEGMENT_SECONDS", &errs)
+	setInt(&c.LiveDVRSegments, "LIVE_DVR_SEGMENTS", &errs)
+	setInt(&c.UploadConcurrency, "UPLOAD_CONCURRENCY", &errs)
+	setInt(&c.MediaUploadWorkers, "MEDIA_UPLOAD_WORKERS", &errs)
+	setInt(&c.MediaUploadRetries, "MEDIA_UPLOAD_RETRIES", &errs)
+	setBool(&c.KeepTranscodedFiles, "KEEP_TRANSCODED_FILES", &errs)
+	setInt(&c.ImportConcurrency, "IMPORT_CONCURRENCY", &errs)
+	setInt(&c.ImportRetries, "IMPORT_RETRIES", &errs)
+	setBool(&c.ImportAllowPrivate, "IMPORT_ALLOW_PRIVATE_NETWORKS", &errs)
+	setInt(&c.WatchConcurrency, "WATCH_CONCURRENCY", &errs)
+	setBool(&c.WatchRequireDone, "WATCH_REQUIRE_DONE", &errs)
+	setBool(&c.LiveEnabled, "LIVE_ENABLED", &errs)
+	setBool(&c.LiveRetranscode, "LIVE_RETRANSCODE", &errs)
+	setBool(&c.LiveLowLatency, "LIVE_LOW_LATENCY", &errs)
+	setDuration(&c.ShutdownGrace, "SHUTDOWN_GRACE_PERIOD", &errs)
+	setDuration(&c.JobPollInterval, "JOB_POLL_INTERVAL", &errs)
+	setDuration(&c.LivePartDuration, "LIVE_PART_DURATION", &errs)
+	setDuration(&c.UploadExpiry, "UPLOAD_EXPIRY", &errs)
+	setDuration(&c.SourceRetention, "SOURCE_RETENTION", &errs)
+	setDuration(&c.JanitorInterval, "JANITOR_INTERVAL", &errs)
+	setDuration(&c.WatchInterval, "WATCH_INTERVAL", &errs)
+	setDuration(&c.WatchSettleTime, "WATCH_SETTLE_TIME", &errs)
+	setMegabytes(&c.MinFreeDiskMB, "MIN_FREE_DISK_MB", &errs)
+	setMegabytes(&c.UploadMaxSizeMB, "UPLOAD_MAX_SIZE_MB", &errs)
+	setMegabytes(&c.UploadQuotaMB, "UPLOAD_QUOTA_MB", &errs)
+	if value, ok := os.LookupEnv("RENDITIONS"); ok {
+		renditions, err := parseRenditions(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("RENDITIONS: %v", err))
+		}
+		c.Renditions = renditions
 	}
 
-	// Return the default value if the environment variable is not set
-	return defaultValue
+	return errors.Join(errs...)
+}
+
+// parseRenditions parses a rendition list such as "480p:480:T4,720p:720:T7".
+func parseRenditions(value string) ([]Rendition, error) {
+	var renditions []Rendition
+	for _, entry := range strings.Split(value, ",") {
+		fields := strings.Split(strings.TrimSpace(entry), ":")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%q is not in name:height:status_code form", entry)
+		}
+		height, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("height of %q is not a number", entry)
+		}
+		renditions = append(renditions, Rendition{Name: fields[0], Height: height, StatusCode: fields[2]})
+	}
+	return renditions, nil
+}
+
+// TrustedProxyPrefixes parses TrustedProxies. A single address is a range of its own.
+func (c Config) TrustedProxyPrefixes() ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(c.TrustedProxies))
+	for _, proxy := range c.TrustedProxies {
+		if addr, err := netip.ParseAddr(proxy); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("%q is neither an address nor a CIDR range", proxy)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// Validate checks that the configuration can be used to start the server.
+// It reports every invalid value at once.
+func (c Config) Validate() error {
+	var errs []error
+	invalid := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c.ServerAddress == "" {
+		invalid("server_address must not be empty")
+	}
+	switch c.StorageBackend {
+	case StorageGridFS:
+		if c.MongoURI == "" || c.DBName == "" {
+			invalid("mongo_uri and db_name are required with the %s storage backend", StorageGridFS)
+		}
+	case StorageMemory:
+	default:
+		invalid("storage_backend must be %q or %q, got %q", StorageGridFS, StorageMemory, c.StorageBackend)
+	}
+	if c.UploadPath == "" || c.TranscodedFilePath == "" {
+		invalid("upload_path and transcode_path must not be empty")
+	}
+	if c.WorkerProcessCount < 1 {
+		invalid("worker_count must be at least 1, got %d", c.WorkerProcessCount)
+	}
+	if c.ShutdownGrace < 0 {
+		invalid("shutdown_grace_period must not be negative, got %s", c.ShutdownGrace)
+	}
+	if c.JobPollInterval <= 0 {
+		invalid("job_poll_interval must be positive, got %s", c.JobPollInterval)
+	}
+	if c.MediaUploadWorkers < 1 {
+		invalid("media_upload_workers must be at least 1, got %d", c.MediaUploadWorkers)
+	}
+	if c.MediaUploadRetries < 0 {
+		invalid("media_upload_retries must not be negative, got %d", c.MediaUploadRetries)
+	}
+	if c.ImportConcurrency < 1 {
+		invalid("import_concurrency must be at least 1, got %d", c.ImportConcurrency)
+	}
+	if c.ImportRetries < 0 {
+		invalid("import_retries must not be negative, got %d", c.ImportRetries)
+	}
+	if c.UploadConcurrency < 0 {
+		invalid("upload_concurrency must not be negative, got %d", c.UploadConcurrency)
+	}
+	if c.UploadExpiry < 0 || c.SourceRetention < 0 {
+		invalid("upload_expiry and source_retention must not be negative, got %s and %s", c.UploadExpiry, c.SourceRetention)
+	}
+	if (c.UploadExpiry > 0 || c.SourceRetention > 0) && c.JanitorInterval <= 0 {
+		invalid("janitor_interval must be positive, got %s", c.JanitorInterval)
+	}
+	if c.WatchPath != "" {
+		if c.WatchInterval <= 0 {
+			invalid("watch_interval must be positive, got %s", c.WatchInterval)
+		}
+		if c.WatchSettleTime < 0 {
+			invalid("watch_settle_time must not be negative, got %s", c.WatchSettleTime)
+		}
+		if c.WatchConcurrency < 1 {
+			invalid("watch_concurrency must be at least 1, got %d", c.WatchConcurrency)
+		}
+	}
+	if _, err := c.TrustedProxyPrefixes(); err != nil {
+		invalid("trusted_proxies: %v", err)
+	}
+	if c.UploadUserHeader != "" && len(c.TrustedProxies) == 0 {
+		invalid("upload_user_header is only read from trusted_proxies, which are not set")
+	}
+	for _, extension := range c.UploadExtensions {
+		if !strings.HasPrefix(extension, ".") {
+			invalid("upload_extensions must start with a dot, got %q", extension)
+		}
+	}
+
+	if len(c.Renditions) == 0 {
+		invalid("at least one rendition is required")
+	}
+	names := make(map[string]bool)
+	for i, rendition := range c.Renditions {
+		switch {
+		case rendition.Name == "" || strings.ContainsAny(rendition.Name, `/\`):
+			invalid("rendition %d: name must be set and must not contain slashes", i+1)
+		case names[rendition.Name]:
+			invalid("rendition %s is listed twice", rendition.Name)
+		}
+		names[rendition.Name] = true
+		if rendition.Height <= 0 || rendition.Height%2 != 0 {
+			invalid("rendition %s: height must be a positive even number, got %d", rendition.Name, rendition.Height)
+		}
+		if rendition.StatusCode == "" {
+			invalid("rendition %s: status_code is required", rendition.Name)
+		}
+	}
+
+	if c.LiveEnabled {
+		if c.LiveProtocol != "rtmp" && c.LiveProtocol != "srt" {
+			invalid("live_protocol must be \"rtmp\" or \"srt\", got %q", c.LiveProtocol)
+		}
+		if c.LivePort < 1 || c.LivePort > 65535 {
+			invalid("live_port must be between 1 and 65535, got %d", c.LivePort)
+		}
+		if c.LiveSegmentSeconds < 1 {
+			invalid("live_segment_seconds must be at least 1, got %d", c.LiveSegmentSeconds)
+		}
+		if c.LiveDVRSegments != 0 && c.LiveDVRSegments < 2 {
+			invalid("live_dvr_segments must be 0 or at least 2, got %d", c.LiveDVRSegments)
+		}
+		segment := time.Duration(c.LiveSegmentSeconds) * time.Second
+		if c.LiveLowLatency && (c.LivePartDuration <= 0 || c.LivePartDuration >= segment || segment%c.LivePartDuration != 0) {
+			invalid("live_part_duration must divide the %s segment duration into several parts, got %s", segment, c.LivePartDuration)
+		}
+	}
+
+	switch c.TraceExporter {
+	case "none", "stdout", "otlp":
+	default:
+		invalid("trace_exporter must be \"none\", \"stdout\" or \"otlp\", got %q", c.TraceExporter)
+	}
+	switch c.LogFormat {
+	case "text", "json":
+	default:
+		invalid("log_format must be \"text\" or \"json\", got %q", c.LogFormat)
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		invalid("log_level must be \"debug\", \"info\", \"warn\" or \"error\", got %q", c.LogLevel)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// setInt overrides value with the environment variable given by key, if it is set,
+// recording an error in errs when it is not a number.
+func setInt(value *int, key string, errs *[]error) {
+	if env, exists := os.LookupEnv(key); exists {
+		number, err := strconv.Atoi(env)
+		if err != nil {
+			*errs = append(*errs, fmt.Errorf("%s: %q is not a number", key, env))
+		}
+		*value = number
+	}
+}
+
+// setBool overrides value with the environment variable given by key, if it is set,
+// recording an error in errs when it is not true or false.
+func setBool(value *bool, key string, errs *[]error) {
+	if env, exists := os.LookupEnv(key); exists {
+		flag, err := strconv.ParseBool(env)
+		if err != nil {
+			*errs = append(*errs, fmt.Errorf("%s: %q is not true or false", key, env))
+		}
+		*value = flag
+	}
+}
+
+// setDuration overrides value with the environment variable given by key, if it is set,
+// recording an error in errs when it is not a duration.
+func setDuration(value *time.Duration, key string, errs *[]error) {
+	if env, exists := os.LookupEnv(key); exists {
+		duration, err := time.ParseDuration(env)
+		if err != nil {
+			*errs = append(*errs, fmt.Errorf("%s: %q is not a duration such as \"30s\"", key, env))
+		}
+		*value = duration
+	}
+}
+
+// setMegabytes overrides value with the environment variable given by key, if it is set,
+// recording an error in errs when it is not a number of megabytes.
+func setMegabytes(value *uint64, key string, errs *[]error) {
+	if env, exists := os.LookupEnv(key); exists {
+		megabytes, err := strconv.ParseUint(env, 10, 64)
+		if err != nil {
+			*errs = append(*errs, fmt.Errorf("%s: %q is not a number of megabytes", key, env))
+		}
+		*value = megabytes
+	}
+}
+
+// setList overrides value with the comma-separated environment variable given by key, if it
+// is set. An empty variable clears the list.
+func setList(value *[]string, key string) {
+	if env, exists := os.LookupEnv(key); exists {
+		*value = nil
+		for _, item := range strings.Split(env, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*value = append(*value, item)
+			}
+		}
+	}
+}
+
+// setString overrides value with the environment variable given by key, if it is set.
+func setString(value *string, key string) {
+	if env, exists := os.LookupEnv(key); exists {
+		*value = env
+	}
 }
@@ -0,0 +1,91 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// RequestIDHeader is the header a request ID is read from and echoed back in.
+const RequestIDHeader = "X-Request-ID"
+
+// Attribute keys that correlate log lines across requests, uploads and jobs.
+const (
+	RequestIDKey = "request_id" // ID of the HTTP request being served
+	UploadIDKey  = "upload_id"  // tus upload ID, also the video ID
+	JobIDKey     = "job_id"     // ID of the job record being processed
+)
+
+// loggerKey is the context key the request or job logger is stored under.
+type loggerKey struct{}
+
+// Setup installs a structured logger as the default slog logger, which the standard log
+// package also writes through. Format is "json" or "text"; level is "debug", "info", "warn" or "error".
+func Setup(format string, level string) error {
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q: %v", level, err)
+	}
+	options := &slog.HandlerOptions{Level: logLevel}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, options)
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// WithLogger returns a copy of ctx carrying logger, to be picked up by FromContext.
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// FromContext returns the logger stored in ctx, or the default logger if there is none.
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// With returns a copy of ctx whose logger adds the given attributes to every line.
+func With(ctx context.Context, args ...any) context.Context {
+	return WithLogger(ctx, FromContext(ctx).With(args...))
+}
+
+// RequestID is a middleware that gives every request an ID, taken from the X-Request-ID
+// header when the client sent one. The ID is echoed in the response and attached to the
+// request's logger, so every line logged while serving the request carries it.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(RequestIDHeader)
+		if requestID == "" || len(requestID) > 128 {
+			requestID = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, requestID)
+
+		ctx := With(r.Context(), RequestIDKey, requestID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// newRequestID generates a random 16 character hex request ID.
+func newRequestID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,141 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/tus/tusd/v2/pkg/handler"
+	"github.com/tus/tusd/v2/pkg/prometheuscollector"
+)
+
+// namespace prefixes every metric exported by the application.
+const namespace = "mtv"
+
+// mediaLatencyBuckets cover GridFS operations from a cached chunk read to a large segment upload.
+var mediaLatencyBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// transcodeDurationBuckets cover a rendition of a short clip up to one of a long feature.
+var transcodeDurationBuckets = []float64{1, 5, 10, 30, 60, 120, 300, 600, 1200, 3600}
+
+var (
+	// JobQueueDepth is the number of jobs handed to the worker pool that no worker has picked up yet.
+	JobQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "job_queue_depth",
+		Help:      "Number of jobs waiting for a free worker.",
+	})
+
+	// JobWaitSeconds is the time jobs spend queued before a worker picks them up.
+	JobWaitSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "job_wait_seconds",
+		Help:      "Time jobs spend queued before a worker picks them up.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+	})
+
+	// TranscodeDurationSeconds is the time it took to produce each rendition, by rendition name.
+	TranscodeDurationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "transcode_duration_seconds",
+		Help:      "Time it took to transcode a rendition, including failed attempts.",
+		Buckets:   transcodeDurationBuckets,
+	}, []string{"rendition"})
+
+	// TranscodeFailures counts renditions that failed to transcode, by rendition name.
+	TranscodeFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "transcode_failures_total",
+		Help:      "Number of renditions that failed to transcode.",
+	}, []string{"rendition"})
+
+	// SSEClients is the number of clients currently connected to the status stream.
+	SSEClients = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "sse_clients",
+		Help:      "Number of clients connected to the status stream.",
+	})
+
+	// StatusMessagesDropped counts status updates dropped because the client's channel was full.
+	StatusMessagesDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "status_messages_dropped_total",
+		Help:      "Number of status updates dropped because the client was not ready to receive them.",
+	})
+
+	// LiveStreams is the number of live streams currently being ingested.
+	LiveStreams = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "live_streams",
+		Help:      "Number of live streams currently being ingested.",
+	})
+
+	// MediaOperationSeconds is the latency of media repository operations, by operation ("read" or "write").
+	MediaOperationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "gridfs_operation_seconds",
+		Help:      "Latency of GridFS reads (until the file is open) and writes (until the file is stored).",
+		Buckets:   mediaLatencyBuckets,
+	}, []string{"operation"})
+
+	// MediaUploadRetries counts attempts to store a transcoded file again after it failed.
+	MediaUploadRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "media_upload_retries_total",
+		Help:      "Number of times storing a transcoded file in GridFS was retried.",
+	})
+
+	// MediaUploadFailures counts transcoded files that could not be stored intact after every attempt.
+	MediaUploadFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "media_upload_failures_total",
+		Help:      "Number of transcoded files that could not be stored in GridFS after every retry.",
+	})
+
+	// JanitorFilesDeleted counts files the upload janitor deleted, by kind ("expired_upload" or "source").
+	JanitorFilesDeleted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "janitor_files_deleted_total",
+		Help:      "Number of abandoned uploads and retained sources deleted by the upload janitor.",
+	}, []string{"kind"})
+
+	// JanitorReclaimedBytes counts the disk space freed by the upload janitor, by kind ("expired_upload" or "source").
+	JanitorReclaimedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "janitor_reclaimed_bytes_total",
+		Help:      "Disk space freed in the upload path by the upload janitor.",
+	}, []string{"kind"})
+
+	// WatchFiles counts files taken from the watch directory, by outcome ("ingested" or "rejected").
+	WatchFiles = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "watch_files_total",
+		Help:      "Number of files taken from the watch directory, ingested or rejected.",
+	}, []string{"outcome"})
+
+	// HLSRequests counts requests for HLS playlists and segments, by quality and kind
+	// ("master", "playlist", "iframe_playlist" or "segment").
+	HLSRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hls_requests_total",
+		Help:      "Number of HLS playlist and segment requests.",
+	}, []string{"quality", "kind"})
+)
+
+// RegisterUploads exports the upload counters kept by the tus handler: requests, bytes
+// received and uploads created, finished and terminated.
+func RegisterUploads(tusHandler *handler.Handler) {
+	prometheus.MustRegister(prometheuscollector.New(tusHandler.Metrics))
+}
+
+// ObserveSince records the seconds elapsed since start in the given observer.
+func ObserveSince(observer prometheus.Observer, start time.Time) {
+	observer.Observe(time.Since(start).Seconds())
+}
+
+// Handler serves every registered metric in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
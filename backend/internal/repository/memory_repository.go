@@ -0,0 +1,323 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NewMemoryRepositories creates repositories that keep everything in process memory.
+// They are meant for tests and local experiments; nothing survives a restart.
+func NewMemoryRepositories() *Repositories {
+	return &Repositories{
+		Videos: NewMemoryVideoRepository(),
+		Jobs:   NewMemoryJobRepository(),
+		Media:  NewMemoryMediaRepository(),
+	}
+}
+
+// MemoryVideoRepository is a VideoRepository backed by a map.
+type MemoryVideoRepository struct {
+	mu     sync.Mutex
+	videos map[string]Video
+}
+
+// NewMemoryVideoRepository creates an empty in-memory video catalog.
+func NewMemoryVideoRepository() *MemoryVideoRepository {
+	return &MemoryVideoRepository{videos: make(map[string]Video)}
+}
+
+// Create inserts a new video, setting its timestamps.
+func (r *MemoryVideoRepository) Create(ctx context.Context, video *Video) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.videos[video.ID]; exists {
+		return fmt.Errorf("failed to create video %s: duplicate ID", video.ID)
+	}
+
+	now := time.Now().UTC()
+	video.CreatedAt = now
+	video.UpdatedAt = now
+	r.videos[video.ID] = copyVideo(*video)
+	return nil
+}
+
+// Get returns the video with the given ID, or ErrNotFound.
+func (r *MemoryVideoRepository) Get(ctx context.Context, id string) (*Video, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	video, ok := r.videos[id]
+	if !ok {
+		return nil, fmt.Errorf("video %s: %w", id, ErrNotFound)
+	}
+	video = copyVideo(video)
+	return &video, nil
+}
+
+// List returns all videos, newest first.
+func (r *MemoryVideoRepository) List(ctx context.Context) ([]Video, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	videos := make([]Video, 0, len(r.videos))
+	for _, video := range r.videos {
+		videos = append(videos, copyVideo(video))
+	}
+	sort.Slice(videos, func(i, j int) bool { return videos[i].CreatedAt.After(videos[j].CreatedAt) })
+	return videos, nil
+}
+
+// UpdateStatus sets the pipeline status of a video and its failure reason.
+func (r *MemoryVideoRepository) UpdateStatus(ctx context.Context, id string, status string, errMsg string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	video, ok := r.videos[id]
+	if !ok {
+		return fmt.Errorf("video %s: %w", id, ErrNotFound)
+	}
+	video.Status = status
+	video.Error = errMsg
+	video.UpdatedAt = time.Now().UTC()
+	r.videos[id] = video
+	return nil
+}
+
+// SetSize records the size of a video's source file.
+func (r *MemoryVideoRepository) SetSize(ctx context.Context, id string, size int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	video, ok := r.videos[id]
+	if !ok {
+		return fmt.Errorf("video %s: %w", id, ErrNotFound)
+	}
+	video.Size = size
+	video.UpdatedAt = time.Now().UTC()
+	r.videos[id] = video
+	return nil
+}
+
+// Delete removes a video from the catalog.
+func (r *MemoryVideoRepository) Delete(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.videos[id]; !ok {
+		return fmt.Errorf("video %s: %w", id, ErrNotFound)
+	}
+	delete(r.videos, id)
+	return nil
+}
+
+// StorageUsed returns the total source size of the videos uploaded by owner, in bytes.
+func (r *MemoryVideoRepository) StorageUsed(ctx context.Context, owner string) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var used int64
+	for _, video := range r.videos {
+		if video.Owner == owner {
+			used += video.Size
+		}
+	}
+	return used, nil
+}
+
+// copyVideo returns a copy of a video that shares no slices or maps with the original.
+func copyVideo(video Video) Video {
+	video.Tags = append([]string(nil), video.Tags...)
+	video.ClientIDs = maps.Clone(video.ClientIDs)
+	video.SourceIDs = append([]string(nil), video.SourceIDs...)
+	return video
+}
+
+// MemoryJobRepository is a JobRepository backed by a map.
+type MemoryJobRepository struct {
+	mu   sync.Mutex
+	jobs map[string]JobRecord
+}
+
+// NewMemoryJobRepository creates an empty in-memory job store.
+func NewMemoryJobRepository() *MemoryJobRepository {
+	return &MemoryJobRepository{jobs: make(map[string]JobRecord)}
+}
+
+// Create inserts a new job, setting its creation time.
+func (r *MemoryJobRepository) Create(ctx context.Context, job *JobRecord) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.jobs[job.ID]; exists {
+		return fmt.Errorf("failed to create job %s: duplicate ID", job.ID)
+	}
+
+	job.CreatedAt = time.Now().UTC()
+	r.jobs[job.ID] = copyJob(*job)
+	return nil
+}
+
+// Get returns the job with the given ID, or ErrNotFound.
+func (r *MemoryJobRepository) Get(ctx context.Context, id string) (*JobRecord, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	job, ok := r.jobs[id]
+	if !ok {
+		return nil, fmt.Errorf("job %s: %w", id, ErrNotFound)
+	}
+	job = copyJob(job)
+	return &job, nil
+}
+
+// List returns the jobs with the given status (all jobs if status is empty), oldest first.
+func (r *MemoryJobRepository) List(ctx context.Context, status string) ([]JobRecord, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	jobs := []JobRecord{}
+	for _, job := range r.jobs {
+		if status == "" || job.Status == status {
+			jobs = append(jobs, copyJob(job))
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt.Before(jobs[j].CreatedAt) })
+	return jobs, nil
+}
+
+// MarkRunning records that a worker started the queued job, incrementing its attempt count.
+func (r *MemoryJobRepository) MarkRunning(ctx context.Context, id string) error {
+	return r.update(id, []string{JobStatusQueued}, func(job *JobRecord) {
+		job.Status = JobStatusRunning
+		job.Error = ""
+		job.Attempts++
+		job.StartedAt = time.Now().UTC()
+	})
+}
+
+// MarkFinished records the outcome of a queued or running job.
+func (r *MemoryJobRepository) MarkFinished(ctx context.Context, id string, status string, errMsg string) error {
+	return r.update(id, []string{JobStatusQueued, JobStatusRunning}, func(job *JobRecord) {
+		job.Status = status
+		job.Error = errMsg
+		job.FinishedAt = time.Now().UTC()
+	})
+}
+
+// update applies fn to a single job under the lock, if the job has one of the given statuses.
+func (r *MemoryJobRepository) update(id string, from []string, fn func(job *JobRecord)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	job, ok := r.jobs[id]
+	if !ok {
+		return fmt.Errorf("job %s: %w", id, ErrNotFound)
+	}
+	if !slices.Contains(from, job.Status) {
+		return fmt.Errorf("job %s is %s: %w", id, job.Status, ErrJobFinished)
+	}
+	fn(&job)
+	r.jobs[id] = job
+	return nil
+}
+
+// copyJob returns a copy of a job that shares no pointers with the original.
+func copyJob(job JobRecord) JobRecord {
+	if job.Clip != nil {
+		clip := *job.Clip
+		job.Clip = &clip
+	}
+	if job.Concat != nil {
+		concat := *job.Concat
+		concat.SourceFilenames = append([]string(nil), concat.SourceFilenames...)
+		job.Concat = &concat
+	}
+	return job
+}
+
+// memoryMediaFile is a file held by MemoryMediaRepository.
+type memoryMediaFile struct {
+	data       []byte
+	uploadedAt time.Time
+	md5        string // Hex MD5 of data
+}
+
+// MemoryMediaRepository is a MediaRepository backed by a map of byte slices.
+type MemoryMediaRepository struct {
+	mu    sync.Mutex
+	files map[string]memoryMediaFile
+}
+
+// NewMemoryMediaRepository creates an empty in-memory media store.
+func NewMemoryMediaRepository() *MemoryMediaRepository {
+	return &MemoryMediaRepository{files: make(map[string]memoryMediaFile)}
+}
+
+// Save stores the contents of r under name, replacing any existing file with that name.
+func (r *MemoryMediaRepository) Save(ctx context.Context, name string, reader io.Reader) (MediaFileInfo, error) {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return MediaFileInfo{}, fmt.Errorf("failed to read media file %s: %v", name, err)
+	}
+
+	sum := md5.Sum(data)
+	file := memoryMediaFile{data: data, uploadedAt: time.Now().UTC(), md5: hex.EncodeToString(sum[:])}
+
+	r.mu.Lock()
+	r.files[name] = file
+	r.mu.Unlock()
+
+	return MediaFileInfo{Name: name, Size: int64(len(data)), UploadedAt: file.uploadedAt, MD5: file.md5}, nil
+}
+
+// Open returns a reader for the named file, or ErrNotFound.
+func (r *MemoryMediaRepository) Open(ctx context.Context, name string) (io.ReadCloser, MediaFileInfo, error) {
+	r.mu.Lock()
+	file, ok := r.files[name]
+	r.mu.Unlock()
+
+	if !ok {
+		return nil, MediaFileInfo{}, fmt.Errorf("media file %s: %w", name, ErrNotFound)
+	}
+
+	info := MediaFileInfo{Name: name, Size: int64(len(file.data)), UploadedAt: file.uploadedAt}
+	return io.NopCloser(bytes.NewReader(file.data)), info, nil
+}
+
+// Delete removes the named file, or returns ErrNotFound.
+func (r *MemoryMediaRepository) Delete(ctx context.Context, name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.files[name]; !ok {
+		return fmt.Errorf("media file %s: %w", name, ErrNotFound)
+	}
+	delete(r.files, name)
+	return nil
+}
+
+// List returns the files whose names start with prefix, sorted by name.
+func (r *MemoryMediaRepository) List(ctx context.Context, prefix string) ([]MediaFileInfo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	infos := []MediaFileInfo{}
+	for name, file := range r.files {
+		if strings.HasPrefix(name, prefix) {
+			infos = append(infos, MediaFileInfo{Name: name, Size: int64(len(file.data)), UploadedAt: file.uploadedAt, MD5: file.md5})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
@@ -0,0 +1,224 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryRepositoriesReturnErrNotFound(t *testing.T) {
+	ctx := context.Background()
+	repos := NewMemoryRepositories()
+
+	_, err := repos.Videos.Get(ctx, "missing")
+	checkNotFound(t, "Videos.Get", err)
+	checkNotFound(t, "Videos.UpdateStatus", repos.Videos.UpdateStatus(ctx, "missing", VideoStatusReady, ""))
+	checkNotFound(t, "Videos.SetSize", repos.Videos.SetSize(ctx, "missing", 1))
+	checkNotFound(t, "Videos.Delete", repos.Videos.Delete(ctx, "missing"))
+
+	_, err = repos.Jobs.Get(ctx, "missing")
+	checkNotFound(t, "Jobs.Get", err)
+	checkNotFound(t, "Jobs.MarkRunning", repos.Jobs.MarkRunning(ctx, "missing"))
+	checkNotFound(t, "Jobs.MarkFinished", repos.Jobs.MarkFinished(ctx, "missing", JobStatusFailed, "error"))
+
+	_, _, err = repos.Media.Open(ctx, "missing")
+	checkNotFound(t, "Media.Open", err)
+	checkNotFound(t, "Media.Delete", repos.Media.Delete(ctx, "missing"))
+
+	// A deleted video is gone like one that never existed
+	if err := repos.Videos.Create(ctx, &Video{ID: "deleted", Status: VideoStatusReady}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repos.Videos.Delete(ctx, "deleted"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = repos.Videos.Get(ctx, "deleted")
+	checkNotFound(t, "Videos.Get after Delete", err)
+}
+
+// checkNotFound fails the test unless err wraps ErrNotFound.
+func checkNotFound(t *testing.T, call string, err error) {
+	t.Helper()
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("%s returned %v, want ErrNotFound", call, err)
+	}
+}
+
+func TestMemoryVideoRepositoryListsNewestFirst(t *testing.T) {
+	ctx := context.Background()
+	videos := NewMemoryVideoRepository()
+	for _, id := range []string{"first", "second", "third"} {
+		if err := videos.Create(ctx, &Video{ID: id, Status: VideoStatusUploaded}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond) // Keep the creation times apart
+	}
+	if err := videos.Create(ctx, &Video{ID: "first"}); err == nil {
+		t.Error("Create accepted a duplicate ID")
+	}
+
+	list, err := videos.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := videoIDs(list); got != "third,second,first" {
+		t.Errorf("List returned %s, want third,second,first", got)
+	}
+}
+
+// videoIDs joins the IDs of videos in order.
+func videoIDs(videos []Video) string {
+	ids := make([]string, len(videos))
+	for i, video := range videos {
+		ids[i] = video.ID
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestMemoryJobRepositoryListsOldestFirst(t *testing.T) {
+	ctx := context.Background()
+	jobs := NewMemoryJobRepository()
+	for _, id := range []string{"first", "second", "third"} {
+		if err := jobs.Create(ctx, &JobRecord{ID: id, VideoID: "video", Status: JobStatusQueued}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond) // Keep the creation times apart
+	}
+	if err := jobs.MarkRunning(ctx, "second"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		status string
+		want   string
+	}{
+		{"", "first,second,third"},
+		{JobStatusQueued, "first,third"},
+		{JobStatusRunning, "second"},
+		{JobStatusFailed, ""},
+	}
+	for _, test := range tests {
+		list, err := jobs.List(ctx, test.status)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]string, len(list))
+		for i, job := range list {
+			ids[i] = job.ID
+		}
+		if got := strings.Join(ids, ","); got != test.want {
+			t.Errorf("List(%q) returned %q, want %q", test.status, got, test.want)
+		}
+	}
+
+	job, err := jobs.Get(ctx, "second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Attempts != 1 || job.StartedAt.IsZero() {
+		t.Errorf("running job is %+v, want 1 attempt and a start time", job)
+	}
+}
+
+func TestMemoryVideoRepositoryStorageUsed(t *testing.T) {
+	ctx := context.Background()
+	videos := NewMemoryVideoRepository()
+	for _, video := range []Video{
+		{ID: "a1", Owner: "alice", Size: 100},
+		{ID: "a2", Owner: "alice", Size: 250},
+		{ID: "b1", Owner: "bob", Size: 1000},
+		{ID: "a3", Owner: "alice"}, // Upload in progress, its size is not known yet
+	} {
+		if err := videos.Create(ctx, &video); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := videos.SetSize(ctx, "a3", 50); err != nil {
+		t.Fatal(err)
+	}
+	if err := videos.Delete(ctx, "a1"); err != nil {
+		t.Fatal(err)
+	}
+
+	for owner, want := range map[string]int64{"alice": 300, "bob": 1000, "carol": 0} {
+		used, err := videos.StorageUsed(ctx, owner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if used != want {
+			t.Errorf("StorageUsed(%s) = %d, want %d", owner, used, want)
+		}
+	}
+}
+
+func TestMemoryMediaRepositoryStoresFiles(t *testing.T) {
+	ctx := context.Background()
+	media := NewMemoryMediaRepository()
+	for name, contents := range map[string]string{
+		"./transcoded/720p/video/ts/720p_001.ts":   "second segment",
+		"./transcoded/720p/video/ts/720p_000.ts":   "first segment",
+		"./transcoded/720p/video/m3u8/720p.m3u8":   "#EXTM3U\n",
+		"./transcoded/720p/other/m3u8/720p.m3u8":   "#EXTM3U\n",
+		"./transcoded/720p/video/ts/720p_000.ts.x": "stale",
+	} {
+		if _, err := media.Save(ctx, name, strings.NewReader(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err := media.Save(ctx, "./transcoded/720p/video/ts/720p_000.ts", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 5 || info.MD5 != "5d41402abc4b2a76b9719d911017c592" {
+		t.Errorf("Save returned %+v, want 5 bytes with the MD5 of hello", info)
+	}
+
+	reader, info, err := media.Open(ctx, "./transcoded/720p/video/ts/720p_000.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil || string(data) != "hello" || info.Size != 5 {
+		t.Errorf("Open read %q (%d bytes), %v; want the replaced contents", data, info.Size, err)
+	}
+
+	files, err := media.List(ctx, "./transcoded/720p/video/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name)
+	}
+	want := "./transcoded/720p/video/m3u8/720p.m3u8,./transcoded/720p/video/ts/720p_000.ts,./transcoded/720p/video/ts/720p_000.ts.x,./transcoded/720p/video/ts/720p_001.ts"
+	if got := strings.Join(names, ","); got != want {
+		t.Errorf("List returned %s, want %s", got, want)
+	}
+}
+
+func TestMemoryJobRepositoryKeepsFinishedJobs(t *testing.T) {
+	ctx := context.Background()
+	jobs := NewMemoryJobRepository()
+	if err := jobs.Create(ctx, &JobRecord{ID: "job", VideoID: "video", Status: JobStatusQueued}); err != nil {
+		t.Fatal(err)
+	}
+	if err := jobs.MarkFinished(ctx, "job", JobStatusCancelled, "cancelled by an operator"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := jobs.MarkRunning(ctx, "job"); !errors.Is(err, ErrJobFinished) {
+		t.Errorf("MarkRunning of a cancelled job returned %v, want ErrJobFinished", err)
+	}
+	for _, status := range []string{JobStatusSucceeded, JobStatusQueued} {
+		if err := jobs.MarkFinished(ctx, "job", status, ""); !errors.Is(err, ErrJobFinished) {
+			t.Errorf("MarkFinished(%s) of a cancelled job returned %v, want ErrJobFinished", status, err)
+		}
+	}
+	if job, err := jobs.Get(ctx, "job"); err != nil || job.Status != JobStatusCancelled || job.Attempts != 0 {
+		t.Errorf("job is %+v, %v; want it still cancelled", job, err)
+	}
+}
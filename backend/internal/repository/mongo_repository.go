@@ -0,0 +1,404 @@
+package repository
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+
+	"manhattan_tech_ventures/internal/metrics"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Names of the MongoDB collections used by the repositories.
+const (
+	VideosCollection = "videos" // Video catalog
+	JobsCollection   = "jobs"   // Transcode jobs
+)
+
+// NewMongoRepositories creates the MongoDB backed repositories. Media files are kept in the
+// GridFS bucket with the given name. All indexes the repositories rely on are created here,
+// so this should be called once at startup.
+func NewMongoRepositories(ctx context.Context, db *mongo.Database, bucketName string) (*Repositories, error) {
+	bucket, err := gridfs.NewBucket(db, options.GridFSBucket().SetName(bucketName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GridFS bucket: %v", err)
+	}
+
+	if err := ensureIndexes(ctx, db, bucketName); err != nil {
+		return nil, err
+	}
+
+	return &Repositories{
+		Videos: &MongoVideoRepository{collection: db.Collection(VideosCollection)},
+		Jobs:   &MongoJobRepository{collection: db.Collection(JobsCollection)},
+		Media:  &GridFSMediaRepository{bucket: bucket, files: db.Collection(bucketName + ".files")},
+	}, nil
+}
+
+// ensureIndexes creates the indexes of the catalog, the job queue and the GridFS bucket.
+// GridFS would otherwise create its own indexes lazily on the first upload.
+func ensureIndexes(ctx context.Context, db *mongo.Database, bucketName string) error {
+	indexes := map[string][]mongo.IndexModel{
+		VideosCollection: {
+			{Keys: bson.D{{Key: "created_at", Value: -1}}},
+			{Keys: bson.D{{Key: "parent_id", Value: 1}}},
+			{Keys: bson.D{{Key: "status", Value: 1}}},
+			{Keys: bson.D{{Key: "owner", Value: 1}}},
+		},
+		JobsCollection: {
+			{Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: 1}}},
+			{Keys: bson.D{{Key: "video_id", Value: 1}}},
+		},
+		bucketName + ".files": {
+			{Keys: bson.D{{Key: "filename", Value: 1}, {Key: "uploadDate", Value: 1}}},
+		},
+		bucketName + ".chunks": {
+			{Keys: bson.D{{Key: "files_id", Value: 1}, {Key: "n", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+	}
+
+	for collection, models := range indexes {
+		if _, err := db.Collection(collection).Indexes().CreateMany(ctx, models); err != nil {
+			return fmt.Errorf("failed to create indexes on %s: %v", collection, err)
+		}
+	}
+	return nil
+}
+
+// MongoVideoRepository is a VideoRepository backed by a MongoDB collection.
+type MongoVideoRepository struct {
+	collection *mongo.Collection
+}
+
+// Create inserts a new video, setting its timestamps.
+func (r *MongoVideoRepository) Create(ctx context.Context, video *Video) error {
+	now := time.Now().UTC()
+	video.CreatedAt = now
+	video.UpdatedAt = now
+
+	if _, err := r.collection.InsertOne(ctx, video); err != nil {
+		return fmt.Errorf("failed to create video %s: %v", video.ID, err)
+	}
+	return nil
+}
+
+// Get returns the video with the given ID, or ErrNotFound.
+func (r *MongoVideoRepository) Get(ctx context.Context, id string) (*Video, error) {
+	var video Video
+	err := r.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&video)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, fmt.Errorf("video %s: %w", id, ErrNotFound)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to find video %s: %v", id, err)
+	}
+	return &video, nil
+}
+
+// List returns all videos, newest first.
+func (r *MongoVideoRepository) List(ctx context.Context) ([]Video, error) {
+	cursor, err := r.collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list videos: %v", err)
+	}
+
+	videos := []Video{}
+	if err := cursor.All(ctx, &videos); err != nil {
+		return nil, fmt.Errorf("failed to read videos: %v", err)
+	}
+	return videos, nil
+}
+
+// UpdateStatus sets the pipeline status of a video and its failure reason.
+func (r *MongoVideoRepository) UpdateStatus(ctx context.Context, id string, status string, errMsg string) error {
+	update := bson.M{"$set": bson.M{
+		"status":     status,
+		"error":      errMsg,
+		"updated_at": time.Now().UTC(),
+	}}
+
+	result, err := r.collection.UpdateByID(ctx, id, update)
+	if err != nil {
+		return fmt.Errorf("failed to update status of video %s: %v", id, err)
+	}
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("video %s: %w", id, ErrNotFound)
+	}
+	return nil
+}
+
+// SetSize records the size of a video's source file.
+func (r *MongoVideoRepository) SetSize(ctx context.Context, id string, size int64) error {
+	update := bson.M{"$set": bson.M{"size": size, "updated_at": time.Now().UTC()}}
+
+	result, err := r.collection.UpdateByID(ctx, id, update)
+	if err != nil {
+		return fmt.Errorf("failed to update size of video %s: %v", id, err)
+	}
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("video %s: %w", id, ErrNotFound)
+	}
+	return nil
+}
+
+// Delete removes a video from the catalog.
+func (r *MongoVideoRepository) Delete(ctx context.Context, id string) error {
+	result, err := r.collection.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return fmt.Errorf("failed to delete video %s: %v", id, err)
+	}
+	if result.DeletedCount == 0 {
+		return fmt.Errorf("video %s: %w", id, ErrNotFound)
+	}
+	return nil
+}
+
+// StorageUsed returns the total source size of the videos uploaded by owner, in bytes.
+func (r *MongoVideoRepository) StorageUsed(ctx context.Context, owner string) (int64, error) {
+	cursor, err := r.collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"owner": owner}}},
+		{{Key: "$group", Value: bson.M{"_id": nil, "used": bson.M{"$sum": "$size"}}}},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to sum storage of %s: %v", owner, err)
+	}
+
+	var totals []struct {
+		Used int64 `bson:"used"`
+	}
+	if err := cursor.All(ctx, &totals); err != nil {
+		return 0, fmt.Errorf("failed to read storage of %s: %v", owner, err)
+	}
+	if len(totals) == 0 {
+		return 0, nil
+	}
+	return totals[0].Used, nil
+}
+
+// MongoJobRepository is a JobRepository backed by a MongoDB collection.
+type MongoJobRepository struct {
+	collection *mongo.Collection
+}
+
+// Create inserts a new job, setting its creation time.
+func (r *MongoJobRepository) Create(ctx context.Context, job *JobRecord) error {
+	job.CreatedAt = time.Now().UTC()
+
+	if _, err := r.collection.InsertOne(ctx, job); err != nil {
+		return fmt.Errorf("failed to create job %s: %v", job.ID, err)
+	}
+	return nil
+}
+
+// Get returns the job with the given ID, or ErrNotFound.
+func (r *MongoJobRepository) Get(ctx context.Context, id string) (*JobRecord, error) {
+	var job JobRecord
+	err := r.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&job)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, fmt.Errorf("job %s: %w", id, ErrNotFound)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to find job %s: %v", id, err)
+	}
+	return &job, nil
+}
+
+// List returns the jobs with the given status (all jobs if status is empty), oldest first.
+func (r *MongoJobRepository) List(ctx context.Context, status string) ([]JobRecord, error) {
+	filter := bson.M{}
+	if status != "" {
+		filter["status"] = status
+	}
+
+	cursor, err := r.collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list jobs: %v", err)
+	}
+
+	jobs := []JobRecord{}
+	if err := cursor.All(ctx, &jobs); err != nil {
+		return nil, fmt.Errorf("failed to read jobs: %v", err)
+	}
+	return jobs, nil
+}
+
+// MarkRunning records that a worker started the queued job, incrementing its attempt count.
+func (r *MongoJobRepository) MarkRunning(ctx context.Context, id string) error {
+	update := bson.M{
+		"$set": bson.M{"status": JobStatusRunning, "error": "", "started_at": time.Now().UTC()},
+		"$inc": bson.M{"attempts": 1},
+	}
+	return r.update(ctx, id, []string{JobStatusQueued}, update)
+}
+
+// MarkFinished records the outcome of a queued or running job.
+func (r *MongoJobRepository) MarkFinished(ctx context.Context, id string, status string, errMsg string) error {
+	update := bson.M{"$set": bson.M{"status": status, "error": errMsg, "finished_at": time.Now().UTC()}}
+	return r.update(ctx, id, []string{JobStatusQueued, JobStatusRunning}, update)
+}
+
+// update applies an update document to a single job, if the job has one of the given statuses.
+// The status is part of the filter, so a concurrent change of the status is never overwritten.
+func (r *MongoJobRepository) update(ctx context.Context, id string, from []string, update bson.M) error {
+	result, err := r.collection.UpdateOne(ctx, bson.M{"_id": id, "status": bson.M{"$in": from}}, update)
+	if err != nil {
+		return fmt.Errorf("failed to update job %s: %v", id, err)
+	}
+	if result.MatchedCount > 0 {
+		return nil
+	}
+
+	// Tell a job in another status from one that does not exist
+	count, err := r.collection.CountDocuments(ctx, bson.M{"_id": id})
+	if err != nil {
+		return fmt.Errorf("failed to find job %s: %v", id, err)
+	}
+	if count == 0 {
+		return fmt.Errorf("job %s: %w", id, ErrNotFound)
+	}
+	return fmt.Errorf("job %s: %w", id, ErrJobFinished)
+}
+
+// GridFSMediaRepository is a MediaRepository backed by a MongoDB GridFS bucket.
+type GridFSMediaRepository struct {
+	bucket *gridfs.Bucket
+	files  *mongo.Collection // The bucket's files collection, used for listing by prefix
+}
+
+// gridFSFile is the subset of a GridFS files document the repository reads.
+type gridFSFile struct {
+	ID         primitive.ObjectID `bson:"_id"`
+	Name       string             `bson:"filename"`
+	Length     int64              `bson:"length"`
+	UploadDate time.Time          `bson:"uploadDate"`
+	MD5        string             `bson:"md5,omitempty"`
+}
+
+// info converts a GridFS files document to a MediaFileInfo.
+func (f gridFSFile) info() MediaFileInfo {
+	return MediaFileInfo{Name: f.Name, Size: f.Length, UploadedAt: f.UploadDate, MD5: f.MD5}
+}
+
+// Save uploads the contents of r as a new revision of the named file and removes older revisions.
+// The driver no longer computes the md5 field of GridFS files, so Save hashes the contents while
+// copying them and sets the field itself once the upload is finished.
+func (r *GridFSMediaRepository) Save(ctx context.Context, name string, reader io.Reader) (MediaFileInfo, error) {
+	defer metrics.ObserveSince(metrics.MediaOperationSeconds.WithLabelValues("write"), time.Now())
+
+	previous, err := r.revisions(ctx, name)
+	if err != nil {
+		return MediaFileInfo{}, err
+	}
+
+	// Open an upload stream for the file in the GridFS bucket
+	uploadStream, err := r.bucket.OpenUploadStream(name)
+	if err != nil {
+		return MediaFileInfo{}, fmt.Errorf("failed to open upload stream: %v", err)
+	}
+
+	// Copy the contents to the GridFS upload stream; the file is only stored once the stream is closed
+	hash := md5.New()
+	size, err := io.Copy(uploadStream, io.TeeReader(reader, hash))
+	if err != nil {
+		uploadStream.Abort()
+		return MediaFileInfo{}, fmt.Errorf("failed to upload file to GridFS: %v", err)
+	}
+	if err := uploadStream.Close(); err != nil {
+		return MediaFileInfo{}, fmt.Errorf("failed to finish upload to GridFS: %v", err)
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if _, err := r.files.UpdateByID(ctx, uploadStream.FileID, bson.M{"$set": bson.M{"md5": sum}}); err != nil {
+		return MediaFileInfo{}, fmt.Errorf("failed to record checksum of %s: %v", name, err)
+	}
+
+	// Remove older revisions so only the new contents are kept
+	for _, revision := range previous {
+		if err := r.bucket.Delete(revision.ID); err != nil && !errors.Is(err, gridfs.ErrFileNotFound) {
+			return MediaFileInfo{}, fmt.Errorf("failed to delete old revision of %s: %v", name, err)
+		}
+	}
+
+	return MediaFileInfo{Name: name, Size: size, UploadedAt: time.Now().UTC(), MD5: sum}, nil
+}
+
+// Open returns a reader for the latest revision of the named file, or ErrNotFound.
+func (r *GridFSMediaRepository) Open(ctx context.Context, name string) (io.ReadCloser, MediaFileInfo, error) {
+	defer metrics.ObserveSince(metrics.MediaOperationSeconds.WithLabelValues("read"), time.Now())
+
+	downloadStream, err := r.bucket.OpenDownloadStreamByName(name)
+	if errors.Is(err, gridfs.ErrFileNotFound) {
+		return nil, MediaFileInfo{}, fmt.Errorf("media file %s: %w", name, ErrNotFound)
+	} else if err != nil {
+		return nil, MediaFileInfo{}, fmt.Errorf("failed to open media file %s: %v", name, err)
+	}
+
+	file := downloadStream.GetFile()
+	return downloadStream, MediaFileInfo{Name: file.Name, Size: file.Length, UploadedAt: file.UploadDate}, nil
+}
+
+// Delete removes every stored revision of the named file, or returns ErrNotFound.
+func (r *GridFSMediaRepository) Delete(ctx context.Context, name string) error {
+	revisions, err := r.revisions(ctx, name)
+	if err != nil {
+		return err
+	}
+	if len(revisions) == 0 {
+		return fmt.Errorf("media file %s: %w", name, ErrNotFound)
+	}
+
+	for _, revision := range revisions {
+		if err := r.bucket.Delete(revision.ID); err != nil && !errors.Is(err, gridfs.ErrFileNotFound) {
+			return fmt.Errorf("failed to delete media file %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// List returns the latest revision of every file whose name starts with prefix.
+func (r *GridFSMediaRepository) List(ctx context.Context, prefix string) ([]MediaFileInfo, error) {
+	filter := bson.M{"filename": bson.M{"$regex": "^" + regexp.QuoteMeta(prefix)}}
+	files, err := r.find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	// Files are sorted by upload date, so later revisions overwrite earlier ones
+	latest := make(map[string]int)
+	infos := []MediaFileInfo{}
+	for _, file := range files {
+		if i, ok := latest[file.Name]; ok {
+			infos[i] = file.info()
+			continue
+		}
+		latest[file.Name] = len(infos)
+		infos = append(infos, file.info())
+	}
+	return infos, nil
+}
+
+// revisions returns every stored revision of the named file.
+func (r *GridFSMediaRepository) revisions(ctx context.Context, name string) ([]gridFSFile, error) {
+	return r.find(ctx, bson.M{"filename": name})
+}
+
+// find returns the files documents matching filter, oldest upload first.
+func (r *GridFSMediaRepository) find(ctx context.Context, filter bson.M) ([]gridFSFile, error) {
+	cursor, err := r.files.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "uploadDate", Value: 1}}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query GridFS files: %v", err)
+	}
+
+	var files []gridFSFile
+	if err := cursor.All(ctx, &files); err != nil {
+		return nil, fmt.Errorf("failed to read GridFS files: %v", err)
+	}
+	return files, nil
+}
@@ -0,0 +1,168 @@
+package repository
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ErrNotFound is returned by every repository when the requested record or file does not exist.
+var ErrNotFound = errors.New("not found")
+
+// ErrJobFinished is returned when a job's status is updated after it left the queued or running
+// status it was expected in, e.g. because an operator cancelled it in the meantime.
+var ErrJobFinished = errors.New("job is already finished")
+
+// Video statuses stored on catalog records as a video moves through the pipeline.
+const (
+	VideoStatusImporting   = "importing"   // Source file is being downloaded from a URL
+	VideoStatusUploaded    = "uploaded"    // Source file is available, no job has been queued yet
+	VideoStatusQueued      = "queued"      // A transcode job has been queued for the video
+	VideoStatusTranscoding = "transcoding" // A worker is preparing or transcoding the video
+	VideoStatusReady       = "ready"       // HLS renditions are stored and can be played
+	VideoStatusFailed      = "failed"      // Preparing or transcoding the video failed
+	VideoStatusLive        = "live"        // A live stream is being ingested and can be watched
+	VideoStatusEnded       = "ended"       // A live stream's publisher disconnected
+)
+
+// Job statuses stored on job records.
+const (
+	JobStatusQueued    = "queued"    // Waiting for a free worker
+	JobStatusRunning   = "running"   // Being processed by a worker
+	JobStatusSucceeded = "succeeded" // Finished and all output was stored
+	JobStatusFailed    = "failed"    // Finished with an error
+	JobStatusCancelled = "cancelled" // Stopped by an operator before it finished
+)
+
+// Video is a catalog record describing a single playable video. Uploaded videos use their
+// tus upload ID as ID; derived videos (clips and concatenations) get a freshly generated ID
+// and keep a reference to the videos they were derived from.
+type Video struct {
+	ID          string            `bson:"_id" json:"id"`                                      // Stream ID, also the name of the source file in the upload path
+	Filename    string            `bson:"filename" json:"filename"`                           // Name the client uploaded the source file as; the ID for derived videos
+	FileType    string            `bson:"file_type,omitempty" json:"file_type,omitempty"`     // MIME type the client reported for the source file
+	Title       string            `bson:"title,omitempty" json:"title,omitempty"`             // Title given by the client
+	Description string            `bson:"description,omitempty" json:"description,omitempty"` // Description given by the client
+	Tags        []string          `bson:"tags,omitempty" json:"tags,omitempty"`               // Tags given by the client
+	ClientIDs   map[string]string `bson:"client_ids,omitempty" json:"client_ids,omitempty"`   // IDs the client attached to the upload, keyed by metadata key
+	Owner       string            `bson:"owner,omitempty" json:"owner,omitempty"`             // User who uploaded the video, counted against their storage quota
+	Size        int64             `bson:"size,omitempty" json:"size,omitempty"`               // Size of the uploaded source file in bytes
+	ImportURL   string            `bson:"import_url,omitempty" json:"import_url,omitempty"`   // URL the source file was imported from, without its query
+	Status      string            `bson:"status" json:"status"`                               // Current pipeline status (see VideoStatus* constants)
+	Error       string            `bson:"error,omitempty" json:"error,omitempty"`             // Last failure reported for the video, if any
+	ParentID    string            `bson:"parent_id,omitempty" json:"parent_id,omitempty"`     // ID of the video this one was derived from
+	ClipStart   float64           `bson:"clip_start,omitempty" json:"clip_start,omitempty"`   // Start of the clip within the parent, in seconds
+	ClipEnd     float64           `bson:"clip_end,omitempty" json:"clip_end,omitempty"`       // End of the clip within the parent, in seconds
+	SourceIDs   []string          `bson:"source_ids,omitempty" json:"source_ids,omitempty"`   // IDs of the videos concatenated into this one, in order
+	CreatedAt   time.Time         `bson:"created_at" json:"created_at"`                       // Time the record was created
+	UpdatedAt   time.Time         `bson:"updated_at" json:"updated_at"`                       // Time the record was last modified
+}
+
+// ClipSpec describes the part of a parent video that a clip job has to cut out
+// before the clip can be transcoded like any other upload.
+type ClipSpec struct {
+	ParentFilename string  `bson:"parent_filename" json:"parent_filename"` // Name of the parent's source file in the upload path
+	Start          float64 `bson:"start" json:"start"`                     // Start of the clip within the parent, in seconds
+	End            float64 `bson:"end" json:"end"`                         // End of the clip within the parent, in seconds
+}
+
+// ConcatSpec describes the videos a concat job has to join, in order, before the result
+// can be transcoded like any other upload. Zero values for the target format mean
+// "use the format of the first source".
+type ConcatSpec struct {
+	SourceFilenames []string `bson:"source_filenames" json:"source_filenames"`         // Names of the source files in the upload path, in playback order
+	Width           int      `bson:"width,omitempty" json:"width,omitempty"`           // Target frame width in pixels
+	Height          int      `bson:"height,omitempty" json:"height,omitempty"`         // Target frame height in pixels
+	FrameRate       float64  `bson:"frame_rate,omitempty" json:"frame_rate,omitempty"` // Target frame rate in frames per second
+}
+
+// JobRecord is the persisted form of a transcode job. It holds everything needed to run the
+// job again, so jobs can be inspected and retried after the process that queued them is gone.
+type JobRecord struct {
+	ID         string      `bson:"_id" json:"id"`                                      // Unique job ID
+	VideoID    string      `bson:"video_id" json:"video_id"`                           // Video the job produces, also the source filename
+	Status     string      `bson:"status" json:"status"`                               // Current job status (see JobStatus* constants)
+	Error      string      `bson:"error,omitempty" json:"error,omitempty"`             // Failure reported by the last run, if any
+	Attempts   int         `bson:"attempts" json:"attempts"`                           // Number of times a worker has started the job
+	Clip       *ClipSpec   `bson:"clip,omitempty" json:"clip,omitempty"`               // Clip to cut before transcoding, if any
+	Concat     *ConcatSpec `bson:"concat,omitempty" json:"concat,omitempty"`           // Videos to join before transcoding, if any
+	CreatedAt  time.Time   `bson:"created_at" json:"created_at"`                       // Time the job was queued
+	StartedAt  time.Time   `bson:"started_at,omitempty" json:"started_at,omitempty"`   // Time the last run started
+	FinishedAt time.Time   `bson:"finished_at,omitempty" json:"finished_at,omitempty"` // Time the last run finished
+}
+
+// MediaFileInfo describes a file held by a MediaRepository.
+type MediaFileInfo struct {
+	Name       string    `json:"name"`          // Name the file is stored and served under
+	Size       int64     `json:"size"`          // Size of the file in bytes
+	UploadedAt time.Time `json:"uploaded_at"`   // Time the file was stored
+	MD5        string    `json:"md5,omitempty"` // Hex MD5 of the contents, set by Save and List; empty for files stored before checksums were kept
+}
+
+// VideoRepository stores the video catalog.
+type VideoRepository interface {
+	// Create inserts a new video, setting its timestamps.
+	Create(ctx context.Context, video *Video) error
+	// Get returns the video with the given ID, or ErrNotFound.
+	Get(ctx context.Context, id string) (*Video, error)
+	// List returns all videos, newest first.
+	List(ctx context.Context) ([]Video, error)
+	// UpdateStatus sets the pipeline status of a video and its failure reason (empty on success).
+	UpdateStatus(ctx context.Context, id string, status string, errMsg string) error
+	// SetSize records the size of a video's source file, once it is known.
+	SetSize(ctx context.Context, id string, size int64) error
+	// Delete removes a video from the catalog.
+	Delete(ctx context.Context, id string) error
+	// StorageUsed returns the total source size of the videos uploaded by owner, in bytes.
+	StorageUsed(ctx context.Context, owner string) (int64, error)
+}
+
+// JobRepository stores transcode jobs.
+type JobRepository interface {
+	// Create inserts a new job, setting its creation time.
+	Create(ctx context.Context, job *JobRecord) error
+	// Get returns the job with the given ID, or ErrNotFound.
+	Get(ctx context.Context, id string) (*JobRecord, error)
+	// List returns the jobs with the given status (all jobs if status is empty), oldest first.
+	List(ctx context.Context, status string) ([]JobRecord, error)
+	// MarkRunning records that a worker started the queued job, incrementing its attempt count.
+	// It returns ErrJobFinished if the job is no longer queued.
+	MarkRunning(ctx context.Context, id string) error
+	// MarkFinished records the outcome of a job run, or puts a job back in the queue. It returns
+	// ErrJobFinished if the job is neither queued nor running, so a cancellation is not overwritten.
+	MarkFinished(ctx context.Context, id string, status string, errMsg string) error
+}
+
+// MediaRepository stores the transcoded media files (playlists and segments) served to players.
+type MediaRepository interface {
+	// Save stores the contents of r under name, replacing any existing file with that name.
+	Save(ctx context.Context, name string, r io.Reader) (MediaFileInfo, error)
+	// Open returns a reader for the named file, or ErrNotFound. The caller must close it.
+	Open(ctx context.Context, name string) (io.ReadCloser, MediaFileInfo, error)
+	// Delete removes every stored revision of the named file, or returns ErrNotFound.
+	Delete(ctx context.Context, name string) error
+	// List returns the files whose names start with prefix.
+	List(ctx context.Context, prefix string) ([]MediaFileInfo, error)
+}
+
+// Repositories groups the repositories the application works with, so they can be passed
+// around together and swapped as a whole between the MongoDB and in-memory implementations.
+type Repositories struct {
+	Videos VideoRepository
+	Jobs   JobRepository
+	Media  MediaRepository
+}
+
+// NewID generates a random identifier for videos and jobs, using the same
+// 32 character hex format as tus upload IDs.
+func NewID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate ID: %v", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
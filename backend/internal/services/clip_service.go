@@ -0,0 +1,238 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"manhattan_tech_ventures/internal/tracing"
+)
+
+// keyframeTolerance is the distance, in seconds, below which a cut point is considered
+// to fall exactly on a keyframe, so no edge needs to be re-encoded.
+const keyframeTolerance = 0.001
+
+// runCommand runs an external command and returns its standard output. When the command
+// fails, the returned error includes whatever the command wrote to standard error.
+// Cancelling ctx kills the command. Every run is traced as a child of the span in ctx.
+func runCommand(ctx context.Context, name string, args ...string) (out []byte, err error) {
+	ctx, span := tracing.Start(ctx, name)
+	defer func() { tracing.End(span, err) }()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("%s interrupted: %w", name, ctx.Err())
+		}
+		return nil, fmt.Errorf("%s failed: %v: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// formatSeconds renders a timestamp in seconds the way ffmpeg expects it on the command line.
+func formatSeconds(seconds float64) string {
+	return strconv.FormatFloat(seconds, 'f', 3, 64)
+}
+
+// ProbeDuration returns the duration of a media file in seconds using ffprobe.
+func ProbeDuration(ctx context.Context, inputPath string) (float64, error) {
+	out, err := runCommand(ctx, "ffprobe", "-v", "error",
+		"-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		inputPath)
+	if err != nil {
+		return 0, err
+	}
+
+	duration, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse duration of %s: %v", inputPath, err)
+	}
+	return duration, nil
+}
+
+// probeVideoStream returns the codec name and pixel format of the first video stream of a file.
+func probeVideoStream(ctx context.Context, inputPath string) (codec string, pixFmt string, err error) {
+	out, err := runCommand(ctx, "ffprobe", "-v", "error",
+		"-select_streams", "v:0",
+		"-show_entries", "stream=codec_name,pix_fmt",
+		"-of", "csv=p=0",
+		inputPath)
+	if err != nil {
+		return "", "", err
+	}
+
+	fields := strings.Split(strings.TrimSpace(string(out)), ",")
+	if len(fields) < 2 {
+		return "", "", fmt.Errorf("no video stream found in %s", inputPath)
+	}
+	return fields[0], fields[1], nil
+}
+
+// probeKeyframes returns the timestamps of the video keyframes between start and end,
+// in ascending order. Only packet headers are read, so nothing has to be decoded.
+func probeKeyframes(ctx context.Context, inputPath string, start, end float64) ([]float64, error) {
+	out, err := runCommand(ctx, "ffprobe", "-v", "error",
+		"-select_streams", "v:0",
+		"-read_intervals", formatSeconds(start)+"%"+formatSeconds(end),
+		"-show_entries", "packet=pts_time,flags",
+		"-of", "csv=p=0",
+		inputPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var keyframes []float64
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(strings.TrimSpace(line), ",")
+		if len(fields) < 2 || !strings.HasPrefix(fields[1], "K") {
+			continue
+		}
+		pts, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil || pts < start || pts > end {
+			continue
+		}
+		keyframes = append(keyframes, pts)
+	}
+	return keyframes, nil
+}
+
+// TrimVideo cuts the range [start, end) out of inputPath and writes it to outputPath as an
+// MPEG-TS file. When the source is H.264, the range between the first and the last keyframe
+// inside the cut is stream-copied and only the partial GOPs at the edges are re-encoded.
+// Other codecs, or cuts without a usable keyframe, are re-encoded entirely. Cancelling ctx
+// stops the running ffmpeg process.
+func TrimVideo(ctx context.Context, inputPath string, outputPath string, start float64, end float64) error {
+	if end <= start {
+		return fmt.Errorf("invalid clip range %s-%s", formatSeconds(start), formatSeconds(end))
+	}
+
+	codec, pixFmt, err := probeVideoStream(ctx, inputPath)
+	if err != nil {
+		return err
+	}
+
+	keyframes, err := probeKeyframes(ctx, inputPath, start, end)
+	if err != nil {
+		return err
+	}
+
+	// Without two keyframes inside the range there is nothing worth stream-copying.
+	if codec != "h264" || len(keyframes) < 2 {
+		return encodeRange(ctx, inputPath, outputPath, start, end, pixFmt)
+	}
+	firstKeyframe := keyframes[0]
+	lastKeyframe := keyframes[len(keyframes)-1]
+
+	// Work in a scratch directory next to the output so the parts can be concatenated.
+	partsDir := outputPath + ".parts"
+	if err := os.MkdirAll(partsDir, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create clip work directory: %v", err)
+	}
+	defer os.RemoveAll(partsDir)
+
+	var parts []string
+
+	// Re-encode the leading partial GOP, unless the cut starts on a keyframe.
+	if firstKeyframe-start > keyframeTolerance {
+		head := filepath.Join(partsDir, "head.ts")
+		if err := encodeRange(ctx, inputPath, head, start, firstKeyframe, pixFmt); err != nil {
+			return err
+		}
+		parts = append(parts, head)
+	}
+
+	// Stream-copy every complete GOP between the first and the last keyframe.
+	body := filepath.Join(partsDir, "body.ts")
+	if _, err := runCommand(ctx, "ffmpeg", "-y", "-v", "error",
+		"-ss", formatSeconds(firstKeyframe),
+		"-i", inputPath,
+		"-t", formatSeconds(lastKeyframe-firstKeyframe),
+		"-map", "0:v:0", "-map", "0:a:0?",
+		"-c:v", "copy",
+		"-c:a", "aac",
+		"-f", "mpegts",
+		body); err != nil {
+		return fmt.Errorf("failed to copy clip body: %v", err)
+	}
+	parts = append(parts, body)
+
+	// Re-encode the trailing partial GOP, unless the cut ends on a keyframe.
+	if end-lastKeyframe > keyframeTolerance {
+		tail := filepath.Join(partsDir, "tail.ts")
+		if err := encodeRange(ctx, inputPath, tail, lastKeyframe, end, pixFmt); err != nil {
+			return err
+		}
+		parts = append(parts, tail)
+	}
+
+	return concatParts(ctx, parts, partsDir, outputPath)
+}
+
+// encodeRange re-encodes the range [start, end) of inputPath to H.264/AAC in MPEG-TS,
+// keeping the source pixel format so the result can be joined with stream-copied parts.
+func encodeRange(ctx context.Context, inputPath string, outputPath string, start float64, end float64, pixFmt string) error {
+	args := []string{"-y", "-v", "error",
+		"-ss", formatSeconds(start),
+		"-i", inputPath,
+		"-t", formatSeconds(end - start),
+		"-map", "0:v:0", "-map", "0:a:0?",
+		"-c:v", "libx264",
+		"-c:a", "aac",
+	}
+	if pixFmt != "" {
+		args = append(args, "-pix_fmt", pixFmt)
+	}
+	args = append(args, "-f", "mpegts", outputPath)
+
+	if _, err := runCommand(ctx, "ffmpeg", args...); err != nil {
+		return fmt.Errorf("failed to encode clip range %s-%s: %v", formatSeconds(start), formatSeconds(end), err)
+	}
+	return nil
+}
+
+// concatParts joins already encoded MPEG-TS parts into outputPath with the concat demuxer.
+func concatParts(ctx context.Context, parts []string, workDir string, outputPath string) error {
+	listPath, err := writeConcatList(parts, workDir)
+	if err != nil {
+		return err
+	}
+
+	if _, err := runCommand(ctx, "ffmpeg", "-y", "-v", "error",
+		"-f", "concat", "-safe", "0",
+		"-i", listPath,
+		"-c", "copy",
+		"-f", "mpegts",
+		outputPath); err != nil {
+		return fmt.Errorf("failed to join clip parts: %v", err)
+	}
+	return nil
+}
+
+// writeConcatList writes the file list read by ffmpeg's concat demuxer into workDir and
+// returns its path.
+func writeConcatList(parts []string, workDir string) (string, error) {
+	var list strings.Builder
+	for _, part := range parts {
+		absPart, err := filepath.Abs(part)
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve part %s: %v", part, err)
+		}
+		fmt.Fprintf(&list, "file '%s'\n", strings.ReplaceAll(absPart, "'", `'\''`))
+	}
+
+	listPath := filepath.Join(workDir, "parts.txt")
+	if err := os.WriteFile(listPath, []byte(list.String()), 0o644); err != nil {
+		return "", fmt.Errorf("failed to write concat list: %v", err)
+	}
+	return listPath, nil
+}
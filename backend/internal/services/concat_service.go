@@ -0,0 +1,219 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"manhattan_tech_ventures/internal/repository"
+	"manhattan_tech_ventures/internal/tracing"
+)
+
+// MediaInfo holds the properties of a media file needed to normalize it for concatenation.
+type MediaInfo struct {
+	Width     int     // Width of the first video stream
+	Height    int     // Height of the first video stream
+	FrameRate float64 // Frame rate of the first video stream
+	HasAudio  bool    // Whether the file contains at least one audio stream
+	Duration  float64 // Duration of the file in seconds
+}
+
+// ProbeMediaInfo reads the video dimensions, frame rate, audio presence and duration of a file with ffprobe.
+func ProbeMediaInfo(ctx context.Context, inputPath string) (MediaInfo, error) {
+	out, err := runCommand(ctx, "ffprobe", "-v", "error",
+		"-show_entries", "stream=codec_type,width,height,r_frame_rate:format=duration",
+		"-of", "json",
+		inputPath)
+	if err != nil {
+		return MediaInfo{}, err
+	}
+
+	var probe struct {
+		Streams []struct {
+			CodecType  string `json:"codec_type"`
+			Width      int    `json:"width"`
+			Height     int    `json:"height"`
+			RFrameRate string `json:"r_frame_rate"`
+		} `json:"streams"`
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return MediaInfo{}, fmt.Errorf("failed to parse ffprobe output for %s: %v", inputPath, err)
+	}
+
+	var info MediaInfo
+	foundVideo := false
+	for _, stream := range probe.Streams {
+		switch stream.CodecType {
+		case "video":
+			if !foundVideo {
+				foundVideo = true
+				info.Width = stream.Width
+				info.Height = stream.Height
+				info.FrameRate = parseFrameRate(stream.RFrameRate)
+			}
+		case "audio":
+			info.HasAudio = true
+		}
+	}
+	if !foundVideo {
+		return MediaInfo{}, fmt.Errorf("no video stream found in %s", inputPath)
+	}
+
+	info.Duration, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	return info, nil
+}
+
+// parseFrameRate converts an ffprobe rational such as "30000/1001" to frames per second.
+func parseFrameRate(rate string) float64 {
+	num, den, found := strings.Cut(rate, "/")
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0
+	}
+	if !found {
+		return n
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d == 0 {
+		return 0
+	}
+	return n / d
+}
+
+// evenDimension rounds a frame dimension down to an even number, as required by yuv420p.
+func evenDimension(size int) int {
+	return size - size%2
+}
+
+// ConcatVideos normalizes every input to a common resolution, frame rate and audio layout
+// and joins them, in order, into a single H.264/AAC MPEG-TS file at outputPath. Inputs without
+// audio get a silent track so all segments line up. Progress is reported as a percentage of
+// the combined input duration through the progress callback, which may be nil. Cancelling
+// ctx stops the running ffmpeg process.
+func ConcatVideos(ctx context.Context, inputPaths []string, outputPath string, spec repository.ConcatSpec, progress func(percent int)) error {
+	if len(inputPaths) < 2 {
+		return fmt.Errorf("at least two videos are required for concatenation")
+	}
+
+	infos := make([]MediaInfo, len(inputPaths))
+	var totalDuration float64
+	for i, inputPath := range inputPaths {
+		info, err := ProbeMediaInfo(ctx, inputPath)
+		if err != nil {
+			return err
+		}
+		infos[i] = info
+		totalDuration += info.Duration
+	}
+
+	// Fill in the target format from the first source where the spec leaves it open
+	width, height, frameRate := spec.Width, spec.Height, spec.FrameRate
+	if width <= 0 || height <= 0 {
+		width, height = infos[0].Width, infos[0].Height
+	}
+	if frameRate <= 0 {
+		frameRate = infos[0].FrameRate
+	}
+	if frameRate <= 0 {
+		frameRate = 30
+	}
+	width, height = evenDimension(width), evenDimension(height)
+
+	args := []string{"-y", "-v", "error", "-nostats", "-progress", "pipe:1"}
+	for _, inputPath := range inputPaths {
+		args = append(args, "-i", inputPath)
+	}
+
+	// Generate silence for inputs without audio; these are appended after the real inputs
+	silenceInputs := make(map[int]int)
+	for i, info := range infos {
+		if !info.HasAudio {
+			silenceInputs[i] = len(inputPaths) + len(silenceInputs)
+			args = append(args, "-f", "lavfi", "-t", formatSeconds(info.Duration),
+				"-i", "anullsrc=channel_layout=stereo:sample_rate=48000")
+		}
+	}
+
+	// Scale and pad each video into the target frame, then resample each audio track
+	var filter strings.Builder
+	var concatInputs strings.Builder
+	for i := range inputPaths {
+		fmt.Fprintf(&filter,
+			"[%d:v:0]scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,setsar=1,fps=%s,format=yuv420p[v%d];",
+			i, width, height, width, height, strconv.FormatFloat(frameRate, 'f', -1, 64), i)
+
+		audioInput := fmt.Sprintf("%d:a:0", i)
+		if silence, ok := silenceInputs[i]; ok {
+			audioInput = fmt.Sprintf("%d:a:0", silence)
+		}
+		fmt.Fprintf(&filter, "[%s]aresample=48000,aformat=channel_layouts=stereo[a%d];", audioInput, i)
+		fmt.Fprintf(&concatInputs, "[v%d][a%d]", i, i)
+	}
+	fmt.Fprintf(&filter, "%sconcat=n=%d:v=1:a=1[v][a]", concatInputs.String(), len(inputPaths))
+
+	args = append(args,
+		"-filter_complex", filter.String(),
+		"-map", "[v]", "-map", "[a]",
+		"-c:v", "libx264",
+		"-c:a", "aac",
+		"-f", "mpegts",
+		outputPath)
+
+	return runWithProgress(ctx, exec.CommandContext(ctx, "ffmpeg", args...), totalDuration, progress)
+}
+
+// runWithProgress runs an ffmpeg command started with "-progress pipe:1" and translates its
+// out_time reports into percentages of totalDuration. A percentage is only reported when it changes.
+func runWithProgress(ctx context.Context, cmd *exec.Cmd, totalDuration float64, progress func(percent int)) (err error) {
+	_, span := tracing.Start(ctx, "ffmpeg")
+	defer func() { tracing.End(span, err) }()
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to read ffmpeg progress: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start ffmpeg: %v", err)
+	}
+
+	lastPercent := -1
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), "=")
+		if !found || key != "out_time_us" || progress == nil || totalDuration <= 0 {
+			continue
+		}
+
+		microseconds, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			continue
+		}
+		percent := int(microseconds / 1e6 / totalDuration * 100)
+		if percent > 100 {
+			percent = 100
+		}
+		if percent > lastPercent {
+			lastPercent = percent
+			progress(percent)
+		}
+	}
+
+	if err := cmd.Wait(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("ffmpeg interrupted: %w", ctx.Err())
+		}
+		return fmt.Errorf("ffmpeg failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
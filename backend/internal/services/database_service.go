@@ -1,30 +1,53 @@
 package service
 
 import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/gridfs"
-	"go.mongodb.org/mongo-driver/mongo/options"
+	"manhattan_tech_ventures/internal/logging"
+	"manhattan_tech_ventures/internal/metrics"
+	"manhattan_tech_ventures/internal/repository"
+	"manhattan_tech_ventures/internal/tracing"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
+// mediaUploadRetryDelay is the wait before a file that failed to store is tried again the
+// first time; it doubles with every further attempt.
+const mediaUploadRetryDelay = time.Second
+
 // NormalizePath replaces backslashes with forward slashes to ensure consistent path formatting.
 // This function is particularly useful for normalizing file paths on different operating systems.
 func NormalizePath(path string) string {
 	return strings.ReplaceAll(path, `\`, `/`)
 }
 
-// UploadFileToGridFS uploads a file from the local filesystem to MongoDB GridFS.
-// It takes the MongoDB database, the file path of the file to upload, and the GridFS bucket name as parameters.
-// The function opens the file, creates an upload stream in the specified GridFS bucket, and copies the file's contents
-// into the GridFS bucket. If any step fails, it returns an error.
-func UploadFileToGridFS(db *mongo.Database, filePath string, bucketName string) error {
+// UploadMediaFile stores a file from the local filesystem in the media repository.
+// It takes the media repository and the file path of the file to upload as parameters.
+// The function opens the file and copies its contents into the repository under the name
+// mediaFileName derives from its path, which is the name ServeMediaFile later looks it up by.
+// The stored file is then read back and its length and MD5 compared with the local file's, so a
+// file that was not stored intact is reported as an error rather than found by a viewer. If any
+// step fails, it returns an error. The upload is traced as a child of the span in ctx, but
+// cancelling ctx does not interrupt it.
+func UploadMediaFile(ctx context.Context, media repository.MediaRepository, filePath string) (err error) {
+	relPath := mediaFileName(filePath)
+
+	_, span := tracing.Start(ctx, "media.upload", tracing.FileName.String(relPath))
+	defer func() { tracing.End(span, err) }()
+	ctx = trace.ContextWithSpan(context.Background(), span)
+
 	// Open the local file for reading
 	file, err := os.Open(filePath)
 	if err != nil {
@@ -32,65 +55,252 @@ func UploadFileToGridFS(db *mongo.Database, filePath string, bucketName string)
 	}
 	defer file.Close()
 
-	// Create a new GridFS bucket with the specified name
-	bucket, err := gridfs.NewBucket(db, options.GridFSBucket().SetName(bucketName))
+	// Copy the file's contents into the media repository, hashing them on the way; only the span
+	// is carried over from ctx, so a file that is being stored is always finished
+	hash := md5.New()
+	info, err := media.Save(ctx, relPath, io.TeeReader(file, hash))
 	if err != nil {
-		return fmt.Errorf("failed to create GridFS bucket: %v", err)
+		return fmt.Errorf("failed to upload file %s: %v", relPath, err)
 	}
+	span.SetAttributes(tracing.FileSize.Int64(info.Size))
 
-	// Normalize the file path by trimming the output directory prefix
-	relPath := NormalizePath(strings.TrimPrefix(filePath, "./output/"))
-
-	// Open an upload stream for the file in the GridFS bucket
-	uploadStream, err := bucket.OpenUploadStream(relPath)
+	stat, err := file.Stat()
 	if err != nil {
-		return fmt.Errorf("failed to open upload stream: %v", err)
+		return fmt.Errorf("failed to read file %s: %v", filePath, err)
+	}
+	return verifyMediaFile(ctx, media, relPath, stat.Size(), hex.EncodeToString(hash.Sum(nil)))
+}
+
+// mediaFileName returns the name a local file is stored under in the media repository: its
+// path in the form "./<path>", with the same separators on every platform.
+func mediaFileName(filePath string) string {
+	return NormalizePath("./" + filepath.Clean(filePath))
+}
+
+// uploadMediaFiles stores local files in the media repository with UploadMediaFile, using up to
+// workers uploads at once. A file that fails to store is tried again up to retries more times,
+// waiting longer before every attempt. If some files still could not be stored, the returned
+// error lists the names they were to be stored under. Once ctx is cancelled no further uploads
+// are started and ctx's error is returned.
+func uploadMediaFiles(ctx context.Context, media repository.MediaRepository, files []string, workers int, retries int) error {
+	logger := logging.FromContext(ctx)
+	queue := make(chan string)
+	var mu sync.Mutex
+	var missing []string
+
+	var wg sync.WaitGroup
+	for i := 0; i < max(workers, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for filePath := range queue {
+				if err := uploadWithRetries(ctx, media, filePath, retries); err != nil {
+					if ctx.Err() == nil {
+						logger.Error("Failed to store media file", "file", filePath, "error", err)
+						metrics.MediaUploadFailures.Inc()
+					}
+					mu.Lock()
+					missing = append(missing, mediaFileName(filePath))
+					mu.Unlock()
+				}
+			}
+		}()
 	}
-	defer uploadStream.Close()
 
-	// Copy the file's contents to the GridFS upload stream
-	if _, err := io.Copy(uploadStream, file); err != nil {
-		return fmt.Errorf("failed to upload file to GridFS: %v", err)
+feed:
+	for _, filePath := range files {
+		select {
+		case queue <- filePath:
+		case <-ctx.Done():
+			break feed
+		}
 	}
+	close(queue)
+	wg.Wait()
 
+	if ctx.Err() != nil {
+		return fmt.Errorf("upload interrupted: %w", ctx.Err())
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("failed to store %d of %d files: %s", len(missing), len(files), strings.Join(missing, ", "))
+	}
 	return nil
 }
 
-// ServeFileFromGridFS serves a file stored in MongoDB GridFS to the client over HTTP.
-// It takes the HTTP response writer, request, MongoDB database, the filename to serve, and the GridFS bucket name as parameters.
-// The function retrieves the file from GridFS using the filename, sets the appropriate content type based on the file extension,
-// and writes the file's contents to the response. If the file is not found or any error occurs, it sends an appropriate HTTP error response.
-func ServeFileFromGridFS(w http.ResponseWriter, r *http.Request, db *mongo.Database, filename string, bucketName string) {
-	// Normalize the filename to ensure consistent path formatting
-	normalizedFilePath := NormalizePath(filename)
+// uploadWithRetries stores a local file with UploadMediaFile, trying again up to retries times
+// with a growing delay while it fails and ctx is not cancelled.
+func uploadWithRetries(ctx context.Context, media repository.MediaRepository, filePath string, retries int) error {
+	delay := mediaUploadRetryDelay
+	for attempt := 0; ; attempt++ {
+		err := UploadMediaFile(ctx, media, filePath)
+		if err == nil || attempt >= retries {
+			return err
+		}
+		logging.FromContext(ctx).Warn("Retrying media file upload", "file", filePath, "attempt", attempt+1, "error", err)
+		metrics.MediaUploadRetries.Inc()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
 
-	// Create a new GridFS bucket with the specified name
-	bucket, err := gridfs.NewBucket(db, options.GridFSBucket().SetName(bucketName))
+// verifyMediaFile reads a file back from the media repository and checks that it holds size
+// bytes with the given hex MD5. The checksum the repository records is computed from the same
+// stream as sum while storing it, so only reading the stored contents shows that they were
+// written intact.
+func verifyMediaFile(ctx context.Context, media repository.MediaRepository, name string, size int64, sum string) error {
+	reader, _, err := media.Open(ctx, name)
 	if err != nil {
-		http.Error(w, "Failed to create GridFS bucket", http.StatusInternalServerError)
-		log.Printf("Failed to create GridFS bucket: %v", err)
-		return
+		return fmt.Errorf("failed to open stored file %s: %v", name, err)
 	}
+	defer reader.Close()
 
-	// Open a download stream for the file in the GridFS bucket using its name
-	downloadStream, err := bucket.OpenDownloadStreamByName(normalizedFilePath)
+	hash := md5.New()
+	read, err := io.Copy(hash, reader)
 	if err != nil {
+		return fmt.Errorf("failed to read back stored file %s: %v", name, err)
+	}
+	if read != size {
+		return fmt.Errorf("stored file %s holds %d bytes, expected %d", name, read, size)
+	}
+	if stored := hex.EncodeToString(hash.Sum(nil)); stored != sum {
+		return fmt.Errorf("stored file %s has MD5 %s, expected %s", name, stored, sum)
+	}
+	return nil
+}
+
+// ServeMediaFile serves a file stored in the media repository to the client over HTTP.
+// It takes the HTTP response writer, request, media repository and the filename to serve as parameters.
+// The function retrieves the file from the repository using the filename, sets the appropriate content type based on the file extension,
+// and writes the file's contents, or the byte ranges the client asked for, to the response. If the file is not found or any error occurs, it sends an appropriate HTTP error response.
+func ServeMediaFile(w http.ResponseWriter, r *http.Request, media repository.MediaRepository, filename string) {
+	// Normalize the filename to ensure consistent path formatting
+	normalizedFilePath := NormalizePath(filename)
+
+	// Open the file in the media repository using its name
+	downloadStream, info, err := media.Open(r.Context(), normalizedFilePath)
+	if errors.Is(err, repository.ErrNotFound) {
 		http.Error(w, "File not found", http.StatusNotFound)
-		log.Printf("File not found in GridFS: %s", normalizedFilePath)
+		logging.FromContext(r.Context()).Warn("File not found in media repository", "file", normalizedFilePath)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to open file", http.StatusInternalServerError)
+		logging.FromContext(r.Context()).Error("Failed to open media file", "file", normalizedFilePath, "error", err)
 		return
 	}
-	defer downloadStream.Close()
+	content := &mediaReadSeeker{ctx: r.Context(), media: media, name: normalizedFilePath, size: info.Size, reader: downloadStream}
+	defer content.Close()
+
+	// Describe the served file on the request's span, if it is traced
+	trace.SpanFromContext(r.Context()).SetAttributes(tracing.FileName.String(info.Name), tracing.FileSize.Int64(info.Size))
 
 	// Set the appropriate Content-Type header based on the file extension
 	if filepath.Ext(normalizedFilePath) == ".m3u8" {
 		w.Header().Set("Content-Type", "application/text")
+		w.Header().Set("Cache-Control", "no-cache") // Playlists grow while their video is being encoded
 	} else if filepath.Ext(normalizedFilePath) == ".ts" {
 		w.Header().Set("Content-Type", "video/vnd.dlna.mpeg-tts")
+	} else if filepath.Ext(normalizedFilePath) == ".mp4" {
+		w.Header().Set("Content-Type", "video/mp4")
+	}
+
+	// Serve the contents of the file from the repository, answering Range requests such as the
+	// byte ranges of I-frame playlists by seeking within the stored file
+	http.ServeContent(w, r, "", info.UploadedAt, content)
+	if content.err != nil {
+		logging.FromContext(r.Context()).Error("Failed to serve media file", "file", normalizedFilePath, "error", content.err)
+	}
+}
+
+// mediaReadSeeker lets http.ServeContent seek within a file of the media repository, whose
+// readers can only be read from the start. Seeking only records the new position; the next
+// read skips forward to it, or reopens the file when it lies before the current read position.
+type mediaReadSeeker struct {
+	ctx     context.Context
+	media   repository.MediaRepository
+	name    string
+	size    int64         // Size of the file
+	reader  io.ReadCloser // Current reader of the file, nil until the file is reopened
+	readPos int64         // Position of reader within the file
+	pos     int64         // Position the next read starts at
+	err     error         // First error reading the file
+}
+
+// Read reads from the current position, moving the underlying reader there first.
+func (m *mediaReadSeeker) Read(p []byte) (int, error) {
+	if m.pos >= m.size {
+		return 0, io.EOF
+	}
+	if m.reader != nil && m.pos < m.readPos {
+		m.reader.Close()
+		m.reader = nil
+	}
+	if m.reader == nil {
+		reader, _, err := m.media.Open(m.ctx, m.name)
+		if err != nil {
+			return 0, m.fail(err)
+		}
+		m.reader, m.readPos = reader, 0
+	}
+	if m.pos > m.readPos {
+		if err := m.skip(m.pos - m.readPos); err != nil {
+			return 0, m.fail(err)
+		}
+		m.readPos = m.pos
 	}
 
-	// Copy the contents of the file from GridFS to the HTTP response writer
-	if _, err := io.Copy(w, downloadStream); err != nil {
-		http.Error(w, "Failed to serve file", http.StatusInternalServerError)
-		log.Printf("Failed to serve file from GridFS: %v", err)
+	n, err := m.reader.Read(p)
+	m.readPos += int64(n)
+	m.pos += int64(n)
+	if err != nil && err != io.EOF {
+		m.fail(err)
+	}
+	return n, err
+}
+
+// skip moves the underlying reader forward, using the reader's own Skip when it has one
+// (GridFS download streams do) instead of reading the skipped bytes.
+func (m *mediaReadSeeker) skip(n int64) error {
+	if skipper, ok := m.reader.(interface{ Skip(int64) (int64, error) }); ok {
+		_, err := skipper.Skip(n)
+		return err
+	}
+	_, err := io.CopyN(io.Discard, m.reader, n)
+	return err
+}
+
+// fail records the first read error, so it can be logged once the response is written.
+func (m *mediaReadSeeker) fail(err error) error {
+	if m.err == nil {
+		m.err = err
+	}
+	return err
+}
+
+// Seek sets the position of the next read.
+func (m *mediaReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += m.pos
+	case io.SeekEnd:
+		offset += m.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("seek to negative position in %s", m.name)
+	}
+	m.pos = offset
+	return offset, nil
+}
+
+// Close closes the underlying reader.
+func (m *mediaReadSeeker) Close() error {
+	if m.reader == nil {
+		return nil
 	}
+	return m.reader.Close()
 }
@@ -0,0 +1,47 @@
+package service
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"manhattan_tech_ventures/internal/repository"
+)
+
+// truncatingMedia stores only the first half of every file but records the size and checksum
+// of all of it, like a store that lost chunks after hashing the stream it was sent.
+type truncatingMedia struct {
+	*repository.MemoryMediaRepository
+}
+
+func (m truncatingMedia) Save(ctx context.Context, name string, reader io.Reader) (repository.MediaFileInfo, error) {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return repository.MediaFileInfo{}, err
+	}
+	info, err := m.MemoryMediaRepository.Save(ctx, name, strings.NewReader(string(data[:len(data)/2])))
+	info.Size = int64(len(data))
+	return info, err
+}
+
+func TestUploadMediaFileReadsStoredFileBack(t *testing.T) {
+	chdirTemp(t)
+	filePath := filepath.Join("transcoded", "720p", "video", "ts", "720p_000.ts")
+	if err := os.MkdirAll(filepath.Dir(filePath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filePath, []byte("segment contents"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := UploadMediaFile(context.Background(), repository.NewMemoryMediaRepository(), filePath); err != nil {
+		t.Errorf("storing intact file failed: %v", err)
+	}
+	err := UploadMediaFile(context.Background(), truncatingMedia{repository.NewMemoryMediaRepository()}, filePath)
+	if err == nil || !strings.Contains(err.Error(), "holds 8 bytes, expected 16") {
+		t.Errorf("storing truncated file returned %v, want the missing bytes reported", err)
+	}
+}
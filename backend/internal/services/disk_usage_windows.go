@@ -0,0 +1,26 @@
+//go:build windows
+
+package service
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// getDiskFreeSpaceEx is the kernel32 call reporting the free space of a volume.
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// diskFreeBytes returns the disk space available to the current user on the volume holding dir.
+func diskFreeBytes(dir string) (uint64, error) {
+	path, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var freeBytesAvailable uint64
+	ret, _, err := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(path)), uintptr(unsafe.Pointer(&freeBytesAvailable)), 0, 0)
+	if ret == 0 {
+		return 0, err
+	}
+	return freeBytesAvailable, nil
+}
@@ -0,0 +1,179 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"manhattan_tech_ventures/internal/repository"
+	"manhattan_tech_ventures/internal/tracing"
+)
+
+// MP4Exporter turns stored HLS renditions into single faststart MP4 files for download. An
+// MP4 is generated the first time it is asked for, by remuxing the rendition's segments without
+// re-encoding, and kept in the media repository next to the rendition for later requests.
+type MP4Exporter struct {
+	Media          repository.MediaRepository // Repository the renditions are read from and the MP4 files cached in
+	TranscodedPath string                     // Configured transcode path; names the stored files and holds the work directories
+
+	mu       sync.Mutex
+	inflight map[string]*exportCall // Exports in progress, keyed by the name of the MP4
+}
+
+// exportCall is an export in progress that several requests can wait for.
+type exportCall struct {
+	done chan struct{} // Closed when the export finished
+	err  error         // Outcome of the export, set before done is closed
+}
+
+// MP4Name returns the name a rendition's MP4 export is stored under in the media repository.
+func MP4Name(transcodedPath string, quality string, videoID string) string {
+	return NormalizePath("./" + filepath.Join(transcodedPath, quality, videoID, "mp4", quality+".mp4"))
+}
+
+// mediaSegmentName returns the name a rendition's segment is stored under in the media repository.
+func mediaSegmentName(transcodedPath string, rendition RenditionSpec, streamID string, filename string) string {
+	return NormalizePath("./" + filepath.Join(transcodedPath, rendition.Name, streamID, "ts", filename))
+}
+
+// Export makes sure the MP4 export of a video's rendition is stored and returns its name.
+// Concurrent requests for the same export wait for a single run. The export is not tied to
+// ctx's cancellation, so a client giving up does not waste the work done for the others.
+func (e *MP4Exporter) Export(ctx context.Context, videoID string, rendition RenditionSpec) (string, error) {
+	name := MP4Name(e.TranscodedPath, rendition.Name, videoID)
+	if reader, _, err := e.Media.Open(ctx, name); err == nil {
+		reader.Close()
+		return name, nil
+	}
+
+	e.mu.Lock()
+	if e.inflight == nil {
+		e.inflight = make(map[string]*exportCall)
+	}
+	call, running := e.inflight[name]
+	if !running {
+		call = &exportCall{done: make(chan struct{})}
+		e.inflight[name] = call
+		go func() {
+			call.err = e.export(context.WithoutCancel(ctx), videoID, rendition, name)
+			e.mu.Lock()
+			delete(e.inflight, name)
+			e.mu.Unlock()
+			close(call.done)
+		}()
+	}
+	e.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return "", fmt.Errorf("export interrupted: %w", ctx.Err())
+	case <-call.done:
+	}
+	if call.err != nil {
+		return "", call.err
+	}
+	return name, nil
+}
+
+// export downloads the segments of a rendition into a work directory, joins them into a
+// faststart MP4 and stores the result under name.
+func (e *MP4Exporter) export(ctx context.Context, videoID string, rendition RenditionSpec, name string) (err error) {
+	ctx, span := tracing.Start(ctx, "mp4.export", tracing.UploadID.String(videoID), tracing.Rendition.String(rendition.Name))
+	defer func() { tracing.End(span, err) }()
+
+	playlist, err := readMediaFile(ctx, e.Media, mediaPlaylistName(e.TranscodedPath, rendition, videoID, rendition.Name+".m3u8"))
+	if err != nil {
+		return err
+	}
+	segments := parseMediaPlaylist(playlist)
+	if len(segments) == 0 {
+		return fmt.Errorf("playlist of %s lists no segments", rendition.Name)
+	}
+
+	workDir, err := os.MkdirTemp(e.TranscodedPath, "mp4-export-")
+	if err != nil {
+		return fmt.Errorf("failed to create export work directory: %v", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	parts := make([]string, len(segments))
+	for i, segment := range segments {
+		parts[i] = filepath.Join(workDir, segmentFileName(segment.URI))
+		if err := e.downloadSegment(ctx, mediaSegmentName(e.TranscodedPath, rendition, videoID, segmentFileName(segment.URI)), parts[i]); err != nil {
+			return err
+		}
+	}
+
+	outputPath := filepath.Join(workDir, rendition.Name+".mp4")
+	listPath, err := writeConcatList(parts, workDir)
+	if err != nil {
+		return err
+	}
+	// ADTS audio from the MPEG-TS segments has to be repackaged for MP4; +faststart moves the
+	// index to the front so players can start before the whole file is downloaded
+	if _, err := runCommand(ctx, "ffmpeg", "-y", "-v", "error",
+		"-f", "concat", "-safe", "0",
+		"-i", listPath,
+		"-c", "copy",
+		"-bsf:a", "aac_adtstoasc",
+		"-movflags", "+faststart",
+		"-f", "mp4",
+		outputPath); err != nil {
+		return fmt.Errorf("failed to remux %s to MP4: %v", rendition.Name, err)
+	}
+
+	file, err := os.Open(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to open MP4 export: %v", err)
+	}
+	defer file.Close()
+
+	info, err := e.Media.Save(ctx, name, file)
+	if err != nil {
+		return fmt.Errorf("failed to store MP4 export: %v", err)
+	}
+	span.SetAttributes(tracing.FileSize.Int64(info.Size))
+	return nil
+}
+
+// downloadSegment copies a segment from the media repository to a local file.
+func (e *MP4Exporter) downloadSegment(ctx context.Context, name string, path string) error {
+	reader, _, err := e.Media.Open(ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to open segment %s: %v", name, err)
+	}
+	defer reader.Close()
+
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create segment file: %v", err)
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, reader); err != nil {
+		return fmt.Errorf("failed to download segment %s: %v", name, err)
+	}
+	return nil
+}
+
+// UploadFilename returns the file name a video was uploaded with, as sent by the client in
+// the tus Upload-Metadata header, or "" when it is not known (e.g. for derived videos). It reads
+// the upload's info file, for videos registered before the name was kept on the video record.
+func UploadFilename(uploadPath string, videoID string) string {
+	data, err := os.ReadFile(filepath.Join(uploadPath, videoID+".info"))
+	if err != nil {
+		return ""
+	}
+
+	var info struct {
+		MetaData map[string]string
+	}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return ""
+	}
+	return ParseUploadMetadata(info.MetaData).Filename
+}
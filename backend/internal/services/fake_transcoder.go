@@ -0,0 +1,119 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// tsPacketSize is the size of an MPEG-TS packet; fake segments are made of whole packets.
+const tsPacketSize = 188
+
+// FakeTranscoder is a Transcoder that does not run ffmpeg. It writes synthetic output in the
+// same layout as FFmpegTranscoder: an event playlist that grows with every segment and is
+// turned into a VOD playlist once the rendition is done, and an I-frame playlist pointing at
+// one keyframe per segment. The rest of the job flow (media upload, status events, catalog
+// updates) can therefore run without ffmpeg being installed.
+type FakeTranscoder struct {
+	Segments       int              // Number of segments written per rendition (defaults to 3)
+	SegmentPackets int              // Number of TS packets per segment (defaults to 10, at least 2)
+	Fail           map[string]error // Errors to return for specific renditions, keyed by rendition name
+
+	mu       sync.Mutex
+	requests []TranscodeRequest
+}
+
+// Requests returns a copy of every request the fake has received, in order.
+func (t *FakeTranscoder) Requests() []TranscodeRequest {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]TranscodeRequest(nil), t.requests...)
+}
+
+// Transcode writes synthetic playlists and segments for every requested rendition,
+// except the ones configured to fail. The source file must exist, like it must for ffmpeg.
+func (t *FakeTranscoder) Transcode(ctx context.Context, req TranscodeRequest, progress func(TranscodeProgress)) error {
+	t.mu.Lock()
+	t.requests = append(t.requests, req)
+	t.mu.Unlock()
+
+	if _, err := os.Stat(req.InputPath); err != nil {
+		return fmt.Errorf("failed to open source video: %v", err)
+	}
+
+	errChan := make(chan error, len(req.Renditions))
+	for _, rendition := range req.Renditions {
+		if err := ctx.Err(); err != nil {
+			errChan <- fmt.Errorf("failed to transcode %s: %v", rendition.Name, err)
+			break
+		}
+
+		renditionErr := t.Fail[rendition.Name]
+		if renditionErr == nil {
+			renditionErr = t.writeRendition(req, rendition)
+		}
+		if renditionErr != nil {
+			renditionErr = fmt.Errorf("failed to transcode %s: %v", rendition.Name, renditionErr)
+			errChan <- renditionErr
+		}
+		if progress != nil {
+			progress(TranscodeProgress{Rendition: rendition, Err: renditionErr})
+		}
+	}
+	close(errChan)
+
+	return combineErrors(errChan)
+}
+
+// writeRendition writes the playlists and segments of one rendition. Segment URIs use the
+// same base URL as the playlists produced by FFmpegTranscoder.
+func (t *FakeTranscoder) writeRendition(req TranscodeRequest, rendition RenditionSpec) error {
+	playlistDir, segmentDir, err := prepareRenditionDirs(req.OutputPath, rendition, req.StreamID)
+	if err != nil {
+		return err
+	}
+
+	segments := t.Segments
+	if segments <= 0 {
+		segments = 3
+	}
+	packets := t.SegmentPackets
+	if packets <= 0 {
+		packets = 10
+	}
+	packets = max(packets, 2)
+
+	// Every packet starts with the MPEG-TS sync byte, so the segments look like real TS data.
+	// The first packet of a segment stands for its PAT and PMT, the rest for one keyframe.
+	packet := make([]byte, tsPacketSize)
+	packet[0] = 0x47
+	segmentData := bytes.Repeat(packet, packets)
+
+	// Append every segment to the event playlist once it is written, like ffmpeg does
+	playlistPath := filepath.Join(playlistDir, rendition.Name+".m3u8")
+	var playlist strings.Builder
+	var frames []iFrame
+	playlist.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:10\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:EVENT\n")
+	for i := 0; i < segments; i++ {
+		segmentName := fmt.Sprintf("%s_%03d.ts", rendition.Name, i)
+		if err := os.WriteFile(filepath.Join(segmentDir, segmentName), segmentData, 0o644); err != nil {
+			return fmt.Errorf("failed to write segment %s: %v", segmentName, err)
+		}
+		uri := segmentDir + "\\" + segmentName
+		fmt.Fprintf(&playlist, "#EXTINF:10.000000,\n%s\n", uri)
+		if err := writePlaylist(playlistPath, playlist.String()); err != nil {
+			return err
+		}
+		frames = append(frames, iFrame{URI: uri, Time: float64(i * 10), Offset: tsPacketSize, Length: int64((packets - 1) * tsPacketSize)})
+	}
+	if err := finishPlaylist(playlistPath); err != nil {
+		return err
+	}
+
+	return writePlaylist(filepath.Join(playlistDir, IFramePlaylistName(rendition.Name)),
+		iFramePlaylist(frames, frames[0].URI, tsPacketSize, float64(segments*10)))
+}
@@ -0,0 +1,124 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// Health statuses reported by the readiness check, both overall and per component.
+const (
+	HealthStatusOK       = "ok"
+	HealthStatusDegraded = "degraded"
+)
+
+// mongoPingTimeout bounds how long the readiness check waits for MongoDB to answer a ping.
+const mongoPingTimeout = 2 * time.Second
+
+// HealthCheck is the result of checking a single component the service depends on.
+type HealthCheck struct {
+	Status    string  `json:"status"`               // HealthStatusOK or HealthStatusDegraded
+	Error     string  `json:"error,omitempty"`      // Why the component is degraded
+	LatencyMS float64 `json:"latency_ms,omitempty"` // Round trip time of the check, for remote dependencies
+	Path      string  `json:"path,omitempty"`       // Directory or binary that was checked
+	FreeBytes uint64  `json:"free_bytes,omitempty"` // Free disk space available to the process, for directories
+}
+
+// HealthReport is the result of a readiness check. Status is degraded if any check is.
+type HealthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks"`
+}
+
+// HealthChecker checks whether the service can do its work: reach MongoDB, write uploads and
+// transcoded output to disk, run ffmpeg and process jobs.
+type HealthChecker struct {
+	PingMongo      func(ctx context.Context) error // Pings the MongoDB deployment; nil when MongoDB is not used
+	Pool           *WorkerPool                     // Worker pool that has to be running
+	UploadPath     string                          // Directory tus uploads are written to
+	TranscodedPath string                          // Directory ffmpeg writes renditions to
+	MinFreeBytes   uint64                          // Free space both directories need to stay ready
+}
+
+// Check runs every readiness check and combines their results into a report.
+func (h *HealthChecker) Check(ctx context.Context) HealthReport {
+	report := HealthReport{Status: HealthStatusOK, Checks: map[string]HealthCheck{
+		"upload_path":     h.checkDirectory(h.UploadPath),
+		"transcoded_path": h.checkDirectory(h.TranscodedPath),
+		"ffmpeg":          checkBinary("ffmpeg"),
+		"ffprobe":         checkBinary("ffprobe"),
+		"worker_pool":     h.checkWorkerPool(),
+	}}
+	if h.PingMongo != nil {
+		report.Checks["mongo"] = h.checkMongo(ctx)
+	}
+
+	for _, check := range report.Checks {
+		if check.Status != HealthStatusOK {
+			report.Status = HealthStatusDegraded
+		}
+	}
+	return report
+}
+
+// checkMongo pings MongoDB and reports how long the round trip took.
+func (h *HealthChecker) checkMongo(ctx context.Context) HealthCheck {
+	ctx, cancel := context.WithTimeout(ctx, mongoPingTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := h.PingMongo(ctx)
+	check := HealthCheck{Status: HealthStatusOK, LatencyMS: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		check.Status = HealthStatusDegraded
+		check.Error = fmt.Sprintf("ping failed: %v", err)
+	}
+	return check
+}
+
+// checkDirectory verifies that a directory is writable, by creating and removing a file in it,
+// and that it has at least MinFreeBytes of free space left.
+func (h *HealthChecker) checkDirectory(dir string) HealthCheck {
+	check := HealthCheck{Status: HealthStatusOK, Path: dir}
+
+	file, err := os.CreateTemp(dir, ".readyz-*")
+	if err != nil {
+		check.Status = HealthStatusDegraded
+		check.Error = fmt.Sprintf("not writable: %v", err)
+		return check
+	}
+	file.Close()
+	os.Remove(file.Name())
+
+	free, err := diskFreeBytes(dir)
+	if err != nil {
+		check.Status = HealthStatusDegraded
+		check.Error = fmt.Sprintf("failed to read free disk space: %v", err)
+		return check
+	}
+	check.FreeBytes = free
+	if free < h.MinFreeBytes {
+		check.Status = HealthStatusDegraded
+		check.Error = fmt.Sprintf("only %d bytes free, need at least %d", free, h.MinFreeBytes)
+	}
+	return check
+}
+
+// checkWorkerPool reports whether the worker pool is processing jobs.
+func (h *HealthChecker) checkWorkerPool() HealthCheck {
+	if h.Pool == nil || !h.Pool.Running() {
+		return HealthCheck{Status: HealthStatusDegraded, Error: "worker pool is not running"}
+	}
+	return HealthCheck{Status: HealthStatusOK}
+}
+
+// checkBinary reports whether an executable can be found in PATH.
+func checkBinary(name string) HealthCheck {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return HealthCheck{Status: HealthStatusDegraded, Error: fmt.Sprintf("%s not found: %v", name, err)}
+	}
+	return HealthCheck{Status: HealthStatusOK, Path: path}
+}
@@ -0,0 +1,547 @@
+package service
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"manhattan_tech_ventures/internal/config"
+	"manhattan_tech_ventures/internal/logging"
+	"manhattan_tech_ventures/internal/repository"
+	"manhattan_tech_ventures/internal/tracing"
+)
+
+// importRetryDelay is the wait before an interrupted import download is resumed the first
+// time; it doubles with every further attempt.
+const importRetryDelay = 2 * time.Second
+
+var (
+	// errImportTooLarge is reported for sources larger than the upload size limit.
+	errImportTooLarge = errors.New("source is larger than the upload size limit")
+
+	// errPrivateAddress is reported when an import would connect to a loopback or private address.
+	errPrivateAddress = errors.New("connecting to private network addresses is not allowed")
+)
+
+// checksumHashes are the hash functions an import's checksum may use, by name.
+var checksumHashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// ImportSource describes where an import downloads its source file from.
+type ImportSource struct {
+	URL      string      // HTTP or HTTPS URL of the source file
+	Header   http.Header // Headers sent with every request for the file, e.g. Authorization
+	Checksum string      // Expected checksum as "<algorithm>:<hex>" (md5, sha1 or sha256), empty to skip the check
+}
+
+// ValidateImportSource checks that an import source can be downloaded: the URL must be an
+// absolute HTTP or HTTPS URL and the checksum, if any, must name a supported algorithm.
+func ValidateImportSource(source ImportSource) error {
+	u, err := url.Parse(source.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an absolute http or https URL")
+	}
+	if source.Checksum != "" {
+		if _, _, err := parseChecksum(source.Checksum); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseChecksum splits a checksum given as "<algorithm>:<hex>" into its hash function and sum.
+func parseChecksum(checksum string) (func() hash.Hash, string, error) {
+	algorithm, sum, _ := strings.Cut(checksum, ":")
+	newHash, ok := checksumHashes[strings.ToLower(algorithm)]
+	if !ok {
+		return nil, "", fmt.Errorf("checksum must be given as md5:<hex>, sha1:<hex> or sha256:<hex>")
+	}
+	sum = strings.ToLower(sum)
+	if decoded, err := hex.DecodeString(sum); err != nil || len(decoded) != newHash().Size() {
+		return nil, "", fmt.Errorf("checksum is not a valid %s sum", algorithm)
+	}
+	return newHash, sum, nil
+}
+
+// ImportURL returns the URL a video is recorded as imported from: the source URL without its
+// credentials, query and fragment, which may hold access tokens.
+func ImportURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path}).String()
+}
+
+// ImportFilename returns the file name an import is registered under when the client names
+// none: the last element of the URL path, or "" when the URL has none.
+func ImportFilename(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		return ""
+	}
+	return cleanFilename(name)
+}
+
+// Importer downloads source files from URLs into the upload path in the background and queues
+// them for transcoding like completed tus uploads. Downloads that are interrupted are resumed
+// with Range requests when the server supports them. Progress is reported on the status stream
+// as IS (started), IP (percent, when the size is known), IC (done) and IF (failed) events.
+type Importer struct {
+	uploadPath     string                   // Path imported source files are stored in
+	transcodedPath string                   // Path jobs write their output to
+	maxSize        int64                    // Largest source accepted in bytes, 0 for no limit
+	limits         *UploadLimits            // Ledger the size of running imports is reserved in against the quota
+	retries        int                      // Times an interrupted download is resumed
+	repos          *repository.Repositories // Catalog the imported videos are registered in
+	jobs           chan<- Job               // Queue the transcode jobs are sent to
+	client         *http.Client             // Client the sources are downloaded with
+
+	slots  chan struct{}      // Limits the number of downloads running at once
+	ctx    context.Context    // Context of running downloads, cancelled by Shutdown
+	cancel context.CancelFunc // Cancels ctx
+}
+
+// NewImporter creates an importer with the import settings of the configuration. Unless private
+// networks are allowed, it refuses to connect to loopback, private and link-local addresses,
+// whichever address a host name resolves to.
+func NewImporter(conf config.Config, repos *repository.Repositories, jobs chan<- Job, limits *UploadLimits) *Importer {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if !conf.ImportAllowPrivate {
+		dialer.Control = refusePrivateAddresses
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.Proxy = nil // A proxy would make the address check meaningless
+	transport.ResponseHeaderTimeout = time.Minute
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Importer{
+		uploadPath:     conf.UploadPath,
+		transcodedPath: conf.TranscodedFilePath,
+		maxSize:        int64(conf.UploadMaxSizeMB) * 1024 * 1024,
+		limits:         limits,
+		retries:        conf.ImportRetries,
+		repos:          repos,
+		jobs:           jobs,
+		client:         &http.Client{Transport: transport},
+		slots:          make(chan struct{}, conf.ImportConcurrency),
+		ctx:            ctx,
+		cancel:         cancel,
+	}
+}
+
+// refusePrivateAddresses is a net.Dialer Control function that refuses connections to
+// addresses that are not publicly routable.
+func refusePrivateAddresses(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return fmt.Errorf("%s: %w", host, errPrivateAddress)
+	}
+	return nil
+}
+
+// Reserve checks that an import of size bytes, which may be 0 when the size is not known yet,
+// keeps owner within the storage quota, and reserves the size for the import of the video with
+// the given ID until it finishes. An import over the quota is refused with errQuotaExceeded, the
+// tus error uploads over the quota are rejected with. A reservation whose import is not started
+// must be released with Release.
+func (i *Importer) Reserve(ctx context.Context, videoID string, owner string, size int64) error {
+	return i.limits.reserveImport(ctx, videoID, owner, size)
+}
+
+// Release ends the reservation of an import that is not going to be started.
+func (i *Importer) Release(videoID string) {
+	i.limits.release(videoID)
+}
+
+// checkDownloadQuota reserves the size of a source once it is known, checking it against the
+// quota of the video's owner. Failing to read the storage used is not permanent, so the
+// download is resumed.
+func (i *Importer) checkDownloadQuota(ctx context.Context, video repository.Video, size int64) error {
+	err := i.limits.reserveImport(ctx, video.ID, video.Owner, size)
+	if errors.Is(err, errQuotaExceeded) {
+		return permanentError{err}
+	}
+	return err
+}
+
+// Start downloads the source of a video registered with the importing status in the
+// background. Once the download is complete and verified, the video is queued for transcoding.
+// The reservation made with Reserve is held until the import finishes.
+func (i *Importer) Start(video repository.Video, source ImportSource) {
+	go i.run(video, source)
+}
+
+// Shutdown interrupts the running downloads; their videos are marked as failed.
+func (i *Importer) Shutdown() {
+	i.cancel()
+}
+
+// Recover marks the videos a previous run of the server left importing as failed, as their
+// downloads cannot be resumed without the request that started them, and deletes the partial
+// downloads.
+func (i *Importer) Recover(ctx context.Context) error {
+	videos, err := i.repos.Videos.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, video := range videos {
+		if video.Status != repository.VideoStatusImporting {
+			continue
+		}
+		slog.Warn("Failing import interrupted by a restart", logging.UploadIDKey, video.ID, "url", video.ImportURL)
+		os.Remove(filepath.Join(i.uploadPath, video.ID+".part"))
+		if err := i.repos.Videos.UpdateStatus(ctx, video.ID, repository.VideoStatusFailed, "import interrupted by a restart"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// run downloads the source of a video and queues its transcode job, reporting the outcome on
+// the video and the status stream.
+func (i *Importer) run(video repository.Video, source ImportSource) {
+	logger := slog.Default().With(logging.UploadIDKey, video.ID)
+	ctx := logging.WithLogger(i.ctx, logger)
+	// A stored source counts against the quota by the size recorded on the video from then on
+	defer i.limits.release(video.ID)
+
+	// Wait for a free download slot
+	select {
+	case i.slots <- struct{}{}:
+	case <-ctx.Done():
+		i.fail(video, logger, ctx.Err())
+		return
+	}
+	defer func() { <-i.slots }()
+
+	ctx, span := tracing.Start(ctx, "import.download", tracing.UploadID.String(video.ID))
+	logger.Info("Import started", "url", video.ImportURL)
+	SendStatusUpdateToClient(currClientChan, jobStatus("IS", video.ID, video.Filename, "OK"))
+
+	size, err := i.download(ctx, video, source)
+	if err == nil {
+		span.SetAttributes(tracing.FileSize.Int64(size))
+	}
+	tracing.End(span, err)
+	if err != nil {
+		i.fail(video, logger, err)
+		return
+	}
+	logger.Info("Import completed", "size", size)
+
+	// From here on the video is handled like a completed upload
+	if err := i.repos.Videos.SetSize(ctx, video.ID, size); err != nil {
+		logger.Error("Failed to record video size", "error", err)
+	}
+	if err := i.repos.Videos.UpdateStatus(ctx, video.ID, repository.VideoStatusQueued, ""); err != nil {
+		logger.Error("Failed to update video status", "error", err)
+	}
+	SendStatusUpdateToClient(currClientChan, jobStatus("IC", video.ID, video.Filename, "OK"))
+
+	err = EnqueueJob(context.WithoutCancel(ctx), i.repos, i.jobs, Job{
+		UploadPath:     i.uploadPath,
+		TranscodedPath: i.transcodedPath,
+		Filename:       video.ID,
+		Name:           video.Filename,
+		ClientChan:     currClientChan,
+	})
+	if err != nil {
+		logger.Error("Failed to queue transcode job", "error", err)
+	}
+}
+
+// fail records that the import of a video failed.
+func (i *Importer) fail(video repository.Video, logger *slog.Logger, err error) {
+	if i.ctx.Err() != nil {
+		err = errors.New("import interrupted by shutdown")
+	}
+	logger.Error("Import failed", "error", err)
+	if err := i.repos.Videos.UpdateStatus(context.Background(), video.ID, repository.VideoStatusFailed, err.Error()); err != nil {
+		logger.Error("Failed to update video status", "error", err)
+	}
+	SendStatusUpdateToClient(currClientChan, jobStatus("IF", video.ID, video.Filename, err.Error()))
+}
+
+// permanentError marks a download error that resuming the download cannot fix.
+type permanentError struct{ error }
+
+// Unwrap returns the underlying error.
+func (e permanentError) Unwrap() error { return e.error }
+
+// importDownload is the state of a download that survives resuming it.
+type importDownload struct {
+	file        *os.File  // Partial download
+	hash        hash.Hash // Hash of the bytes written so far, if a checksum is checked
+	written     int64     // Bytes written so far
+	total       int64     // Size of the source, -1 while unknown
+	validator   string    // ETag or Last-Modified of the source, sent as If-Range when resuming
+	resumable   bool      // Whether the server accepts byte range requests
+	lastPercent int       // Last progress percentage reported
+}
+
+// download fetches the source of a video into the upload path, resuming the download after
+// errors up to the configured number of retries. The result is checked against the size limit,
+// the owner's storage quota, the expected checksum and the container signatures of accepted
+// videos before it is moved to the name of the video. It returns the size of the source.
+func (i *Importer) download(ctx context.Context, video repository.Video, source ImportSource) (int64, error) {
+	var newHash func() hash.Hash
+	var expectedSum string
+	if source.Checksum != "" {
+		var err error
+		if newHash, expectedSum, err = parseChecksum(source.Checksum); err != nil {
+			return 0, err
+		}
+	}
+
+	partPath := filepath.Join(i.uploadPath, video.ID+".part")
+	file, err := os.Create(partPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create download file: %v", err)
+	}
+	defer func() {
+		file.Close()
+		os.Remove(partPath) // Only left behind when the download failed
+	}()
+
+	state := &importDownload{file: file, total: -1, lastPercent: -1}
+	if newHash != nil {
+		state.hash = newHash()
+	}
+
+	delay := importRetryDelay
+	for attempt := 0; ; attempt++ {
+		err := i.fetch(ctx, video, source, state)
+		if err == nil {
+			break
+		}
+		var permanent permanentError
+		if errors.As(err, &permanent) || ctx.Err() != nil || attempt >= i.retries {
+			return 0, err
+		}
+		logging.FromContext(ctx).Warn("Import download interrupted, resuming", "attempt", attempt+1, "received", state.written, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+
+	// Sources sent without their length are only checked against the quota once downloaded
+	if state.total < 0 {
+		if err := i.limits.reserveImport(ctx, video.ID, video.Owner, state.written); err != nil {
+			return 0, err
+		}
+	}
+
+	if state.hash != nil {
+		if sum := hex.EncodeToString(state.hash.Sum(nil)); sum != expectedSum {
+			return 0, fmt.Errorf("checksum mismatch: source has %s, expected %s", sum, expectedSum)
+		}
+	}
+
+	head := make([]byte, sniffLength)
+	n, err := file.ReadAt(head, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, fmt.Errorf("failed to read download: %v", err)
+	}
+	if !isVideoContainer(head[:n]) {
+		return 0, errNotVideo
+	}
+
+	if err := file.Close(); err != nil {
+		return 0, fmt.Errorf("failed to write download: %v", err)
+	}
+	if err := os.Rename(partPath, filepath.Join(i.uploadPath, video.ID)); err != nil {
+		return 0, fmt.Errorf("failed to store download: %v", err)
+	}
+	return state.written, nil
+}
+
+// fetch makes one request for the source, continuing where the previous one stopped when the
+// server supports it, and appends what it receives to the partial download.
+func (i *Importer) fetch(ctx context.Context, video repository.Video, source ImportSource, state *importDownload) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source.URL, nil)
+	if err != nil {
+		return permanentError{fmt.Errorf("invalid source URL: %v", err)}
+	}
+	for key, values := range source.Header {
+		req.Header[key] = values
+	}
+	if state.written > 0 && state.resumable {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", state.written))
+		if state.validator != "" {
+			req.Header.Set("If-Range", state.validator)
+		}
+	}
+
+	resp, err := i.client.Do(req)
+	if err != nil {
+		if errors.Is(err, errPrivateAddress) {
+			return permanentError{err}
+		}
+		return fmt.Errorf("failed to request source: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		// The whole file is sent, because it is the first request or the server cannot resume
+		if err := state.restart(); err != nil {
+			return permanentError{err}
+		}
+		state.total = resp.ContentLength
+		state.resumable = resp.Header.Get("Accept-Ranges") == "bytes"
+		state.validator = resp.Header.Get("ETag")
+		if state.validator == "" || strings.HasPrefix(state.validator, "W/") {
+			state.validator = resp.Header.Get("Last-Modified")
+		}
+	case resp.StatusCode == http.StatusPartialContent:
+		start, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if !ok || start != state.written {
+			// Start over without a range rather than splice in the wrong bytes
+			state.resumable = false
+			return fmt.Errorf("source answered with unexpected range %q", resp.Header.Get("Content-Range"))
+		}
+		state.total = total
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("source answered %s", resp.Status)
+	default:
+		return permanentError{fmt.Errorf("source answered %s", resp.Status)}
+	}
+
+	if i.maxSize > 0 && state.total > i.maxSize {
+		return permanentError{errImportTooLarge}
+	}
+	if state.total >= 0 && resp.StatusCode == http.StatusOK {
+		if err := i.checkDownloadQuota(ctx, video, state.total); err != nil {
+			return err
+		}
+	}
+
+	// Copy the body, reading one byte more than allowed to notice sources over the limit
+	var body io.Reader = resp.Body
+	if i.maxSize > 0 {
+		body = io.LimitReader(resp.Body, i.maxSize-state.written+1)
+	}
+	buf := make([]byte, 256*1024)
+	for {
+		n, readErr := body.Read(buf)
+		if n > 0 {
+			if _, err := state.file.Write(buf[:n]); err != nil {
+				return permanentError{fmt.Errorf("failed to write download: %v", err)}
+			}
+			if state.hash != nil {
+				state.hash.Write(buf[:n])
+			}
+			state.written += int64(n)
+			if i.maxSize > 0 && state.written > i.maxSize {
+				return permanentError{errImportTooLarge}
+			}
+			state.reportProgress(video)
+		}
+		if errors.Is(readErr, io.EOF) {
+			break
+		} else if readErr != nil {
+			return fmt.Errorf("failed to download source: %v", readErr)
+		}
+	}
+
+	if state.total >= 0 && state.written < state.total {
+		return fmt.Errorf("source closed the connection after %d of %d bytes", state.written, state.total)
+	}
+	return nil
+}
+
+// restart discards what was downloaded so far.
+func (d *importDownload) restart() error {
+	if d.written == 0 {
+		return nil
+	}
+	if err := d.file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to restart download: %v", err)
+	}
+	if _, err := d.file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to restart download: %v", err)
+	}
+	if d.hash != nil {
+		d.hash.Reset()
+	}
+	d.written = 0
+	return nil
+}
+
+// reportProgress sends an IP event for every five percent of the source downloaded, when its
+// size is known.
+func (d *importDownload) reportProgress(video repository.Video) {
+	if d.total <= 0 {
+		return
+	}
+	percent := int(d.written * 100 / d.total)
+	if percent/5 == d.lastPercent/5 || percent >= 100 {
+		return
+	}
+	d.lastPercent = percent
+	SendStatusUpdateToClient(currClientChan, jobStatus("IP", video.ID, video.Filename, strconv.Itoa(percent)))
+}
+
+// parseContentRange returns the first byte and the complete length given by a Content-Range
+// header such as "bytes 100-199/1000". The length is -1 when the server does not know it.
+func parseContentRange(header string) (start int64, total int64, ok bool) {
+	spec, found := strings.CutPrefix(header, "bytes ")
+	if !found {
+		return 0, 0, false
+	}
+	byteRange, length, found := strings.Cut(spec, "/")
+	if !found {
+		return 0, 0, false
+	}
+	first, _, found := strings.Cut(byteRange, "-")
+	if !found {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	if length == "*" {
+		return start, -1, true
+	}
+	total, err = strconv.ParseInt(length, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return start, total, true
+}
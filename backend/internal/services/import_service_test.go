@@ -0,0 +1,71 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"manhattan_tech_ventures/internal/config"
+	"manhattan_tech_ventures/internal/repository"
+)
+
+func TestImporterChecksQuotaOnceSizeIsKnown(t *testing.T) {
+	source := strings.Repeat("x", 200)
+	tests := []struct {
+		name   string
+		length bool // Whether the source is sent with its length
+	}{
+		{"with length", true},
+		{"without length", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if test.length {
+					w.Header().Set("Content-Length", "200")
+				}
+				w.Write([]byte(source))
+				w.(http.Flusher).Flush() // Without a length, the response is sent chunked
+			}))
+			defer server.Close()
+
+			clientChan := currentStatusClient(t)
+			conf := config.Default()
+			conf.UploadPath = t.TempDir()
+			conf.UploadQuotaMB = 1
+			conf.ImportAllowPrivate = true
+			conf.ImportRetries = 0
+			repos := repository.NewMemoryRepositories()
+			stored := &repository.Video{ID: "stored", Owner: "alice", Size: 1024*1024 - 100, Status: repository.VideoStatusReady}
+			imported := &repository.Video{ID: "imported", Filename: "talk.mp4", Owner: "alice", Status: repository.VideoStatusImporting}
+			for _, video := range []*repository.Video{stored, imported} {
+				if err := repos.Videos.Create(context.Background(), video); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// The request declared no size, so it passed the check before the download
+			importer := NewImporter(conf, repos, make(chan Job, 1), NewUploadLimits(conf, repos.Videos))
+			defer importer.Shutdown()
+			importer.Start(*imported, ImportSource{URL: server.URL + "/talk.mp4"})
+
+			nextEvent(t, clientChan, "IS-imported:", 5*time.Second)
+			event := nextEvent(t, clientChan, "IF-imported:", 5*time.Second)
+			if !strings.Contains(event, "ERR_QUOTA_EXCEEDED") {
+				t.Errorf("import failed with %q, want the quota error", event)
+			}
+			video, err := repos.Videos.Get(context.Background(), "imported")
+			if err != nil || video.Status != repository.VideoStatusFailed {
+				t.Errorf("imported video is %+v, %v; want it failed", video, err)
+			}
+			if _, err := os.Stat(filepath.Join(conf.UploadPath, "imported")); !os.IsNotExist(err) {
+				t.Errorf("source over the quota was kept: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,237 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"manhattan_tech_ventures/internal/logging"
+	"manhattan_tech_ventures/internal/repository"
+)
+
+// jobCancelPollInterval is how often the record of a running job is checked for a cancellation
+// requested from outside the server, e.g. with mtvctl.
+const jobCancelPollInterval = 5 * time.Second
+
+var (
+	// ErrJobState is reported when a job or video is not in a state the requested operation applies to.
+	ErrJobState = errors.New("not allowed in the current state")
+
+	// errJobCancelled is the cause of the context of a running job that was cancelled.
+	errJobCancelled = errors.New("job cancelled")
+)
+
+// queuedJobs holds the IDs of the jobs this process handed to the worker pool that have not
+// finished yet, so PollJobs does not queue them a second time.
+var queuedJobs = struct {
+	sync.Mutex
+	ids map[string]bool
+}{ids: make(map[string]bool)}
+
+// trackJob records that the job with the given ID was handed to the worker pool.
+func trackJob(id string) {
+	queuedJobs.Lock()
+	defer queuedJobs.Unlock()
+	queuedJobs.ids[id] = true
+}
+
+// untrackJob records that the job with the given ID has left the worker pool.
+func untrackJob(id string) {
+	queuedJobs.Lock()
+	defer queuedJobs.Unlock()
+	delete(queuedJobs.ids, id)
+}
+
+// isTracked reports whether the job with the given ID is in the worker pool.
+func isTracked(id string) bool {
+	queuedJobs.Lock()
+	defer queuedJobs.Unlock()
+	return queuedJobs.ids[id]
+}
+
+// jobFromRecord rebuilds the job of a job record, e.g. one recovered after a restart or queued
+// by another process.
+func jobFromRecord(ctx context.Context, repos *repository.Repositories, record repository.JobRecord, uploadPath string, transcodedPath string) Job {
+	// The upload name is kept on the video, not the job record
+	name := ""
+	if video, err := repos.Videos.Get(ctx, record.VideoID); err == nil {
+		name = video.Filename
+	}
+	return Job{
+		ID:             record.ID,
+		UploadPath:     uploadPath,
+		TranscodedPath: transcodedPath,
+		Filename:       record.VideoID,
+		Name:           name,
+		ClientChan:     currClientChan,
+		Clip:           record.Clip,
+		Concat:         record.Concat,
+	}
+}
+
+// PollJobs queues the jobs that were recorded as queued in the job repository by another
+// process, such as mtvctl retrying a job, every interval until ctx is cancelled. It must only
+// be started once RecoverJobs has returned, as it cannot tell the jobs RecoverJobs is still
+// about to queue from new ones.
+func PollJobs(ctx context.Context, repos *repository.Repositories, jobs chan<- Job, uploadPath string, transcodedPath string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		records, err := repos.Jobs.List(ctx, repository.JobStatusQueued)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("Failed to poll queued jobs", "error", err)
+			}
+			continue
+		}
+		for _, record := range records {
+			if isTracked(record.ID) || ctx.Err() != nil {
+				continue
+			}
+			slog.Info("Queueing job recorded by another process", logging.JobIDKey, record.ID, logging.UploadIDKey, record.VideoID)
+			queueJob(jobs, jobFromRecord(ctx, repos, record, uploadPath, transcodedPath))
+		}
+	}
+}
+
+// watchCancellation cancels a running job's context with errJobCancelled once its record is
+// marked as cancelled. It returns when ctx is done.
+func watchCancellation(ctx context.Context, repos *repository.Repositories, jobID string, cancel context.CancelCauseFunc) {
+	ticker := time.NewTicker(jobCancelPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if record, err := repos.Jobs.Get(ctx, jobID); err == nil && record.Status == repository.JobStatusCancelled {
+			cancel(errJobCancelled)
+			return
+		}
+	}
+}
+
+// activeJob returns the queued or running job of a video, or nil if it has none.
+func activeJob(ctx context.Context, repos *repository.Repositories, videoID string) (*repository.JobRecord, error) {
+	for _, status := range []string{repository.JobStatusQueued, repository.JobStatusRunning} {
+		records, err := repos.Jobs.List(ctx, status)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			if record.VideoID == videoID {
+				return &record, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// queueRecord records a new queued job for a video and marks the video as queued. A running
+// server picks the job up with PollJobs.
+func queueRecord(ctx context.Context, repos *repository.Repositories, record *repository.JobRecord) error {
+	id, err := repository.NewID()
+	if err != nil {
+		return err
+	}
+	record.ID = id
+	record.Status = repository.JobStatusQueued
+	if err := repos.Jobs.Create(ctx, record); err != nil {
+		return err
+	}
+	return repos.Videos.UpdateStatus(ctx, record.VideoID, repository.VideoStatusQueued, "")
+}
+
+// RetryJob queues a new job doing the same work as a failed or cancelled job and returns it.
+// The old record is kept as it is.
+func RetryJob(ctx context.Context, repos *repository.Repositories, id string) (*repository.JobRecord, error) {
+	record, err := repos.Jobs.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if record.Status != repository.JobStatusFailed && record.Status != repository.JobStatusCancelled {
+		return nil, fmt.Errorf("job %s is %s: %w", id, record.Status, ErrJobState)
+	}
+	if active, err := activeJob(ctx, repos, record.VideoID); err != nil {
+		return nil, err
+	} else if active != nil {
+		return nil, fmt.Errorf("video %s already has %s job %s: %w", record.VideoID, active.Status, active.ID, ErrJobState)
+	}
+
+	retry := &repository.JobRecord{VideoID: record.VideoID, Clip: record.Clip, Concat: record.Concat}
+	if err := queueRecord(ctx, repos, retry); err != nil {
+		return nil, err
+	}
+	return retry, nil
+}
+
+// CancelJob marks a queued or running job as cancelled and its video as failed. A worker
+// skips the job if it has not started it yet, and stops it within jobCancelPollInterval
+// otherwise.
+func CancelJob(ctx context.Context, repos *repository.Repositories, id string) error {
+	record, err := repos.Jobs.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if record.Status != repository.JobStatusQueued && record.Status != repository.JobStatusRunning {
+		return fmt.Errorf("job %s is %s: %w", id, record.Status, ErrJobState)
+	}
+	if err := repos.Jobs.MarkFinished(ctx, id, repository.JobStatusCancelled, "cancelled by an operator"); err != nil {
+		return err
+	}
+	return repos.Videos.UpdateStatus(ctx, record.VideoID, repository.VideoStatusFailed, errJobCancelled.Error())
+}
+
+// RetranscodeVideo queues a new job transcoding a video again from its source, replacing its
+// stored renditions, and returns it. Once the job succeeds, the files of the previous renditions
+// and the MP4 exports made from them are deleted. Clips and concatenations whose source was
+// deleted are cut or joined again from their parents, which must still have theirs.
+func RetranscodeVideo(ctx context.Context, repos *repository.Repositories, uploadPath string, videoID string) (*repository.JobRecord, error) {
+	video, err := repos.Videos.Get(ctx, videoID)
+	if err != nil {
+		return nil, err
+	}
+	switch video.Status {
+	case repository.VideoStatusImporting, repository.VideoStatusLive:
+		return nil, fmt.Errorf("video %s is %s: %w", videoID, video.Status, ErrJobState)
+	}
+	if active, err := activeJob(ctx, repos, videoID); err != nil {
+		return nil, err
+	} else if active != nil {
+		return nil, fmt.Errorf("video %s already has %s job %s: %w", videoID, active.Status, active.ID, ErrJobState)
+	}
+
+	record := &repository.JobRecord{VideoID: videoID}
+	if _, err := os.Stat(filepath.Join(uploadPath, videoID)); err != nil {
+		// Without a source only a derived video can be made again, the way it was made first
+		records, listErr := repos.Jobs.List(ctx, "")
+		if listErr != nil {
+			return nil, listErr
+		}
+		for _, previous := range records {
+			if previous.VideoID == videoID && (previous.Clip != nil || previous.Concat != nil) {
+				record.Clip, record.Concat = previous.Clip, previous.Concat
+			}
+		}
+		if record.Clip == nil && record.Concat == nil {
+			return nil, fmt.Errorf("source of video %s is not available: %v", videoID, err)
+		}
+	}
+
+	if err := queueRecord(ctx, repos, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
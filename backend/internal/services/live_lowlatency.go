@@ -0,0 +1,354 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// blockingPollInterval is how often a blocked playlist or part request checks whether the
+// output it waits for has been written.
+const blockingPollInterval = 50 * time.Millisecond
+
+// livePart is one partial segment of a Low-Latency HLS stream, as listed by ffmpeg.
+type livePart struct {
+	Name     string  // File name of the part in the rendition's segment directory
+	Duration float64 // Duration of the part in seconds
+}
+
+// partsPerSegment returns how many parts make up one full segment.
+func (l *LiveIngest) partsPerSegment() int {
+	return int(time.Duration(l.SegmentDuration) * time.Second / l.PartDuration)
+}
+
+// blockingTimeout is how long a blocking request is held before giving up, three target
+// durations as recommended by the LL-HLS specification.
+func (l *LiveIngest) blockingTimeout() time.Duration {
+	return 3 * time.Duration(l.SegmentDuration) * time.Second
+}
+
+// liveSegmentName returns the file name of a stream's segment with the given media sequence number.
+func liveSegmentName(rendition RenditionSpec, index int) string {
+	return fmt.Sprintf("%s_%03d.ts", rendition.Name, index)
+}
+
+// livePartName returns the file name ffmpeg gives the part with the given index.
+func livePartName(rendition RenditionSpec, index int) string {
+	return fmt.Sprintf("%s_part_%05d.ts", rendition.Name, index)
+}
+
+// parseFileIndex extracts the number from a file name of the form prefix + number + suffix.
+func parseFileIndex(name string, prefix string, suffix string) (int, bool) {
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+		return 0, false
+	}
+	index, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, prefix), suffix))
+	if err != nil || index < 0 {
+		return 0, false
+	}
+	return index, true
+}
+
+// readParts reads the parts ffmpeg has finished so far for one rendition of a stream from the
+// playlist it writes for them, and whether the stream has ended.
+func (l *LiveIngest) readParts(rendition RenditionSpec, streamID string) (parts []livePart, ended bool, err error) {
+	data, err := os.ReadFile(filepath.Join(RenditionPlaylistDir(l.OutputPath, rendition, streamID), rendition.Name+"_parts.m3u8"))
+	if err != nil {
+		return nil, false, err
+	}
+
+	var duration float64
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "#EXTINF:"):
+			value, _, _ := strings.Cut(strings.TrimPrefix(line, "#EXTINF:"), ",")
+			duration, _ = strconv.ParseFloat(value, 64)
+		case line == "#EXT-X-ENDLIST":
+			ended = true
+		case line != "" && !strings.HasPrefix(line, "#"):
+			// Part URIs carry the segment directory as base URL; only the file name matters here
+			parts = append(parts, livePart{Name: line[strings.LastIndexAny(line, `/\`)+1:], Duration: duration})
+		}
+	}
+	return parts, ended, nil
+}
+
+// lowLatencyPlaylist builds the LL-HLS media playlist of one rendition of a stream from its
+// parts. Every partsPerSegment parts form a segment, which is served by joining the parts (see
+// serveLowLatencySegment). The most recent segments also list their parts, followed by the
+// parts of the segment in progress and a preload hint for the next part.
+func (l *LiveIngest) lowLatencyPlaylist(rendition RenditionSpec, streamID string, parts []livePart, ended bool) string {
+	baseURI := RenditionSegmentDir(l.OutputPath, rendition, streamID) + "\\"
+	perSegment := l.partsPerSegment()
+
+	segments := len(parts) / perSegment
+	if ended && len(parts)%perSegment != 0 {
+		segments++ // The last segment of an ended stream may be short
+	}
+	segmentParts := func(index int) []livePart {
+		return parts[index*perSegment : min((index+1)*perSegment, len(parts))]
+	}
+
+	first := 0
+	if l.DVRSegments > 0 && segments > l.DVRSegments {
+		first = segments - l.DVRSegments
+	}
+
+	targetDuration := l.SegmentDuration
+	durations := make([]float64, segments)
+	for index := first; index < segments; index++ {
+		for _, part := range segmentParts(index) {
+			durations[index] += part.Duration
+		}
+		targetDuration = max(targetDuration, int(math.Round(durations[index])))
+	}
+
+	partTarget := l.PartDuration.Seconds()
+	var playlist strings.Builder
+	writeParts := func(parts []livePart, firstIndex int) {
+		for i, part := range parts {
+			fmt.Fprintf(&playlist, "#EXT-X-PART:DURATION=%.3f,URI=\"%s\"", part.Duration, baseURI+part.Name)
+			if (firstIndex+i)%perSegment == 0 {
+				playlist.WriteString(",INDEPENDENT=YES") // Segments, and so their first parts, start on a keyframe
+			}
+			playlist.WriteString("\n")
+		}
+	}
+
+	playlist.WriteString("#EXTM3U\n#EXT-X-VERSION:6\n")
+	fmt.Fprintf(&playlist, "#EXT-X-TARGETDURATION:%d\n", targetDuration)
+	if !ended {
+		fmt.Fprintf(&playlist, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", 3*partTarget)
+	}
+	fmt.Fprintf(&playlist, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", partTarget)
+	fmt.Fprintf(&playlist, "#EXT-X-MEDIA-SEQUENCE:%d\n", first)
+
+	for index := first; index < segments; index++ {
+		// Parts only need to be listed for the last few segments
+		if !ended && index >= segments-3 {
+			writeParts(segmentParts(index), index*perSegment)
+		}
+		fmt.Fprintf(&playlist, "#EXTINF:%.3f,\n%s\n", durations[index], baseURI+liveSegmentName(rendition, index))
+	}
+
+	if ended {
+		playlist.WriteString("#EXT-X-ENDLIST\n")
+	} else {
+		writeParts(parts[segments*perSegment:], segments*perSegment)
+		fmt.Fprintf(&playlist, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%s\"\n", baseURI+livePartName(rendition, len(parts)))
+	}
+	return playlist.String()
+}
+
+// parseBlockingReload reads the _HLS_msn and _HLS_part parameters of a blocking playlist
+// reload. It reports false when the request does not ask to block; part is -1 when only a
+// media sequence number is given.
+func parseBlockingReload(query url.Values) (msn int, part int, blocking bool, err error) {
+	msnParam, partParam := query.Get("_HLS_msn"), query.Get("_HLS_part")
+	if msnParam == "" {
+		if partParam != "" {
+			return 0, 0, false, fmt.Errorf("_HLS_part requires _HLS_msn")
+		}
+		return 0, 0, false, nil
+	}
+
+	msn, err = strconv.Atoi(msnParam)
+	if err != nil || msn < 0 {
+		return 0, 0, false, fmt.Errorf("invalid _HLS_msn %q", msnParam)
+	}
+	part = -1
+	if partParam != "" {
+		part, err = strconv.Atoi(partParam)
+		if err != nil || part < 0 {
+			return 0, 0, false, fmt.Errorf("invalid _HLS_part %q", partParam)
+		}
+	}
+	return msn, part, true, nil
+}
+
+// serveLowLatencyPlaylist serves the LL-HLS playlist of one rendition of a stream. A blocking
+// reload is held until the requested segment, or part of it, has been written, the stream ends,
+// or the blocking timeout passes. Once the stream has been archived, its finished playlist is
+// served as it is.
+func (l *LiveIngest) serveLowLatencyPlaylist(w http.ResponseWriter, r *http.Request, rendition RenditionSpec, streamID string) {
+	finished := playlistPath(l.OutputPath, rendition, streamID)
+	if _, err := os.Stat(finished); err == nil {
+		l.serveFile(w, r, finished)
+		return
+	}
+
+	msn, part, blocking, err := parseBlockingReload(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	perSegment := l.partsPerSegment()
+	deadline := time.Now().Add(l.blockingTimeout())
+	for {
+		parts, ended, err := l.readParts(rendition, streamID)
+		if err != nil && !os.IsNotExist(err) {
+			http.Error(w, "Failed to read playlist", http.StatusInternalServerError)
+			return
+		}
+		if err != nil && !blocking {
+			// ffmpeg writes the playlist with the first part
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+
+		// Without _HLS_part the whole segment must be there; part indexes past the end of the
+		// segment refer to the parts of the following segments
+		ready := ended || (part < 0 && len(parts) >= (msn+1)*perSegment) || (part >= 0 && len(parts) > msn*perSegment+part)
+		if !blocking || ready {
+			w.Header().Set("Content-Type", "application/text")
+			w.Header().Set("Cache-Control", "no-cache")
+			io.WriteString(w, l.lowLatencyPlaylist(rendition, streamID, parts, ended))
+			return
+		}
+
+		// Requests too far ahead of the live edge are rejected rather than held
+		if msn > len(parts)/perSegment+2 {
+			http.Error(w, "Requested segment is too far in the future", http.StatusBadRequest)
+			return
+		}
+		if time.Now().After(deadline) {
+			http.Error(w, "Requested segment is not available", http.StatusServiceUnavailable)
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(blockingPollInterval):
+		}
+	}
+}
+
+// serveLowLatencySegment serves a part or a segment of an LL-HLS stream. A request for a part
+// that is not written yet, such as the one in the preload hint, is held until the part is
+// complete. Segments are not written by ffmpeg; they are served by joining their parts.
+func (l *LiveIngest) serveLowLatencySegment(w http.ResponseWriter, r *http.Request, rendition RenditionSpec, streamID string, filename string) {
+	path := filepath.Join(RenditionSegmentDir(l.OutputPath, rendition, streamID), filename)
+	if _, err := os.Stat(path); err == nil {
+		l.serveFile(w, r, path)
+		return
+	}
+
+	if _, ok := parseFileIndex(filename, rendition.Name+"_part_", ".ts"); ok {
+		deadline := time.Now().Add(l.blockingTimeout())
+		for {
+			if _, err := os.Stat(path); err == nil {
+				l.serveFile(w, r, path)
+				return
+			}
+			if stream, _ := l.Lookup(streamID); !stream.Live || time.Now().After(deadline) {
+				http.Error(w, "File not found", http.StatusNotFound)
+				return
+			}
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(blockingPollInterval):
+			}
+		}
+	}
+
+	index, ok := parseFileIndex(filename, rendition.Name+"_", ".ts")
+	if !ok {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	parts, ended, err := l.readParts(rendition, streamID)
+	perSegment := l.partsPerSegment()
+	if err != nil || index*perSegment >= len(parts) || (!ended && len(parts) < (index+1)*perSegment) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	var segment bytes.Buffer
+	for _, part := range parts[index*perSegment : min((index+1)*perSegment, len(parts))] {
+		if err := appendFile(&segment, filepath.Join(filepath.Dir(path), part.Name)); err != nil {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "video/vnd.dlna.mpeg-tts")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(segment.Bytes()))
+}
+
+// appendFile copies the contents of the file at path to w.
+func appendFile(w io.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// mergeParts joins the parts of an ended LL-HLS stream into the segments its playlists listed
+// and writes a regular VOD playlist for them, so the archive looks like any other VOD output.
+// The parts and their playlist are removed afterwards.
+func (l *LiveIngest) mergeParts(rendition RenditionSpec, streamID string) error {
+	parts, _, err := l.readParts(rendition, streamID)
+	if os.IsNotExist(err) {
+		if _, statErr := os.Stat(playlistPath(l.OutputPath, rendition, streamID)); statErr == nil {
+			return nil // Merged by an earlier archive attempt
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s parts: %v", rendition.Name, err)
+	}
+
+	segmentDir := RenditionSegmentDir(l.OutputPath, rendition, streamID)
+	perSegment := l.partsPerSegment()
+
+	var segments strings.Builder
+	targetDuration := l.SegmentDuration
+	for index := 0; index*perSegment < len(parts); index++ {
+		segmentPath := filepath.Join(segmentDir, liveSegmentName(rendition, index))
+		segment, err := os.Create(segmentPath)
+		if err != nil {
+			return fmt.Errorf("failed to create segment: %v", err)
+		}
+
+		var duration float64
+		for _, part := range parts[index*perSegment : min((index+1)*perSegment, len(parts))] {
+			if err := appendFile(segment, filepath.Join(segmentDir, part.Name)); err != nil {
+				segment.Close()
+				return fmt.Errorf("failed to merge part %s: %v", part.Name, err)
+			}
+			duration += part.Duration
+		}
+		if err := segment.Close(); err != nil {
+			return fmt.Errorf("failed to write segment: %v", err)
+		}
+
+		targetDuration = max(targetDuration, int(math.Ceil(duration)))
+		fmt.Fprintf(&segments, "#EXTINF:%.3f,\n%s\n", duration, segmentDir+"\\"+liveSegmentName(rendition, index))
+	}
+
+	playlist := fmt.Sprintf("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-INDEPENDENT-SEGMENTS\n%s#EXT-X-ENDLIST\n",
+		targetDuration, segments.String())
+	if err := writePlaylist(playlistPath(l.OutputPath, rendition, streamID), playlist); err != nil {
+		return err
+	}
+
+	for _, part := range parts {
+		os.Remove(filepath.Join(segmentDir, part.Name))
+	}
+	os.Remove(filepath.Join(RenditionPlaylistDir(l.OutputPath, rendition, streamID), rendition.Name+"_parts.m3u8"))
+	return nil
+}
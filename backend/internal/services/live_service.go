@@ -0,0 +1,589 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"manhattan_tech_ventures/internal/logging"
+	"manhattan_tech_ventures/internal/metrics"
+	"manhattan_tech_ventures/internal/repository"
+	"manhattan_tech_ventures/internal/tracing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// liveRetryDelay is how long the ingest waits before listening again after ffmpeg failed
+// without a publisher ever connecting, e.g. because the port is taken.
+const liveRetryDelay = 5 * time.Second
+
+// liveStopTimeout is how long ffmpeg gets to finish its playlists after being interrupted
+// before it is killed.
+const liveStopTimeout = 5 * time.Second
+
+// LiveStream describes a stream pushed to the live ingest.
+type LiveStream struct {
+	ID        string    // Stream ID, also the ID of the stream's video record
+	StartedAt time.Time // Time the publisher connected
+	Live      bool      // Whether the publisher is still connected
+}
+
+// LiveIngest accepts RTMP or SRT pushes and transcodes them in real time to HLS playlists in
+// the transcode path, using the same layout as VOD output. ffmpeg acts as the RTMP/SRT server,
+// so one publisher can push at a time; every push becomes a new stream with its own ID and
+// video record.
+//
+// Every segment of a stream is kept on disk while it is live, and viewers get a DVR window of
+// the most recent segments. When the stream ends its playlists are finished and archived to the
+// media repository, turning the stream into a regular VOD asset. Optionally, a recording of the
+// pushed stream is re-transcoded to the full VOD ladder as a video derived from the stream.
+type LiveIngest struct {
+	ListenURL       string                   // URL ffmpeg listens on, e.g. "rtmp://0.0.0.0:1935/live"
+	OutputPath      string                   // Base directory for the HLS output (the configured transcode path)
+	UploadPath      string                   // Directory recordings of pushed streams are written to (the configured upload path)
+	Renditions      []RenditionSpec          // Qualities every live stream is transcoded to
+	SegmentDuration int                      // Target segment duration in seconds
+	DVRSegments     int                      // Number of segments viewers can seek back through, 0 for the whole stream
+	PartDuration    time.Duration            // Duration of Low-Latency HLS partial segments, 0 for regular live HLS
+	Retranscode     bool                     // Whether ended streams are re-transcoded to the VOD ladder
+	Jobs            chan<- Job               // Queue re-transcode jobs are sent to
+	Repos           *repository.Repositories // Repositories streams are registered and archived in
+
+	mu       sync.Mutex
+	streams  map[string]*LiveStream
+	archives sync.WaitGroup // Archives still being stored
+}
+
+// LiveListenURL builds the URL ffmpeg listens on for the given protocol ("rtmp" or "srt") and port.
+func LiveListenURL(protocol string, port int) string {
+	if protocol == "srt" {
+		return fmt.Sprintf("srt://0.0.0.0:%d?mode=listener", port)
+	}
+	return fmt.Sprintf("rtmp://0.0.0.0:%d/live", port)
+}
+
+// Run listens for publishers until ctx is cancelled, handling one push after the other.
+// Cancelling ctx ends the current stream cleanly, so its playlists are finished; Run returns
+// once the archives of all ended streams are stored. Streams that ended without being archived,
+// e.g. because the server stopped first, are archived when Run starts.
+func (l *LiveIngest) Run(ctx context.Context) {
+	defer l.archives.Wait()
+	l.recoverArchives(ctx)
+
+	slog.Info("Live ingest listening", "url", l.ListenURL)
+
+	for ctx.Err() == nil {
+		started, err := l.session(ctx)
+		if err != nil && !started && ctx.Err() == nil {
+			slog.Error("Live ingest failed, retrying", "error", err, "retry_in", liveRetryDelay.String())
+			select {
+			case <-ctx.Done():
+			case <-time.After(liveRetryDelay):
+			}
+		}
+	}
+}
+
+// Lookup returns the live stream with the given ID, if the ingest has seen it since the server started.
+func (l *LiveIngest) Lookup(streamID string) (LiveStream, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	stream, ok := l.streams[streamID]
+	if !ok {
+		return LiveStream{}, false
+	}
+	return *stream, true
+}
+
+// ServePlaylist serves a live stream's playlist for the given quality from local disk. It
+// reports false, without writing a response, when the stream or the quality is unknown, so
+// the caller can look the playlist up in the media repository instead.
+func (l *LiveIngest) ServePlaylist(w http.ResponseWriter, r *http.Request, streamID string, quality string) bool {
+	rendition, ok := l.rendition(streamID, quality)
+	if !ok {
+		return false
+	}
+
+	if l.PartDuration > 0 {
+		l.serveLowLatencyPlaylist(w, r, rendition, streamID)
+	} else {
+		l.serveFile(w, r, playlistPath(l.OutputPath, rendition, streamID))
+	}
+	return true
+}
+
+// ServeSegment serves one of a live stream's segments for the given quality from local disk.
+// It reports false, without writing a response, when the stream or the quality is unknown or
+// the filename is not a plain file name.
+func (l *LiveIngest) ServeSegment(w http.ResponseWriter, r *http.Request, streamID string, quality string, filename string) bool {
+	rendition, ok := l.rendition(streamID, quality)
+	if !ok || filename != filepath.Base(filename) || strings.HasPrefix(filename, ".") {
+		return false
+	}
+
+	if l.PartDuration > 0 {
+		l.serveLowLatencySegment(w, r, rendition, streamID, filename)
+	} else {
+		l.serveFile(w, r, filepath.Join(RenditionSegmentDir(l.OutputPath, rendition, streamID), filename))
+	}
+	return true
+}
+
+// playlistPath returns the local path of the playlist of one rendition of a stream.
+func playlistPath(outputPath string, rendition RenditionSpec, streamID string) string {
+	return filepath.Join(RenditionPlaylistDir(outputPath, rendition, streamID), rendition.Name+".m3u8")
+}
+
+// rendition looks up a rendition of a known live stream.
+func (l *LiveIngest) rendition(streamID string, quality string) (RenditionSpec, bool) {
+	if _, ok := l.Lookup(streamID); !ok {
+		return RenditionSpec{}, false
+	}
+	for _, rendition := range l.Renditions {
+		if rendition.Name == quality {
+			return rendition, true
+		}
+	}
+	return RenditionSpec{}, false
+}
+
+// session waits for one publisher and transcodes its stream until it disconnects. It reports
+// whether a publisher connected, so failures to listen can be told apart from failed streams.
+func (l *LiveIngest) session(ctx context.Context) (started bool, err error) {
+	streamID, err := repository.NewID()
+	if err != nil {
+		return false, err
+	}
+	logger := slog.Default().With(logging.UploadIDKey, streamID)
+
+	args, err := l.ffmpegArgs(streamID)
+	if err != nil {
+		return false, err
+	}
+
+	// Interrupt rather than kill ffmpeg on shutdown, so it writes the end of the playlists
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	cmd.WaitDelay = liveStopTimeout
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return false, fmt.Errorf("failed to read ffmpeg progress: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		l.removeOutput(streamID)
+		os.Remove(filepath.Join(l.UploadPath, streamID))
+		return false, fmt.Errorf("failed to start ffmpeg: %v", err)
+	}
+
+	// ffmpeg only reports progress once a publisher is connected and output is being written
+	var span trace.Span
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		if !started {
+			started = true
+			_, span = tracing.Start(ctx, "live.session", tracing.UploadID.String(streamID))
+			l.startStream(ctx, streamID, logger)
+		}
+	}
+
+	waitErr := cmd.Wait()
+	if !started {
+		l.removeOutput(streamID)
+		os.Remove(filepath.Join(l.UploadPath, streamID))
+		if waitErr != nil {
+			return false, fmt.Errorf("ffmpeg failed: %v: %s", waitErr, strings.TrimSpace(stderr.String()))
+		}
+		return false, nil
+	}
+
+	// A publisher disconnecting and a shutdown both end the stream normally
+	if waitErr != nil && ctx.Err() == nil {
+		err = fmt.Errorf("live transcode failed: %v: %s", waitErr, strings.TrimSpace(stderr.String()))
+	}
+	tracing.End(span, err)
+	l.endStream(streamID, logger, err)
+	return true, err
+}
+
+// ffmpegArgs builds the ffmpeg command line that listens for a publisher and writes one
+// HLS event playlist per rendition, listing every segment of the stream; the DVR window is
+// applied when the playlists are served. Keyframes are forced on segment boundaries so every
+// segment starts with one. For Low-Latency HLS, ffmpeg cuts the stream into parts instead,
+// which are grouped into segments when they are served (see serveLowLatencyPlaylist). When
+// ended streams are re-transcoded, the pushed stream is also recorded unchanged to the upload
+// path, as the source of the re-transcode.
+func (l *LiveIngest) ffmpegArgs(streamID string) ([]string, error) {
+	args := []string{"-v", "error", "-nostats", "-progress", "pipe:1"}
+	if strings.HasPrefix(l.ListenURL, "rtmp://") {
+		args = append(args, "-listen", "1")
+	}
+	args = append(args, "-i", l.ListenURL)
+
+	segmentDuration := strconv.Itoa(l.SegmentDuration)
+	for _, rendition := range l.Renditions {
+		playlistDir, segmentDir, err := prepareRenditionDirs(l.OutputPath, rendition, streamID)
+		if err != nil {
+			return nil, err
+		}
+
+		args = append(args,
+			"-map", "0:v:0", "-map", "0:a:0?",
+			"-vf", fmt.Sprintf("scale=-2:%d", rendition.Height),
+			"-c:v", "libx264", "-preset", "veryfast", "-tune", "zerolatency",
+			"-sc_threshold", "0",
+			"-force_key_frames", "expr:gte(t,n_forced*"+segmentDuration+")",
+			"-c:a", "aac", "-ar", "48000",
+			"-f", "hls",
+			"-hls_list_size", "0",
+			"-hls_playlist_type", "event",
+			"-hls_base_url", segmentDir+"\\")
+
+		if l.PartDuration > 0 {
+			// Parts are cut on time rather than on keyframes and only appear once complete
+			args = append(args,
+				"-hls_time", strconv.FormatFloat(l.PartDuration.Seconds(), 'f', -1, 64),
+				"-hls_flags", "split_by_time+temp_file",
+				"-hls_segment_filename", filepath.Join(segmentDir, rendition.Name+"_part_%05d.ts"),
+				filepath.Join(playlistDir, rendition.Name+"_parts.m3u8"))
+		} else {
+			args = append(args,
+				"-hls_time", segmentDuration,
+				"-hls_flags", "independent_segments",
+				"-hls_segment_filename", filepath.Join(segmentDir, rendition.Name+"_%03d.ts"),
+				playlistPath(l.OutputPath, rendition, streamID))
+		}
+	}
+
+	if l.Retranscode {
+		args = append(args,
+			"-map", "0:v:0", "-map", "0:a:0?",
+			"-c", "copy",
+			"-f", "mpegts",
+			filepath.Join(l.UploadPath, streamID))
+	}
+	return args, nil
+}
+
+// startStream registers a stream whose publisher just connected and announces it.
+func (l *LiveIngest) startStream(ctx context.Context, streamID string, logger *slog.Logger) {
+	l.mu.Lock()
+	if l.streams == nil {
+		l.streams = make(map[string]*LiveStream)
+	}
+	l.streams[streamID] = &LiveStream{ID: streamID, StartedAt: time.Now().UTC(), Live: true}
+	l.mu.Unlock()
+	metrics.LiveStreams.Inc()
+
+	video := &repository.Video{ID: streamID, Filename: streamID, Status: repository.VideoStatusLive}
+	if err := l.Repos.Videos.Create(ctx, video); err != nil {
+		logger.Error("Failed to register live stream", "error", err)
+	}
+
+	logger.Info("Live stream started")
+	SendStatusUpdateToClient(GetCurrClientChan(), fmt.Sprintf("LS-%s:OK", streamID))
+}
+
+// endStream marks a stream as no longer live, announces its end and starts archiving it.
+// The stream stays available from local disk until its archive is stored.
+func (l *LiveIngest) endStream(streamID string, logger *slog.Logger, streamErr error) {
+	l.mu.Lock()
+	l.streams[streamID].Live = false
+	l.mu.Unlock()
+	metrics.LiveStreams.Dec()
+
+	errMsg, message := "", "OK"
+	if streamErr != nil {
+		errMsg, message = streamErr.Error(), streamErr.Error()
+		logger.Error("Live stream failed", "error", streamErr)
+	} else {
+		logger.Info("Live stream ended")
+	}
+	if err := l.Repos.Videos.UpdateStatus(context.Background(), streamID, repository.VideoStatusEnded, errMsg); err != nil {
+		logger.Error("Failed to update live stream status", "error", err)
+	}
+	SendStatusUpdateToClient(GetCurrClientChan(), fmt.Sprintf("LE-%s:%s", streamID, message))
+
+	l.archives.Add(1)
+	go func() {
+		defer l.archives.Done()
+		l.archive(streamID, logger)
+	}()
+}
+
+// recoverArchives archives the streams that ended before the server stopped but whose archive
+// was never stored. Their output is served from local disk again until it is.
+func (l *LiveIngest) recoverArchives(ctx context.Context) {
+	videos, err := l.Repos.Videos.List(ctx)
+	if err != nil {
+		slog.Error("Failed to look up unarchived live streams", "error", err)
+		return
+	}
+
+	for _, video := range videos {
+		if video.Status != repository.VideoStatusEnded || len(l.Renditions) == 0 {
+			continue
+		}
+		if _, err := os.Stat(RenditionPlaylistDir(l.OutputPath, l.Renditions[0], video.ID)); err != nil {
+			continue
+		}
+
+		l.mu.Lock()
+		if l.streams == nil {
+			l.streams = make(map[string]*LiveStream)
+		}
+		l.streams[video.ID] = &LiveStream{ID: video.ID, StartedAt: video.CreatedAt}
+		l.mu.Unlock()
+
+		logger := slog.Default().With(logging.UploadIDKey, video.ID)
+		logger.Info("Archiving live stream left over from a previous run")
+		l.archives.Add(1)
+		go func(streamID string) {
+			defer l.archives.Done()
+			l.archive(streamID, logger)
+		}(video.ID)
+	}
+}
+
+// archive turns an ended stream into a VOD asset: its playlists are finished, stored in the
+// media repository together with its segments, and the local output is removed. The outcome
+// is announced on the status stream as "LA-<id>". When ended streams are re-transcoded, the
+// re-transcode job is queued afterwards.
+func (l *LiveIngest) archive(streamID string, logger *slog.Logger) {
+	ctx := logging.WithLogger(context.Background(), logger)
+
+	if err := l.storeArchive(ctx, streamID); err != nil {
+		logger.Error("Failed to archive live stream", "error", err)
+		if err := l.Repos.Videos.UpdateStatus(ctx, streamID, repository.VideoStatusFailed, err.Error()); err != nil {
+			logger.Error("Failed to update live stream status", "error", err)
+		}
+		SendStatusUpdateToClient(GetCurrClientChan(), fmt.Sprintf("LA-%s:%s", streamID, err.Error()))
+		return
+	}
+
+	// From now on the stream is served from the media repository like any other video
+	l.mu.Lock()
+	delete(l.streams, streamID)
+	l.mu.Unlock()
+	l.removeOutput(streamID)
+
+	if err := l.Repos.Videos.UpdateStatus(ctx, streamID, repository.VideoStatusReady, ""); err != nil {
+		logger.Error("Failed to update live stream status", "error", err)
+	}
+	logger.Info("Live stream archived")
+	SendStatusUpdateToClient(GetCurrClientChan(), fmt.Sprintf("LA-%s:OK", streamID))
+
+	if l.Retranscode {
+		if err := l.retranscode(ctx, streamID); err != nil {
+			logger.Error("Failed to queue live stream re-transcode", "error", err)
+		}
+	}
+}
+
+// storeArchive finishes the playlists of an ended stream and stores them and their segments
+// in the media repository under the same names as VOD output.
+func (l *LiveIngest) storeArchive(ctx context.Context, streamID string) (err error) {
+	ctx, span := tracing.Start(ctx, "live.archive", tracing.UploadID.String(streamID))
+	defer func() { tracing.End(span, err) }()
+
+	var files []string
+	for _, rendition := range l.Renditions {
+		if l.PartDuration > 0 {
+			if err := l.mergeParts(rendition, streamID); err != nil {
+				return err
+			}
+		}
+		if err := finishPlaylist(playlistPath(l.OutputPath, rendition, streamID)); err != nil {
+			return err
+		}
+		if err := WriteIFramePlaylist(ctx, l.OutputPath, rendition, streamID); err != nil {
+			logging.FromContext(ctx).Warn("Failed to write I-frame playlist", "rendition", rendition.Name, "error", err)
+		}
+
+		renditionFiles, err := listOutputFiles(filepath.Join(l.OutputPath, rendition.Name, streamID))
+		if err != nil {
+			return fmt.Errorf("failed to list %s output: %v", rendition.Name, err)
+		}
+		files = append(files, renditionFiles...)
+	}
+	span.SetAttributes(tracing.FileCount.Int(len(files)))
+
+	for _, file := range files {
+		if err := UploadMediaFile(ctx, l.Repos.Media, file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retranscode queues a job transcoding the recording of an ended stream to the VOD ladder. The
+// result is a new video derived from the stream, so the archive stays playable meanwhile.
+func (l *LiveIngest) retranscode(ctx context.Context, streamID string) error {
+	recording := filepath.Join(l.UploadPath, streamID)
+	if _, err := os.Stat(recording); err != nil {
+		return fmt.Errorf("no recording of the stream: %v", err)
+	}
+
+	videoID, err := repository.NewID()
+	if err != nil {
+		return err
+	}
+	// Jobs read their source from the upload path under the video's ID
+	if err := os.Link(recording, filepath.Join(l.UploadPath, videoID)); err != nil {
+		return fmt.Errorf("failed to link recording: %v", err)
+	}
+
+	video := &repository.Video{
+		ID:       videoID,
+		Filename: videoID,
+		Status:   repository.VideoStatusQueued,
+		ParentID: streamID,
+	}
+	if err := l.Repos.Videos.Create(ctx, video); err != nil {
+		return err
+	}
+
+	return EnqueueJob(ctx, l.Repos, l.Jobs, Job{
+		UploadPath:     l.UploadPath,
+		TranscodedPath: l.OutputPath,
+		Filename:       videoID,
+		ClientChan:     GetCurrClientChan(),
+	})
+}
+
+// finishPlaylist turns the event playlist of an ended stream into a VOD playlist. ffmpeg ends
+// the playlist itself when the publisher disconnects, but not when it is killed.
+func finishPlaylist(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read playlist: %v", err)
+	}
+
+	playlist := strings.Replace(string(data), "#EXT-X-PLAYLIST-TYPE:EVENT", "#EXT-X-PLAYLIST-TYPE:VOD", 1)
+	if !strings.Contains(playlist, "#EXT-X-ENDLIST") {
+		playlist = strings.TrimRight(playlist, "\n") + "\n#EXT-X-ENDLIST\n"
+	}
+
+	return writePlaylist(path, playlist)
+}
+
+// writePlaylist writes a playlist to a copy and renames it into place, so it is never served half written.
+func writePlaylist(path string, playlist string) error {
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(playlist), 0o644); err != nil {
+		return fmt.Errorf("failed to write playlist: %v", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to write playlist: %v", err)
+	}
+	return nil
+}
+
+// dvrWindow trims a live event playlist to its last segments segments, advancing the media
+// sequence accordingly. Ended playlists, and playlists that fit the window, are returned as they are.
+func dvrWindow(playlist []byte, segments int) []byte {
+	text := string(playlist)
+	if segments <= 0 || strings.Contains(text, "#EXT-X-ENDLIST") {
+		return playlist
+	}
+
+	// Split the playlist into its header and one group of lines per segment
+	var header []string
+	var groups [][]string
+	var current []string
+	inSegments := false
+	for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		if strings.HasPrefix(line, "#EXTINF:") {
+			inSegments = true
+		}
+		if !inSegments {
+			header = append(header, line)
+			continue
+		}
+		current = append(current, line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			groups = append(groups, current)
+			current = nil
+		}
+	}
+	if len(groups) <= segments {
+		return playlist
+	}
+	dropped := len(groups) - segments
+
+	// A playlist that drops segments is no longer an event playlist
+	var out strings.Builder
+	for _, line := range header {
+		if value, found := strings.CutPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"); found {
+			sequence, _ := strconv.Atoi(value)
+			line = "#EXT-X-MEDIA-SEQUENCE:" + strconv.Itoa(sequence+dropped)
+		}
+		if line == "#EXT-X-PLAYLIST-TYPE:EVENT" {
+			continue
+		}
+		out.WriteString(line + "\n")
+	}
+	for _, group := range groups[dropped:] {
+		for _, line := range group {
+			out.WriteString(line + "\n")
+		}
+	}
+	for _, line := range current {
+		out.WriteString(line + "\n")
+	}
+	return []byte(out.String())
+}
+
+// removeOutput deletes the local HLS output of a stream.
+func (l *LiveIngest) removeOutput(streamID string) {
+	for _, rendition := range l.Renditions {
+		os.RemoveAll(filepath.Join(l.OutputPath, rendition.Name, streamID))
+	}
+}
+
+// serveFile serves a playlist or segment of a live stream from local disk. Playlists are cut
+// to the DVR window and change with every segment, so they must not be cached.
+func (l *LiveIngest) serveFile(w http.ResponseWriter, r *http.Request, path string) {
+	file, err := os.Open(path)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, "Failed to open file", http.StatusInternalServerError)
+		return
+	}
+
+	switch filepath.Ext(path) {
+	case ".m3u8":
+		playlist, err := io.ReadAll(file)
+		if err != nil {
+			http.Error(w, "Failed to read file", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/text")
+		w.Header().Set("Cache-Control", "no-cache")
+		http.ServeContent(w, r, "", info.ModTime(), bytes.NewReader(dvrWindow(playlist, l.DVRSegments)))
+		return
+	case ".ts":
+		w.Header().Set("Content-Type", "video/vnd.dlna.mpeg-tts")
+	}
+	http.ServeContent(w, r, "", info.ModTime(), file)
+}
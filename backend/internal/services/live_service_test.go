@@ -0,0 +1,180 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"manhattan_tech_ventures/internal/repository"
+)
+
+// currentStatusClient registers a status stream client as the current one, which live streams
+// report to, and returns its channel.
+func currentStatusClient(t *testing.T) chan string {
+	t.Helper()
+	clientChan := statusClient(t)
+	previous := currClientChan
+	currClientChan = clientChan
+	t.Cleanup(func() { currClientChan = previous })
+	return clientChan
+}
+
+// nextEvent waits for the next status event, which must start with prefix.
+func nextEvent(t *testing.T, clientChan chan string, prefix string, timeout time.Duration) string {
+	t.Helper()
+	select {
+	case event := <-clientChan:
+		if !strings.HasPrefix(event, prefix) {
+			t.Fatalf("got status event %q, want one starting with %s", event, prefix)
+		}
+		return event
+	case <-time.After(timeout):
+		t.Fatalf("no %s status event within %s", prefix, timeout)
+		return ""
+	}
+}
+
+// freePort returns a TCP port nothing listens on.
+func freePort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestLiveIngestArchivesPushedStream(t *testing.T) {
+	for _, tool := range []string{"ffmpeg", "ffprobe"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s is not installed", tool)
+		}
+	}
+	chdirTemp(t)
+	clientChan := currentStatusClient(t)
+	repos := repository.NewMemoryRepositories()
+	rendition := RenditionSpec{Name: "240p", Height: 240, StatusCode: "T2"}
+	for _, dir := range []string{"uploads", "transcoded"} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	listenURL := fmt.Sprintf("rtmp://127.0.0.1:%d/live", freePort(t))
+	live := &LiveIngest{
+		ListenURL:       listenURL,
+		OutputPath:      "transcoded",
+		UploadPath:      "uploads",
+		Renditions:      []RenditionSpec{rendition},
+		SegmentDuration: 1,
+		Jobs:            make(chan Job, 10),
+		Repos:           repos,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		live.Run(ctx)
+		close(stopped)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+
+	// Push a few seconds of a generated test picture and tone, retrying until the ingest listens
+	published := make(chan error, 1)
+	go func() {
+		deadline := time.Now().Add(15 * time.Second)
+		for {
+			cmd := exec.CommandContext(ctx, "ffmpeg", "-v", "error", "-re",
+				"-f", "lavfi", "-i", "testsrc=size=320x240:rate=25",
+				"-f", "lavfi", "-i", "sine=frequency=440:sample_rate=48000",
+				"-t", "5", "-c:v", "libx264", "-g", "25", "-c:a", "aac",
+				"-f", "flv", listenURL)
+			out, err := cmd.CombinedOutput()
+			if err == nil || time.Now().After(deadline) || ctx.Err() != nil {
+				if err != nil {
+					err = fmt.Errorf("%v: %s", err, out)
+				}
+				published <- err
+				return
+			}
+			time.Sleep(200 * time.Millisecond)
+		}
+	}()
+
+	streamID := strings.TrimSuffix(strings.TrimPrefix(nextEvent(t, clientChan, "LS-", 20*time.Second), "LS-"), ":OK")
+	if stream, ok := live.Lookup(streamID); !ok || !stream.Live {
+		t.Fatalf("stream %s is not live: %+v", streamID, stream)
+	}
+	if video, err := repos.Videos.Get(context.Background(), streamID); err != nil || video.Status != repository.VideoStatusLive {
+		t.Errorf("stream's video is %+v, %v; want it live", video, err)
+	}
+
+	// The live playlist appears on disk and is served while the stream is pushed
+	var playlist string
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		recorder := httptest.NewRecorder()
+		if !live.ServePlaylist(recorder, httptest.NewRequest(http.MethodGet, "/hls", nil), streamID, rendition.Name) {
+			t.Fatal("live playlist is not served for a live stream")
+		}
+		playlist = recorder.Body.String()
+		if recorder.Code == http.StatusOK && len(parseMediaPlaylist(playlist)) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("live playlist lists no segment yet (status %d):\n%s", recorder.Code, playlist)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	if strings.Contains(playlist, "#EXT-X-ENDLIST") {
+		t.Errorf("live playlist is already ended:\n%s", playlist)
+	}
+
+	if err := <-published; err != nil {
+		t.Fatalf("failed to push the test stream: %v", err)
+	}
+	nextEvent(t, clientChan, "LE-"+streamID+":OK", 15*time.Second)
+	nextEvent(t, clientChan, "LA-"+streamID+":OK", 30*time.Second)
+
+	// The archive is stored under the names of VOD output and the local output is removed
+	video, err := repos.Videos.Get(context.Background(), streamID)
+	if err != nil || video.Status != repository.VideoStatusReady {
+		t.Fatalf("archived stream's video is %+v, %v; want it ready", video, err)
+	}
+	archived, err := readMediaFile(context.Background(), repos.Media, mediaPlaylistName("transcoded", rendition, streamID, "240p.m3u8"))
+	if err != nil {
+		t.Fatalf("archived playlist is not stored: %v", err)
+	}
+	if !strings.Contains(archived, "#EXT-X-ENDLIST") {
+		t.Errorf("archived playlist is not ended:\n%s", archived)
+	}
+	segments := parseMediaPlaylist(archived)
+	if len(segments) < 3 {
+		t.Errorf("archived playlist lists %d segments, want one for every second pushed", len(segments))
+	}
+	for _, segment := range segments {
+		name := mediaSegmentName("transcoded", rendition, streamID, segmentFileName(segment.URI))
+		reader, _, err := repos.Media.Open(context.Background(), name)
+		if err != nil {
+			t.Errorf("archived segment %s is not stored: %v", name, err)
+			continue
+		}
+		reader.Close()
+	}
+	if _, err := os.Stat(filepath.Join("transcoded", rendition.Name, streamID)); !os.IsNotExist(err) {
+		t.Errorf("local output of the archived stream was not removed: %v", err)
+	}
+	if _, ok := live.Lookup(streamID); ok {
+		t.Error("archived stream is still served from local disk")
+	}
+}
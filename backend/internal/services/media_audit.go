@@ -0,0 +1,233 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"manhattan_tech_ventures/internal/repository"
+)
+
+// renditionMediaPrefix returns the prefix of the names of every stored file of a rendition of
+// a video: its playlists, segments and MP4 export.
+func renditionMediaPrefix(transcodedPath string, rendition RenditionSpec, videoID string) string {
+	return NormalizePath("./"+filepath.Join(transcodedPath, rendition.Name, videoID)) + "/"
+}
+
+// ListVideoMedia returns the stored files of every rendition of a video.
+func ListVideoMedia(ctx context.Context, media repository.MediaRepository, transcodedPath string, renditions []RenditionSpec, videoID string) ([]repository.MediaFileInfo, error) {
+	var files []repository.MediaFileInfo
+	for _, rendition := range renditions {
+		infos, err := media.List(ctx, renditionMediaPrefix(transcodedPath, rendition, videoID))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, infos...)
+	}
+	return files, nil
+}
+
+// DeleteVideoMedia deletes the stored files of every rendition of a video. It returns the
+// number of files and bytes deleted, also when it stops early because of an error.
+func DeleteVideoMedia(ctx context.Context, media repository.MediaRepository, transcodedPath string, renditions []RenditionSpec, videoID string) (int, int64, error) {
+	files, err := ListVideoMedia(ctx, media, transcodedPath, renditions, videoID)
+	if err != nil {
+		return 0, 0, err
+	}
+	deleted, size := 0, int64(0)
+	for _, file := range files {
+		if err := media.Delete(ctx, file.Name); err != nil && !errors.Is(err, repository.ErrNotFound) {
+			return deleted, size, err
+		}
+		deleted++
+		size += file.Size
+	}
+	return deleted, size, nil
+}
+
+// pruneVideoMedia deletes the stored files of a video's renditions that were stored before
+// since, and its MP4 exports, once a job that started at since stored new renditions. Files the
+// job did not store again, such as the segments beyond the end of a shorter output, would be
+// kept otherwise, and the cached exports would still be served for download. It returns the
+// number of files deleted.
+func pruneVideoMedia(ctx context.Context, media repository.MediaRepository, transcodedPath string, renditions []RenditionSpec, videoID string, since time.Time) (int, error) {
+	files, err := ListVideoMedia(ctx, media, transcodedPath, renditions, videoID)
+	if err != nil {
+		return 0, err
+	}
+	since = since.Truncate(time.Millisecond) // GridFS keeps upload dates to the millisecond
+	deleted := 0
+	for _, file := range files {
+		if !file.UploadedAt.Before(since) && !strings.HasSuffix(file.Name, ".mp4") {
+			continue
+		}
+		if err := media.Delete(ctx, file.Name); err != nil && !errors.Is(err, repository.ErrNotFound) {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// MediaProblem is a defect VerifyStream found in the stored files of a video.
+type MediaProblem struct {
+	File    string `json:"file"`    // Name of the stored file, or prefix of a rendition that is missing
+	Problem string `json:"problem"` // What is wrong with it
+}
+
+// StreamCheck is the result of verifying the stored files of a video.
+type StreamCheck struct {
+	VideoID   string         `json:"video_id"`
+	Files     int            `json:"files"`     // Stored files that were read
+	Bytes     int64          `json:"bytes"`     // Total size of the stored files
+	Unchecked int            `json:"unchecked"` // Files stored before checksums were kept, whose contents could only be read
+	Problems  []MediaProblem `json:"problems"`  // Defects found, empty if the video is intact
+}
+
+// VerifyStream reads back every stored file of a video's renditions and checks it against the
+// length and MD5 recorded when it was stored, and checks that every segment the playlists
+// list is stored. Renditions with no files at all are reported as missing.
+func VerifyStream(ctx context.Context, media repository.MediaRepository, transcodedPath string, renditions []RenditionSpec, videoID string) (StreamCheck, error) {
+	check := StreamCheck{VideoID: videoID, Problems: []MediaProblem{}}
+	problem := func(file string, format string, args ...any) {
+		check.Problems = append(check.Problems, MediaProblem{File: file, Problem: fmt.Sprintf(format, args...)})
+	}
+
+	for _, rendition := range renditions {
+		prefix := renditionMediaPrefix(transcodedPath, rendition, videoID)
+		files, err := media.List(ctx, prefix)
+		if err != nil {
+			return check, err
+		}
+		if len(files) == 0 {
+			problem(prefix, "rendition %s is not stored", rendition.Name)
+			continue
+		}
+
+		stored := make(map[string]bool, len(files))
+		playlists := make(map[string][]byte)
+		for _, file := range files {
+			if ctx.Err() != nil {
+				return check, ctx.Err()
+			}
+			stored[file.Name] = true
+			check.Files++
+			check.Bytes += file.Size
+
+			reader, _, err := media.Open(ctx, file.Name)
+			if err != nil {
+				problem(file.Name, "cannot be opened: %v", err)
+				continue
+			}
+			hash := md5.New()
+			var contents bytes.Buffer
+			var writer io.Writer = hash
+			if strings.HasSuffix(file.Name, ".m3u8") {
+				writer = io.MultiWriter(hash, &contents)
+			}
+			length, err := io.Copy(writer, reader)
+			reader.Close()
+			switch {
+			case err != nil:
+				problem(file.Name, "cannot be read: %v", err)
+				continue
+			case length != file.Size:
+				problem(file.Name, "length is %d bytes, %d were read", file.Size, length)
+			case file.MD5 == "":
+				check.Unchecked++
+			case hex.EncodeToString(hash.Sum(nil)) != file.MD5:
+				problem(file.Name, "MD5 does not match the one recorded when it was stored")
+			}
+			if contents.Len() > 0 {
+				playlists[file.Name] = contents.Bytes()
+			}
+		}
+
+		playlistName := mediaPlaylistName(transcodedPath, rendition, videoID, rendition.Name+".m3u8")
+		if !stored[playlistName] {
+			problem(playlistName, "playlist is not stored")
+		}
+		for name, playlist := range playlists {
+			for _, segment := range parseMediaPlaylist(string(playlist)) {
+				segmentName := mediaSegmentName(transcodedPath, rendition, videoID, segmentFileName(segment.URI))
+				if !stored[segmentName] {
+					problem(segmentName, "listed by %s but not stored", filepath.Base(name))
+					stored[segmentName] = true // Reported once, even if more playlists list it
+				}
+			}
+		}
+	}
+	sort.Slice(check.Problems, func(i, j int) bool { return check.Problems[i].File < check.Problems[j].File })
+	return check, nil
+}
+
+// VideoStorage is the storage a video takes.
+type VideoStorage struct {
+	VideoID     string `json:"video_id"`
+	Filename    string `json:"filename,omitempty"`
+	Status      string `json:"status,omitempty"`
+	SourceBytes int64  `json:"source_bytes"`       // Size of the source file in the upload path, 0 if it was deleted
+	MediaFiles  int    `json:"media_files"`        // Stored playlists, segments and exports
+	MediaBytes  int64  `json:"media_bytes"`        // Total size of the stored files
+	Orphaned    bool   `json:"orphaned,omitempty"` // Whether the files belong to no video in the catalog
+}
+
+// StorageUsage reports the storage every video in the catalog takes, and the stored files of
+// videos that are no longer in it, largest first. Stored files are counted for every rendition
+// found, including renditions that are no longer configured.
+func StorageUsage(ctx context.Context, repos *repository.Repositories, uploadPath string, transcodedPath string) ([]VideoStorage, error) {
+	videos, err := repos.Videos.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	usage := make(map[string]*VideoStorage, len(videos))
+	for _, video := range videos {
+		entry := &VideoStorage{VideoID: video.ID, Filename: video.Filename, Status: video.Status}
+		if stat, err := os.Stat(filepath.Join(uploadPath, video.ID)); err == nil {
+			entry.SourceBytes = stat.Size()
+		}
+		usage[video.ID] = entry
+	}
+
+	// Stored files are named <transcoded path>/<rendition>/<video ID>/...
+	prefix := mediaFileName(transcodedPath) + "/"
+	files, err := repos.Media.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		parts := strings.SplitN(strings.TrimPrefix(file.Name, prefix), "/", 3)
+		if len(parts) < 3 {
+			continue
+		}
+		entry, ok := usage[parts[1]]
+		if !ok {
+			entry = &VideoStorage{VideoID: parts[1], Orphaned: true}
+			usage[parts[1]] = entry
+		}
+		entry.MediaFiles++
+		entry.MediaBytes += file.Size
+	}
+
+	report := make([]VideoStorage, 0, len(usage))
+	for _, entry := range usage {
+		report = append(report, *entry)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		a, b := report[i].SourceBytes+report[i].MediaBytes, report[j].SourceBytes+report[j].MediaBytes
+		if a != b {
+			return a > b
+		}
+		return report[i].VideoID < report[j].VideoID
+	})
+	return report, nil
+}
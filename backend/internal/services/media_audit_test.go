@@ -0,0 +1,63 @@
+package service
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"manhattan_tech_ventures/internal/repository"
+)
+
+func TestPruneVideoMediaDeletesPreviousRenditions(t *testing.T) {
+	ctx := context.Background()
+	media := repository.NewMemoryMediaRepository()
+	save := func(names ...string) {
+		for _, name := range names {
+			if _, err := media.Save(ctx, name, strings.NewReader(name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// The previous output had a fourth segment and was exported to MP4
+	save(
+		"./transcoded/480p/video/m3u8/480p.m3u8",
+		"./transcoded/480p/video/ts/480p_000.ts",
+		"./transcoded/480p/video/ts/480p_003.ts",
+		"./transcoded/480p/video/mp4/480p.mp4",
+		"./transcoded/480p/other/ts/480p_003.ts",
+	)
+	time.Sleep(2 * time.Millisecond)
+	since := time.Now()
+	save(
+		"./transcoded/480p/video/m3u8/480p.m3u8",
+		"./transcoded/480p/video/ts/480p_000.ts",
+	)
+
+	deleted, err := pruneVideoMedia(ctx, media, "transcoded", testRenditions, "video", since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 2 {
+		t.Errorf("deleted %d files, want the old segment and the MP4 export", deleted)
+	}
+
+	files, err := media.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name)
+	}
+	want := []string{
+		"./transcoded/480p/other/ts/480p_003.ts",
+		"./transcoded/480p/video/m3u8/480p.m3u8",
+		"./transcoded/480p/video/ts/480p_000.ts",
+	}
+	if !slices.Equal(names, want) {
+		t.Errorf("stored files are %v, want %v", names, want)
+	}
+}
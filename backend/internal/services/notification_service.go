@@ -2,9 +2,13 @@ package service
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"strings"
 	"sync"
+
+	"manhattan_tech_ventures/internal/logging"
+	"manhattan_tech_ventures/internal/metrics"
 )
 
 // clients is a map that keeps track of all active clients connected via Server-Sent Events (SSE).
@@ -14,6 +18,13 @@ var clients = make(map[chan string]struct{})
 // clientsMu is a mutex used to protect concurrent access to the clients map.
 var clientsMu sync.Mutex
 
+// streamsClosing is closed by CloseStatusStreams to make every open status stream send a
+// final event and return, so the HTTP server can shut down without waiting on them.
+var streamsClosing = make(chan struct{})
+
+// closeStreamsOnce guards streamsClosing against being closed twice.
+var closeStreamsOnce sync.Once
+
 // currClientChan is a variable holding the current client channel.
 // This variable is updated every time a new client connects.
 var currClientChan chan string
@@ -30,6 +41,7 @@ func AddClient(clientChan chan string) {
 	clientsMu.Lock()
 	clients[clientChan] = struct{}{}
 	clientsMu.Unlock()
+	metrics.SSEClients.Inc()
 }
 
 // RemoveClient removes a client channel from the clients map and closes it.
@@ -38,6 +50,22 @@ func RemoveClient(clientChan chan string) {
 	clientsMu.Lock()
 	delete(clients, clientChan)
 	clientsMu.Unlock()
+	metrics.SSEClients.Dec()
+}
+
+// statusNameReplacer makes a file name safe to embed in a status update: colons separate the
+// fields of an update and line breaks would end the SSE event early.
+var statusNameReplacer = strings.NewReplacer(":", "_", "\r", " ", "\n", " ")
+
+// jobStatus formats the status update of an upload or job as "<code>-<id>:<name>:<message>".
+// The name is the file name the client uploaded the video as, so users can tell their videos
+// apart; it falls back to the ID when it is not known. Clients that only look at the first and
+// last field, like the web app, keep working unchanged.
+func jobStatus(code string, id string, name string, message string) string {
+	if name == "" {
+		name = id
+	}
+	return fmt.Sprintf("%s-%s:%s:%s", code, id, statusNameReplacer.Replace(name), message)
 }
 
 // SendStatusUpdateToClient sends a status update to a specific client channel.
@@ -49,16 +77,17 @@ func SendStatusUpdateToClient(clientChan chan string, status string) {
 
 	// Check if the client channel still exists in the map
 	if _, ok := clients[clientChan]; !ok {
-		log.Printf("Attempted to send status '%s' to a closed channel\n", status)
+		slog.Warn("Attempted to send status to a closed channel", "status", status)
 		return
 	}
 
 	// Send the status update to the specified client channel
 	select {
 	case clientChan <- status:
-		log.Printf("Sent: '%s'\n", status)
+		slog.Debug("Sent status update", "status", status)
 	default:
-		log.Printf("Client is not ready to receive the status '%s'\n", status)
+		metrics.StatusMessagesDropped.Inc()
+		slog.Warn("Client is not ready to receive the status, dropping it", "status", status)
 	}
 }
 
@@ -89,7 +118,7 @@ func StatusStreamHandler(w http.ResponseWriter, r *http.Request) chan string {
 		case msg, ok := <-clientChan:
 			// Check if the channel is still open
 			if !ok {
-				log.Println("Client channel closed")
+				logging.FromContext(r.Context()).Info("Client channel closed")
 				return clientChan
 			}
 			// Send the message to the client via SSE
@@ -97,8 +126,22 @@ func StatusStreamHandler(w http.ResponseWriter, r *http.Request) chan string {
 			w.(http.Flusher).Flush() // Flush the response to ensure it's sent immediately
 		case <-r.Context().Done():
 			// Handle client disconnection
-			log.Println("Client disconnected")
+			logging.FromContext(r.Context()).Info("Client disconnected")
+			return clientChan
+		case <-streamsClosing:
+			// Tell the client the server is going away before ending the stream
+			fmt.Fprintf(w, "event: shutdown\ndata: server shutting down\n\n")
+			w.(http.Flusher).Flush()
+			logging.FromContext(r.Context()).Info("Client stream closed for shutdown")
 			return clientChan
 		}
 	}
 }
+
+// CloseStatusStreams ends every open status stream with a final "shutdown" event.
+// It is called during server shutdown; streams opened afterwards are closed immediately.
+func CloseStatusStreams() {
+	closeStreamsOnce.Do(func() {
+		close(streamsClosing)
+	})
+}
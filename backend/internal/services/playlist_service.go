@@ -0,0 +1,251 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"manhattan_tech_ventures/internal/repository"
+)
+
+// playlistEntry is one media segment listed in an HLS media playlist.
+type playlistEntry struct {
+	URI      string  // URI of the segment as written in the playlist
+	Duration float64 // Duration from the segment's EXTINF tag, in seconds
+	Length   int64   // Length from the segment's EXT-X-BYTERANGE tag, 0 if it has none
+}
+
+// parseMediaPlaylist lists the segments of an HLS media playlist in order.
+func parseMediaPlaylist(playlist string) []playlistEntry {
+	var entries []playlistEntry
+	var current playlistEntry
+	for _, line := range strings.Split(playlist, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "#EXTINF:"):
+			value, _, _ := strings.Cut(strings.TrimPrefix(line, "#EXTINF:"), ",")
+			current.Duration, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(line, "#EXT-X-BYTERANGE:"):
+			value, _, _ := strings.Cut(strings.TrimPrefix(line, "#EXT-X-BYTERANGE:"), "@")
+			current.Length, _ = strconv.ParseInt(value, 10, 64)
+		case line != "" && !strings.HasPrefix(line, "#"):
+			current.URI = line
+			entries = append(entries, current)
+			current = playlistEntry{}
+		}
+	}
+	return entries
+}
+
+// segmentFileName returns the file name a segment URI refers to. URIs carry the segment
+// directory as base URL, separated by a backslash (see FFmpegTranscoder).
+func segmentFileName(uri string) string {
+	return uri[strings.LastIndexAny(uri, `/\`)+1:]
+}
+
+// IFramePlaylistName returns the file name of the I-frame-only playlist of a rendition.
+func IFramePlaylistName(quality string) string {
+	return quality + "_iframes.m3u8"
+}
+
+// iFrame is a keyframe located inside one of a rendition's segments.
+type iFrame struct {
+	URI    string  // URI of the segment holding the keyframe
+	Time   float64 // Presentation time of the keyframe in seconds
+	Offset int64   // Byte offset of the keyframe within the segment
+	Length int64   // Number of bytes up to the next video frame
+}
+
+// probeIFrames locates the keyframes of an MPEG-TS segment with ffprobe. Only packet headers
+// are read. Every keyframe's byte range runs up to the next video packet, so it holds the whole
+// frame along with any audio interleaved with it.
+func probeIFrames(ctx context.Context, segmentPath string, uri string) ([]iFrame, error) {
+	out, err := runCommand(ctx, "ffprobe", "-v", "error",
+		"-select_streams", "v:0",
+		"-show_entries", "packet=pts_time,pos,flags",
+		"-of", "csv=p=0",
+		segmentPath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(segmentPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read segment: %v", err)
+	}
+
+	var frames []iFrame
+	var open *iFrame // Keyframe still waiting for the position of the next packet
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(strings.TrimSpace(line), ",")
+		if len(fields) < 3 {
+			continue
+		}
+		pos, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		if open != nil {
+			open.Length = pos - open.Offset
+			frames = append(frames, *open)
+			open = nil
+		}
+		if strings.HasPrefix(fields[2], "K") {
+			pts, err := strconv.ParseFloat(fields[0], 64)
+			if err != nil {
+				continue
+			}
+			open = &iFrame{URI: uri, Time: pts, Offset: pos}
+		}
+	}
+	if open != nil {
+		open.Length = info.Size() - open.Offset
+		frames = append(frames, *open)
+	}
+	return frames, nil
+}
+
+// WriteIFramePlaylist writes the I-frame-only playlist of a finished rendition next to its
+// media playlist. It points at the keyframes inside the existing segments through byte ranges,
+// so trick play needs no extra output. Each I-frame lasts until the next one.
+func WriteIFramePlaylist(ctx context.Context, outputPath string, rendition RenditionSpec, streamID string) error {
+	playlistDir := RenditionPlaylistDir(outputPath, rendition, streamID)
+	segmentDir := RenditionSegmentDir(outputPath, rendition, streamID)
+
+	data, err := os.ReadFile(filepath.Join(playlistDir, rendition.Name+".m3u8"))
+	if err != nil {
+		return fmt.Errorf("failed to read playlist: %v", err)
+	}
+	segments := parseMediaPlaylist(string(data))
+	if len(segments) == 0 {
+		return fmt.Errorf("playlist of %s lists no segments", rendition.Name)
+	}
+
+	var frames []iFrame
+	var mapLength int64 // Bytes before the first keyframe, holding the PAT and PMT
+	var totalDuration float64
+	for i, segment := range segments {
+		segmentFrames, err := probeIFrames(ctx, filepath.Join(segmentDir, segmentFileName(segment.URI)), segment.URI)
+		if err != nil {
+			return err
+		}
+		if i == 0 && len(segmentFrames) > 0 {
+			mapLength = segmentFrames[0].Offset
+		}
+		frames = append(frames, segmentFrames...)
+		totalDuration += segment.Duration
+	}
+	if len(frames) == 0 || mapLength == 0 {
+		return fmt.Errorf("no keyframes found in %s", rendition.Name)
+	}
+	return writePlaylist(filepath.Join(playlistDir, IFramePlaylistName(rendition.Name)),
+		iFramePlaylist(frames, segments[0].URI, mapLength, frames[0].Time+totalDuration))
+}
+
+// iFramePlaylist formats an I-frame-only playlist of the given keyframes. The first mapLength
+// bytes of the segment at mapURI hold the PAT and PMT, and end is when the last I-frame ends.
+func iFramePlaylist(frames []iFrame, mapURI string, mapLength int64, end float64) string {
+	var entries strings.Builder
+	targetDuration := 1
+	for i, frame := range frames {
+		next := end
+		if i+1 < len(frames) {
+			next = frames[i+1].Time
+		}
+		duration := max(next-frame.Time, 0)
+		targetDuration = max(targetDuration, int(math.Ceil(duration)))
+		fmt.Fprintf(&entries, "#EXTINF:%.3f,\n#EXT-X-BYTERANGE:%d@%d\n%s\n", duration, frame.Length, frame.Offset, frame.URI)
+	}
+
+	return fmt.Sprintf("#EXTM3U\n#EXT-X-VERSION:5\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-I-FRAMES-ONLY\n#EXT-X-MAP:URI=\"%s\",BYTERANGE=\"%d@0\"\n%s#EXT-X-ENDLIST\n",
+		targetDuration, mapURI, mapLength, entries.String())
+}
+
+// mediaPlaylistName returns the name a rendition's playlist is stored under in the media repository.
+func mediaPlaylistName(transcodedPath string, rendition RenditionSpec, streamID string, playlist string) string {
+	return NormalizePath("./" + filepath.Join(transcodedPath, rendition.Name, streamID, "m3u8", playlist))
+}
+
+// readMediaFile reads a whole file from the media repository.
+func readMediaFile(ctx context.Context, media repository.MediaRepository, name string) (string, error) {
+	reader, _, err := media.Open(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", name, err)
+	}
+	return string(data), nil
+}
+
+// bandwidth returns the peak and average bit rate of a list of segments, in bits per second,
+// given the size of each segment.
+func bandwidth(segments []playlistEntry, size func(playlistEntry) int64) (peak int64, average int64) {
+	var totalBits, totalDuration float64
+	for _, segment := range segments {
+		if segment.Duration <= 0 {
+			continue
+		}
+		bits := float64(size(segment) * 8)
+		peak = max(peak, int64(math.Ceil(bits/segment.Duration)))
+		totalBits += bits
+		totalDuration += segment.Duration
+	}
+	if totalDuration > 0 {
+		average = int64(math.Ceil(totalBits / totalDuration))
+	}
+	return peak, average
+}
+
+// BuildMasterPlaylist builds the master playlist of a stored video: one EXT-X-STREAM-INF entry
+// for every rendition the media repository holds, and an EXT-X-I-FRAME-STREAM-INF entry for
+// each of them that has an I-frame playlist. Bandwidths are measured from the stored segments.
+// It returns repository.ErrNotFound when no rendition of the video is stored.
+func BuildMasterPlaylist(ctx context.Context, media repository.MediaRepository, transcodedPath string, renditions []RenditionSpec, streamID string) (string, error) {
+	var variants, iFrameVariants strings.Builder
+	for _, rendition := range renditions {
+		playlist, err := readMediaFile(ctx, media, mediaPlaylistName(transcodedPath, rendition, streamID, rendition.Name+".m3u8"))
+		if err != nil {
+			continue
+		}
+
+		// Look up the size of every stored segment of the rendition
+		segmentPrefix := NormalizePath("./"+filepath.Join(transcodedPath, rendition.Name, streamID, "ts")) + "/"
+		files, err := media.List(ctx, segmentPrefix)
+		if err != nil {
+			return "", err
+		}
+		sizes := make(map[string]int64, len(files))
+		for _, file := range files {
+			sizes[path.Base(file.Name)] = file.Size
+		}
+
+		peak, average := bandwidth(parseMediaPlaylist(playlist), func(segment playlistEntry) int64 {
+			return sizes[segmentFileName(segment.URI)]
+		})
+		uri := fmt.Sprintf("/hls?quality=%s&stream_id=%s", rendition.Name, streamID)
+		fmt.Fprintf(&variants, "#EXT-X-STREAM-INF:BANDWIDTH=%d,AVERAGE-BANDWIDTH=%d,NAME=\"%s\"\n%s\n", peak, average, rendition.Name, uri)
+
+		iFrames, err := readMediaFile(ctx, media, mediaPlaylistName(transcodedPath, rendition, streamID, IFramePlaylistName(rendition.Name)))
+		if err != nil {
+			continue // Videos stored before trick play was added have no I-frame playlists
+		}
+		peak, average = bandwidth(parseMediaPlaylist(iFrames), func(frame playlistEntry) int64 {
+			return frame.Length
+		})
+		fmt.Fprintf(&iFrameVariants, "#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=%d,AVERAGE-BANDWIDTH=%d,URI=\"%s&iframes=true\"\n", peak, average, uri)
+	}
+
+	if variants.Len() == 0 {
+		return "", fmt.Errorf("master playlist of %s: %w", streamID, repository.ErrNotFound)
+	}
+	return "#EXTM3U\n#EXT-X-VERSION:4\n#EXT-X-INDEPENDENT-SEGMENTS\n" + variants.String() + iFrameVariants.String(), nil
+}
@@ -0,0 +1,125 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"manhattan_tech_ventures/internal/logging"
+	"manhattan_tech_ventures/internal/repository"
+)
+
+// segmentPublishInterval is how often the output of a running transcode is checked for new segments.
+const segmentPublishInterval = 2 * time.Second
+
+// segmentPublisher stores the segments of a job's renditions in the media repository while
+// ffmpeg is still writing them, so a long video can be watched soon after encoding starts.
+// ffmpeg writes event playlists that only list finished segments and replaces them atomically
+// after every segment. Whenever a playlist lists new segments, those are stored first and the
+// playlist after them, so a stored playlist never lists a segment that is not stored yet.
+type segmentPublisher struct {
+	media      repository.MediaRepository
+	outputPath string // Base directory of the transcoded output
+	streamID   string // ID of the video being transcoded
+	renditions []RenditionSpec
+	retries    int    // Further attempts for a segment that could not be stored
+	onPlayable func() // Called once, when the first playlist was stored
+
+	mu        sync.Mutex
+	stored    map[string]bool // Names of the segments stored so far
+	published map[string]int  // Number of segments listed by the stored playlist of each rendition
+	playable  bool            // Whether a playlist was stored yet
+}
+
+// newSegmentPublisher creates a publisher for the output of a transcode request.
+func newSegmentPublisher(media repository.MediaRepository, req TranscodeRequest, retries int, onPlayable func()) *segmentPublisher {
+	return &segmentPublisher{
+		media:      media,
+		outputPath: req.OutputPath,
+		streamID:   req.StreamID,
+		renditions: req.Renditions,
+		retries:    retries,
+		onPlayable: onPlayable,
+		stored:     make(map[string]bool),
+		published:  make(map[string]int),
+	}
+}
+
+// run publishes new segments every segmentPublishInterval until stop is closed or ctx is
+// cancelled. It returns once the publish in progress, if any, has finished.
+func (p *segmentPublisher) run(ctx context.Context, stop <-chan struct{}) {
+	ticker := time.NewTicker(segmentPublishInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-stop:
+			return
+		case <-ticker.C:
+			p.publish(ctx)
+		}
+	}
+}
+
+// publish stores the segments the local playlists list that are not stored yet, and then the
+// playlists themselves. A rendition whose segments could not all be stored keeps its previous
+// playlist until a later publish, or the upload at the end of the job, stores them.
+func (p *segmentPublisher) publish(ctx context.Context) {
+	logger := logging.FromContext(ctx)
+	for _, rendition := range p.renditions {
+		playlistPath := filepath.Join(RenditionPlaylistDir(p.outputPath, rendition, p.streamID), rendition.Name+".m3u8")
+		playlist, err := os.ReadFile(playlistPath)
+		if err != nil {
+			continue // ffmpeg has not finished the first segment yet
+		}
+		segments := parseMediaPlaylist(string(playlist))
+		if len(segments) == p.published[rendition.Name] {
+			continue
+		}
+
+		complete := true
+		for _, segment := range segments {
+			if ctx.Err() != nil {
+				return
+			}
+			segmentPath := filepath.Join(RenditionSegmentDir(p.outputPath, rendition, p.streamID), segmentFileName(segment.URI))
+			if p.isStored(segmentPath) {
+				continue
+			}
+			if err := uploadWithRetries(ctx, p.media, segmentPath, p.retries); err != nil {
+				logger.Warn("Failed to publish segment, leaving it to the final upload", "file", segmentPath, "error", err)
+				complete = false
+				break
+			}
+			p.mu.Lock()
+			p.stored[mediaFileName(segmentPath)] = true
+			p.mu.Unlock()
+		}
+		if !complete {
+			continue
+		}
+
+		if _, err := p.media.Save(ctx, mediaFileName(playlistPath), bytes.NewReader(playlist)); err != nil {
+			logger.Warn("Failed to publish playlist", "rendition", rendition.Name, "error", err)
+			continue
+		}
+		p.published[rendition.Name] = len(segments)
+		if !p.playable {
+			p.playable = true
+			if p.onPlayable != nil {
+				p.onPlayable()
+			}
+		}
+	}
+}
+
+// isStored reports whether the local file at path was stored by the publisher.
+func (p *segmentPublisher) isStored(path string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stored[mediaFileName(path)]
+}
@@ -0,0 +1,167 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"manhattan_tech_ventures/internal/config"
+	"manhattan_tech_ventures/internal/logging"
+	"manhattan_tech_ventures/internal/tracing"
+)
+
+// RenditionSpec describes one output quality of the HLS ladder.
+type RenditionSpec struct {
+	Name       string // Name of the rendition, used in output paths and playlist names (e.g. "480p")
+	Height     int    // Output frame height in pixels; the width keeps the source aspect ratio
+	StatusCode string // Status category sent to clients when the rendition is done (e.g. "T4")
+}
+
+// RenditionsFromConfig converts the configured HLS ladder into rendition specs.
+func RenditionsFromConfig(renditions []config.Rendition) []RenditionSpec {
+	specs := make([]RenditionSpec, len(renditions))
+	for i, rendition := range renditions {
+		specs[i] = RenditionSpec{Name: rendition.Name, Height: rendition.Height, StatusCode: rendition.StatusCode}
+	}
+	return specs
+}
+
+// TranscodeRequest describes a single transcode run: which source to read, where to write the
+// HLS output and which renditions to produce.
+type TranscodeRequest struct {
+	InputPath  string          // Full path of the source video
+	OutputPath string          // Base directory for transcoded output (the configured transcode path)
+	StreamID   string          // ID of the stream, used to separate the output of different videos
+	Renditions []RenditionSpec // Renditions to produce
+}
+
+// TranscodeProgress reports that a rendition of a transcode run has finished.
+type TranscodeProgress struct {
+	Rendition RenditionSpec // Rendition the report is about
+	Err       error         // Error the rendition failed with, nil on success
+}
+
+// Transcoder turns a source video into HLS renditions on the local filesystem. Every
+// implementation writes the layout described by RenditionPlaylistDir and RenditionSegmentDir,
+// so the rest of the pipeline does not depend on how the output was produced.
+type Transcoder interface {
+	// Transcode produces all requested renditions, calling progress (if not nil) as each one
+	// finishes. It returns an error combining the failures of all renditions, if any.
+	Transcode(ctx context.Context, req TranscodeRequest, progress func(TranscodeProgress)) error
+}
+
+// RenditionPlaylistDir returns the directory holding the .m3u8 playlist of a rendition.
+func RenditionPlaylistDir(outputPath string, rendition RenditionSpec, streamID string) string {
+	return filepath.Join(outputPath, rendition.Name, streamID, "m3u8")
+}
+
+// RenditionSegmentDir returns the directory holding the .ts segments of a rendition.
+func RenditionSegmentDir(outputPath string, rendition RenditionSpec, streamID string) string {
+	return filepath.Join(outputPath, rendition.Name, streamID, "ts")
+}
+
+// prepareRenditionDirs creates the playlist and segment directories of a rendition.
+func prepareRenditionDirs(outputPath string, rendition RenditionSpec, streamID string) (playlistDir string, segmentDir string, err error) {
+	playlistDir = RenditionPlaylistDir(outputPath, rendition, streamID)
+	segmentDir = RenditionSegmentDir(outputPath, rendition, streamID)
+
+	for _, dir := range []string{playlistDir, segmentDir} {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return "", "", fmt.Errorf("failed to create output directory %s: %v", dir, err)
+		}
+	}
+	return playlistDir, segmentDir, nil
+}
+
+// FFmpegTranscoder is the Transcoder used in production. It runs one ffmpeg process per
+// rendition, all in parallel, and adds an I-frame-only playlist to every finished rendition
+// for trick play.
+type FFmpegTranscoder struct {
+	SegmentDuration int // Target HLS segment duration in seconds
+}
+
+// NewFFmpegTranscoder creates an FFmpegTranscoder producing 10 second segments.
+func NewFFmpegTranscoder() *FFmpegTranscoder {
+	return &FFmpegTranscoder{SegmentDuration: 10}
+}
+
+// Transcode runs ffmpeg for every requested rendition. Playlists are written as event
+// playlists that grow with every finished segment, so the output can be published while it is
+// encoded, and turned into VOD playlists once their rendition is done. Cancelling ctx kills the
+// running ffmpeg processes.
+func (t *FFmpegTranscoder) Transcode(ctx context.Context, req TranscodeRequest, progress func(TranscodeProgress)) error {
+	// Create necessary directories for all renditions before starting any ffmpeg process
+	commands := make([]*exec.Cmd, len(req.Renditions))
+	for i, rendition := range req.Renditions {
+		playlistDir, segmentDir, err := prepareRenditionDirs(req.OutputPath, rendition, req.StreamID)
+		if err != nil {
+			return err
+		}
+
+		// Define FFmpeg command for transcoding to this rendition's HLS stream
+		commands[i] = exec.CommandContext(ctx, "ffmpeg", "-i", req.InputPath,
+			"-vf", fmt.Sprintf("scale=-2:%d", rendition.Height),
+			"-hls_time", strconv.Itoa(t.SegmentDuration),
+			"-hls_list_size", "0",
+			"-hls_playlist_type", "event",
+			"-hls_segment_filename", filepath.Join(segmentDir, rendition.Name+"_%03d.ts"),
+			"-hls_base_url", segmentDir+"\\",
+			"-f", "hls",
+			filepath.Join(playlistDir, rendition.Name+".m3u8"))
+	}
+
+	var wg sync.WaitGroup
+	errChan := make(chan error, len(req.Renditions)) // Channel to collect errors from transcoding goroutines
+
+	for i, rendition := range req.Renditions {
+		wg.Add(1)
+
+		// Run FFmpeg command in a separate goroutine
+		go func(rendition RenditionSpec, cmd *exec.Cmd) {
+			defer wg.Done()
+			var stderr bytes.Buffer
+			cmd.Stderr = &stderr
+
+			_, span := tracing.Start(ctx, "ffmpeg", tracing.UploadID.String(req.StreamID), tracing.Rendition.String(rendition.Name))
+			var renditionErr error
+			if err := cmd.Run(); err != nil {
+				logging.FromContext(ctx).Error("FFmpeg failed", "rendition", rendition.Name, "stderr", stderr.String())
+				renditionErr = fmt.Errorf("failed to transcode %s: %v", rendition.Name, err)
+				errChan <- renditionErr
+			} else if err := finishPlaylist(filepath.Join(RenditionPlaylistDir(req.OutputPath, rendition, req.StreamID), rendition.Name+".m3u8")); err != nil {
+				renditionErr = fmt.Errorf("failed to finish %s playlist: %v", rendition.Name, err)
+				errChan <- renditionErr
+			} else if err := WriteIFramePlaylist(ctx, req.OutputPath, rendition, req.StreamID); err != nil {
+				// Trick play is optional; the rendition plays without it
+				logging.FromContext(ctx).Warn("Failed to write I-frame playlist", "rendition", rendition.Name, "error", err)
+			}
+			tracing.End(span, renditionErr)
+			if progress != nil {
+				progress(TranscodeProgress{Rendition: rendition, Err: renditionErr})
+			}
+		}(rendition, commands[i])
+	}
+
+	wg.Wait()      // Wait for all transcoding processes to complete
+	close(errChan) // Close the error channel after all goroutines are done
+
+	return combineErrors(errChan)
+}
+
+// combineErrors joins all errors received on errChan into a single error, or returns nil.
+func combineErrors(errChan <-chan error) error {
+	var combinedError error
+	for err := range errChan {
+		if combinedError == nil {
+			combinedError = err
+		} else {
+			combinedError = fmt.Errorf("%v; %v", combinedError, err)
+		}
+	}
+	return combinedError
+}
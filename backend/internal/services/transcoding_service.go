@@ -1,204 +1,520 @@
 package service
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"log"
-	"manhattan_tech_ventures/internal/config"
+	"log/slog"
+	"manhattan_tech_ventures/internal/logging"
+	"manhattan_tech_ventures/internal/metrics"
+	"manhattan_tech_ventures/internal/repository"
+	"manhattan_tech_ventures/internal/tracing"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// maxWorkersEnv retrieves the maximum number of worker processes from the configuration file.
-// This value is used to control the number of concurrent worker goroutines in the WorkerPool.
-var maxWorkersEnv = config.LoadConfig().WorkerProcessCount
-
 // Job represents a unit of work for the worker pool. It contains all the necessary
-// information to process a video file, including paths, database client, and the channel
-// to communicate status updates to the client.
+// information to process a video file, including paths and the channel to communicate
+// status updates to the client. Every job is also persisted as a repository.JobRecord.
 type Job struct {
-	DBBucketName   string          // Name of the GridFS bucket in MongoDB
-	UploadPath     string          // Path where the original uploaded files are stored
-	TranscodedPath string          // Path where transcoded files will be stored
-	Filename       string          // Name of the original video file
-	DBClient       *mongo.Database // MongoDB client used for GridFS operations
-	ClientChan     chan string     // Channel for sending status updates back to the client
+	ID             string                 // ID of the job's record in the job repository
+	UploadPath     string                 // Path where the original uploaded files are stored
+	TranscodedPath string                 // Path where transcoded files will be stored
+	Filename       string                 // Name of the original video file, also the video ID
+	Name           string                 // Name the client uploaded the video as, shown in status updates
+	ClientChan     chan string            // Channel for sending status updates back to the client
+	Clip           *repository.ClipSpec   // Range to cut out of a parent video before transcoding, nil for regular uploads
+	Concat         *repository.ConcatSpec // Videos to join before transcoding, nil for regular uploads
+	QueuedAt       time.Time              // Time the job was handed to the worker pool
+	SpanContext    trace.SpanContext      // Span that queued the job; the job's own spans continue its trace
+}
+
+// errConcatFailed marks the error of a job whose concatenation failed. The failure has already
+// been reported with a CF event, so the job ends without a further TF event.
+var errConcatFailed = errors.New("failed to concatenate videos")
+
+// logger returns a logger that tags every line with the job and upload IDs.
+func (job Job) logger() *slog.Logger {
+	return slog.Default().With(logging.JobIDKey, job.ID, logging.UploadIDKey, job.Filename)
 }
 
-// WorkerPool initializes a pool of worker goroutines that process jobs from the jobs channel.
-// Each worker transcodes videos and uploads them to GridFS, sending results to the results channel.
-func WorkerPool(jobs chan Job, results chan error) {
-	var wg sync.WaitGroup
+// EnqueueJob records a new job in the job repository and queues it for the worker pool.
+// The job's ID is assigned here.
+func EnqueueJob(ctx context.Context, repos *repository.Repositories, jobs chan<- Job, job Job) (err error) {
+	ctx, span := tracing.Start(ctx, "job.enqueue", tracing.UploadID.String(job.Filename))
+	defer func() { tracing.End(span, err) }()
 
-	// Convert the maxWorkersEnv string to an integer
-	maxWorkers, err := strconv.Atoi(maxWorkersEnv)
+	id, err := repository.NewID()
 	if err != nil {
-		panic(err) // Panic if maxWorkersEnv is not a valid number
+		return err
+	}
+	job.ID = id
+	job.SpanContext = span.SpanContext()
+	span.SetAttributes(tracing.JobID.String(job.ID))
+
+	record := &repository.JobRecord{
+		ID:      job.ID,
+		VideoID: job.Filename,
+		Status:  repository.JobStatusQueued,
+		Clip:    job.Clip,
+		Concat:  job.Concat,
+	}
+	// Tracked before the record exists, so RecoverJobs and PollJobs never queue it a second time
+	trackJob(job.ID)
+	if err := repos.Jobs.Create(ctx, record); err != nil {
+		untrackJob(job.ID)
+		return err
+	}
+
+	queueJob(jobs, job)
+	return nil
+}
+
+// queueJob hands a job to the worker pool, keeping the queue depth metric up to date.
+func queueJob(jobs chan<- Job, job Job) {
+	job.QueuedAt = time.Now()
+	trackJob(job.ID)
+	metrics.JobQueueDepth.Inc()
+	jobs <- job
+}
+
+// prepareSource makes sure the job's source file exists in the upload path before it is
+// transcoded. Regular uploads are already in place; clips are cut out of their parent video
+// and concatenations are joined from their sources, reporting progress on the job's channel.
+func prepareSource(ctx context.Context, job Job) error {
+	outputPath := filepath.Join(job.UploadPath, job.Filename)
+
+	switch {
+	case job.Clip != nil:
+		ctx, span := tracing.Start(ctx, "clip.trim", tracing.UploadID.String(job.Filename))
+		inputPath := filepath.Join(job.UploadPath, job.Clip.ParentFilename)
+		err := TrimVideo(ctx, inputPath, outputPath, job.Clip.Start, job.Clip.End)
+		tracing.End(span, err)
+		if err != nil {
+			return fmt.Errorf("failed to cut clip from %s: %v", job.Clip.ParentFilename, err)
+		}
+
+	case job.Concat != nil:
+		inputPaths := make([]string, len(job.Concat.SourceFilenames))
+		for i, source := range job.Concat.SourceFilenames {
+			inputPaths[i] = filepath.Join(job.UploadPath, source)
+		}
+
+		// Send a status update indicating the start of concatenation, then report its progress
+		SendStatusUpdateToClient(job.ClientChan, jobStatus("CS", job.Filename, job.Name, "OK"))
+		ctx, span := tracing.Start(ctx, "concat", tracing.UploadID.String(job.Filename), tracing.FileCount.Int(len(inputPaths)))
+		err := ConcatVideos(ctx, inputPaths, outputPath, *job.Concat, func(percent int) {
+			SendStatusUpdateToClient(job.ClientChan, jobStatus("CP", job.Filename, job.Name, strconv.Itoa(percent)))
+		})
+		tracing.End(span, err)
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			SendStatusUpdateToClient(job.ClientChan, jobStatus("CF", job.Filename, job.Name, err.Error()))
+			return fmt.Errorf("%w: %v", errConcatFailed, err)
+		}
+		SendStatusUpdateToClient(job.ClientChan, jobStatus("CC", job.Filename, job.Name, "OK"))
 	}
+	return nil
+}
+
+// setVideoStatus records a job's progress on its catalog record. Failing to update the
+// catalog must not fail the job itself, so errors are only logged.
+func setVideoStatus(repos *repository.Repositories, job Job, status string, jobErr error) {
+	errMsg := ""
+	if jobErr != nil {
+		errMsg = jobErr.Error()
+	}
+	if err := repos.Videos.UpdateStatus(context.Background(), job.Filename, status, errMsg); err != nil {
+		job.logger().Error("Failed to update video status", "status", status, "error", err)
+	}
+}
+
+// finishJob records the outcome of a job run on its job record and its catalog record. It
+// returns repository.ErrJobFinished, leaving both records alone, if the job was cancelled.
+func finishJob(repos *repository.Repositories, job Job, jobErr error) error {
+	jobStatus, videoStatus, errMsg := repository.JobStatusSucceeded, repository.VideoStatusReady, ""
+	if jobErr != nil {
+		jobStatus, videoStatus, errMsg = repository.JobStatusFailed, repository.VideoStatusFailed, jobErr.Error()
+	}
+
+	err := repos.Jobs.MarkFinished(context.Background(), job.ID, jobStatus, errMsg)
+	if errors.Is(err, repository.ErrJobFinished) {
+		return err
+	} else if err != nil {
+		job.logger().Error("Failed to record job outcome", "status", jobStatus, "error", err)
+	}
+	setVideoStatus(repos, job, videoStatus, jobErr)
+	return nil
+}
+
+// OutputOptions controls how TranscodeVideo stores the transcoded files of a job.
+type OutputOptions struct {
+	UploadWorkers int  // Files uploaded to the media repository at once
+	UploadRetries int  // Further attempts for a file that could not be stored
+	KeepFiles     bool // Whether the job's local output is kept once it was stored, for debugging
+}
+
+// WorkerPool is a pool of worker goroutines that process jobs from the jobs channel.
+// Each worker transcodes videos with the given transcoder and stores them in the media repository,
+// recording progress in the job and video repositories and sending results to the results channel.
+type WorkerPool struct {
+	jobs       chan Job
+	results    chan error
+	transcoder Transcoder
+	repos      *repository.Repositories
+	workers    int
+	renditions []RenditionSpec
+	output     OutputOptions
+
+	stopping chan struct{}      // Closed when shutdown starts; workers stop taking new jobs
+	ctx      context.Context    // Context of running jobs, cancelled when the grace period runs out
+	cancel   context.CancelFunc // Cancels ctx
+	wg       sync.WaitGroup     // Tracks running worker goroutines
+	running  atomic.Bool        // Whether the workers have been started and not yet stopped
+}
+
+// NewWorkerPool creates a pool of the given number of workers reading jobs from the jobs channel
+// and transcoding every video to the given renditions, storing the output as set by output.
+// Call Start to begin processing jobs.
+func NewWorkerPool(workers int, renditions []RenditionSpec, jobs chan Job, results chan error, transcoder Transcoder, repos *repository.Repositories, output OutputOptions) *WorkerPool {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &WorkerPool{
+		jobs:       jobs,
+		results:    results,
+		transcoder: transcoder,
+		repos:      repos,
+		workers:    workers,
+		renditions: renditions,
+		output:     output,
+		stopping:   make(chan struct{}),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+// Start launches the worker goroutines. The results channel is closed once all of them have stopped.
+func (p *WorkerPool) Start() {
+	p.running.Store(true)
 
 	// Start the specified number of worker goroutines
-	for i := 0; i < maxWorkers; i++ {
-		wg.Add(1)
+	for i := 0; i < p.workers; i++ {
+		p.wg.Add(1)
 		go func() {
-			defer wg.Done()
-			for job := range jobs {
-				// Send a status update indicating the start of transcoding
-				SendStatusUpdateToClient(job.ClientChan, fmt.Sprintf("TS-%s:OK", job.Filename))
-
-				// Perform video transcoding and handle potential errors
-				err := TranscodeVideo(job.DBClient, job.DBBucketName, job.UploadPath, job.TranscodedPath, job.Filename, job.ClientChan)
-
-				// Send status updates based on the success or failure of the transcoding
-				if err != nil {
-					SendStatusUpdateToClient(job.ClientChan, fmt.Sprintf("TF-%s:%v", job.Filename, err))
-				} else {
-					SendStatusUpdateToClient(job.ClientChan, fmt.Sprintf("TC-%s:OK", job.Filename))
+			defer p.wg.Done()
+			for {
+				select {
+				case <-p.stopping:
+					return
+				case job := <-p.jobs:
+					metrics.JobQueueDepth.Dec()
+					// A job picked up after shutdown started stays queued in the job repository
+					select {
+					case <-p.stopping:
+						return
+					default:
+					}
+					p.results <- p.process(job) // Send the result (error or nil) to the results channel
 				}
-				results <- err // Send the result (error or nil) to the results channel
 			}
 		}()
 	}
 
-	wg.Wait()      // Wait for all workers to complete
-	close(results) // Close the results channel once all workers are done
+	go func() {
+		p.wg.Wait() // Wait for all workers to complete
+		p.running.Store(false)
+		close(p.results) // Close the results channel once all workers are done
+	}()
+}
+
+// Running reports whether the workers have been started and are still accepting jobs.
+func (p *WorkerPool) Running() bool {
+	select {
+	case <-p.stopping:
+		return false
+	default:
+		return p.running.Load()
+	}
 }
 
-// TranscodeVideo performs the transcoding of a video into 480p and 720p HLS streams.
-// It creates necessary directories, runs FFmpeg commands for transcoding, and uploads the
-// resulting HLS files to GridFS. Status updates are sent back to the client through a channel.
-func TranscodeVideo(dbClient *mongo.Database, gridFSBucketName string, filePath string, outputfilePath string, originalFilename string, clientChanParam chan string) error {
-	var wg sync.WaitGroup
-	errChan := make(chan error, 2) // Channel to collect errors from transcoding goroutines
+// Shutdown stops the workers from taking new jobs and waits for the running ones to finish.
+// Jobs that are still queued stay queued in the job repository. If ctx expires first, running
+// jobs are interrupted and checkpointed back to queued, so they are picked up again on the next
+// start, and ctx's error is returned once every worker has stopped.
+func (p *WorkerPool) Shutdown(ctx context.Context) error {
+	close(p.stopping)
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		p.cancel()
+		return nil
+	case <-ctx.Done():
+		p.cancel() // Kill running ffmpeg processes and stop uploads between files
+		<-done
+		return ctx.Err()
+	}
+}
+
+// process runs a single job from start to finish and records its outcome. The job's span
+// continues the trace of the request that queued it.
+func (p *WorkerPool) process(job Job) (err error) {
+	metrics.ObserveSince(metrics.JobWaitSeconds, job.QueuedAt)
+
+	ctx, span := tracing.Start(trace.ContextWithSpanContext(p.ctx, job.SpanContext), "job.run",
+		tracing.UploadID.String(job.Filename), tracing.JobID.String(job.ID))
+	defer func() { tracing.End(span, err) }()
 
-	// Define the input and output paths for transcoding
-	inputFullPath := filepath.Join(filePath, originalFilename)
-	m3u8Output480FullPath := filepath.Join(outputfilePath, "480p", originalFilename, "m3u8")
-	m3u8output720FullPath := filepath.Join(outputfilePath, "720p", originalFilename, "m3u8")
-	tsOutput480FullPath := filepath.Join(outputfilePath, "480p", originalFilename, "ts")
-	tsOutput720FullPath := filepath.Join(outputfilePath, "720p", originalFilename, "ts")
+	// Tag every line logged while running the job with its IDs
+	logger := job.logger()
+	ctx = logging.WithLogger(ctx, logger)
+	repos := p.repos
 
-	// Create necessary directories for output files
-	m3u8File480pErr := os.MkdirAll(m3u8Output480FullPath, os.ModePerm)
-	if m3u8File480pErr != nil {
-		log.Fatalf("failed to create base directory: %v", m3u8File480pErr)
-		return m3u8File480pErr
+	// Skip jobs that were cancelled, or otherwise finished, while they waited in the queue; the
+	// record is only marked as running while it is still queued
+	if err := repos.Jobs.MarkRunning(context.Background(), job.ID); errors.Is(err, repository.ErrJobFinished) {
+		logger.Info("Skipping job that is no longer queued", "error", err)
+		untrackJob(job.ID)
+		return nil
+	} else if err != nil {
+		logger.Error("Failed to mark job as running", "error", err)
 	}
+	logger.Info("Job started")
+
+	// Stop the job if it is cancelled while it runs
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	go watchCancellation(ctx, repos, job.ID, cancel)
 
-	tsFile480pErr := os.MkdirAll(tsOutput480FullPath, os.ModePerm)
-	if tsFile480pErr != nil {
-		log.Fatalf("failed to create base directory: %v", tsFile480pErr)
-		return tsFile480pErr
+	setVideoStatus(repos, job, repository.VideoStatusTranscoding, nil)
+
+	// Make the source file available (e.g. cut a clip) before transcoding it
+	if err := prepareSource(ctx, job); err != nil {
+		return p.finish(ctx, job, err)
 	}
 
-	m3u8File720pErr := os.MkdirAll(m3u8output720FullPath, os.ModePerm)
-	if m3u8File720pErr != nil {
-		log.Fatalf("failed to create base directory: %v", m3u8File720pErr)
-		return m3u8File720pErr
+	// Send a status update indicating the start of transcoding
+	SendStatusUpdateToClient(job.ClientChan, jobStatus("TS", job.Filename, job.Name, "OK"))
+
+	// Perform video transcoding and handle potential errors
+	started := time.Now()
+	err = TranscodeVideo(ctx, p.transcoder, p.renditions, repos.Media, job.UploadPath, job.TranscodedPath, job.Filename, job.Name, job.ClientChan, p.output)
+	if err == nil {
+		// A video transcoded again must not keep files of its previous renditions
+		if deleted, pruneErr := pruneVideoMedia(ctx, repos.Media, job.TranscodedPath, p.renditions, job.Filename, started); pruneErr != nil {
+			logger.Error("Failed to delete previous media files", "error", pruneErr)
+		} else if deleted > 0 {
+			logger.Info("Deleted previous media files", "files", deleted)
+		}
 	}
+	return p.finish(ctx, job, err)
+}
 
-	tsFile720pErr := os.MkdirAll(tsOutput720FullPath, os.ModePerm)
-	if tsFile720pErr != nil {
-		log.Fatalf("failed to create base directory: %v", tsFile720pErr)
-		return tsFile720pErr
+// finish records the outcome of a job and sends its final status update. A job that was
+// cancelled keeps the outcome recorded by CancelJob, also when the cancellation is only noticed
+// as its outcome is recorded, and a job interrupted by shutdown is checkpointed back to queued
+// instead of being marked as failed.
+func (p *WorkerPool) finish(ctx context.Context, job Job, err error) error {
+	if err != nil && errors.Is(context.Cause(ctx), errJobCancelled) {
+		return p.cancelled(job, err)
+	}
+	if err != nil && p.ctx.Err() != nil {
+		if checkpointErr := checkpointJob(p.repos, job); errors.Is(checkpointErr, repository.ErrJobFinished) {
+			return p.cancelled(job, err)
+		}
+		job.logger().Warn("Job interrupted by shutdown, leaving it queued", "error", err)
+		return err
+	}
+	untrackJob(job.ID)
+	if finishJob(p.repos, job, err) != nil {
+		return p.cancelled(job, err)
 	}
 
-	// Define paths for the m3u8 playlists and .ts segments
-	m3u8Output480p := filepath.Join(m3u8Output480FullPath, "480p.m3u8")
-	m3u8Output720p := filepath.Join(m3u8output720FullPath, "720p.m3u8")
-	tsOutput480p := filepath.Join(tsOutput480FullPath, "480p_%03d.ts")
-	tsOutput720p := filepath.Join(tsOutput720FullPath, "720p_%03d.ts")
+	// Send status updates based on the success or failure of the job
+	switch {
+	case errors.Is(err, errConcatFailed):
+		job.logger().Error("Job failed", "error", err) // Reported with the CF event already
+	case err != nil:
+		job.logger().Error("Job failed", "error", err)
+		SendStatusUpdateToClient(job.ClientChan, jobStatus("TF", job.Filename, job.Name, err.Error()))
+	default:
+		job.logger().Info("Job succeeded")
+		SendStatusUpdateToClient(job.ClientChan, jobStatus("TC", job.Filename, job.Name, "OK"))
+	}
+	return err
+}
 
-	// Define FFmpeg commands for transcoding to 480p and 720p HLS streams
-	cmd480p := exec.Command("ffmpeg", "-i", inputFullPath,
-		"-vf", "scale=-2:480",
-		"-hls_time", "10",
-		"-hls_list_size", "0",
-		"-hls_segment_filename", tsOutput480p,
-		"-hls_base_url", tsOutput480FullPath+"\\",
-		"-f", "hls",
-		m3u8Output480p)
+// cancelled reports a job that was cancelled while it ran.
+func (p *WorkerPool) cancelled(job Job, err error) error {
+	untrackJob(job.ID)
+	job.logger().Warn("Job cancelled", "error", err)
+	SendStatusUpdateToClient(job.ClientChan, jobStatus("TF", job.Filename, job.Name, errJobCancelled.Error()))
+	return errJobCancelled
+}
 
-	cmd720p := exec.Command("ffmpeg", "-i", inputFullPath,
-		"-vf", "scale=-2:720",
-		"-hls_time", "10",
-		"-hls_list_size", "0",
-		"-hls_segment_filename", tsOutput720p,
-		"-hls_base_url", tsOutput720FullPath+"\\",
-		"-f", "hls",
-		m3u8Output720p)
+// checkpointJob puts an interrupted job back into the queued state, so RecoverJobs runs it again.
+// It returns repository.ErrJobFinished, leaving the job alone, if the job was cancelled.
+func checkpointJob(repos *repository.Repositories, job Job) error {
+	err := repos.Jobs.MarkFinished(context.Background(), job.ID, repository.JobStatusQueued, "interrupted by shutdown")
+	if errors.Is(err, repository.ErrJobFinished) {
+		return err
+	} else if err != nil {
+		job.logger().Error("Failed to checkpoint job", "error", err)
+	}
+	setVideoStatus(repos, job, repository.VideoStatusQueued, nil)
+	return nil
+}
 
-	wg.Add(2)
+// RecoverJobs queues every job that was left queued or running by a previous run of the
+// server, for example because it was shut down before the job could finish. It blocks until
+// all of them have been handed to the jobs channel, so it is usually run in a goroutine. Jobs
+// this process queued itself in the meantime are left alone.
+func RecoverJobs(ctx context.Context, repos *repository.Repositories, jobs chan<- Job, uploadPath string, transcodedPath string) error {
+	for _, status := range []string{repository.JobStatusRunning, repository.JobStatusQueued} {
+		records, err := repos.Jobs.List(ctx, status)
+		if err != nil {
+			return err
+		}
 
-	// Run FFmpeg command for 480p in a separate goroutine
-	go func() {
-		defer wg.Done()
-		var stderr480p bytes.Buffer
-		cmd480p.Stderr = &stderr480p
-		err480 := cmd480p.Run()
-		if err480 != nil {
-			log.Printf("FFmpeg 480p error: %s", stderr480p.String())
-			errChan <- fmt.Errorf("failed to transcode 480p: %v", err480)
-		} else {
-			SendStatusUpdateToClient(clientChanParam, fmt.Sprintf("T4-%s:OK", originalFilename))
+		for _, record := range records {
+			// Uploads, imports and the watcher queue jobs while recovery runs, which it must not queue again
+			if isTracked(record.ID) {
+				continue
+			}
+			slog.Info("Recovering unfinished job", logging.JobIDKey, record.ID, logging.UploadIDKey, record.VideoID, "status", record.Status)
+			if record.Status == repository.JobStatusRunning {
+				// Workers only start queued jobs; one cancelled in the meantime is left alone
+				err := repos.Jobs.MarkFinished(ctx, record.ID, repository.JobStatusQueued, "interrupted by a restart")
+				if errors.Is(err, repository.ErrJobFinished) {
+					continue
+				} else if err != nil {
+					return err
+				}
+			}
+			queueJob(jobs, jobFromRecord(ctx, repos, record, uploadPath, transcodedPath))
 		}
-	}()
+	}
+	return nil
+}
+
+// TranscodeVideo transcodes a video into the given HLS renditions using the given transcoder
+// and uploads the resulting HLS files to the media repository. Segments are stored while ffmpeg
+// is still encoding, behind a growing event playlist, and the finished playlists once it is
+// done. Status updates are sent back to the client through a channel as the video becomes
+// playable and as each rendition finishes. Cancelling ctx stops the transcoder and any further
+// uploads. Only the job's own output directories are uploaded, with several files at once, and
+// every file is verified once stored; the job fails with a list of the files that could not be
+// stored intact even after retrying. The job's output directories are deleted afterwards,
+// whatever the outcome, unless output.KeepFiles is set.
+func TranscodeVideo(ctx context.Context, transcoder Transcoder, renditions []RenditionSpec, media repository.MediaRepository, filePath string, outputfilePath string, originalFilename string, name string, clientChanParam chan string, output OutputOptions) error {
+	req := TranscodeRequest{
+		InputPath:  filepath.Join(filePath, originalFilename),
+		OutputPath: outputfilePath,
+		StreamID:   originalFilename,
+		Renditions: renditions,
+	}
+	if !output.KeepFiles {
+		defer removeJobOutput(ctx, outputfilePath, renditions, originalFilename)
+	}
 
-	// Run FFmpeg command for 720p in a separate goroutine
+	// Store segments as soon as ffmpeg finishes them, so viewers can start watching while the
+	// video is still being encoded; the first stored playlist is announced with a TP event
+	publisher := newSegmentPublisher(media, req, output.UploadRetries, func() {
+		SendStatusUpdateToClient(clientChanParam, jobStatus("TP", originalFilename, name, "OK"))
+	})
+	stopPublishing := make(chan struct{})
+	publishing := make(chan struct{})
 	go func() {
-		defer wg.Done()
-		var stderr720p bytes.Buffer
-		cmd720p.Stderr = &stderr720p
-		err720 := cmd720p.Run()
-		if err720 != nil {
-			log.Printf("FFmpeg 720p error: %s", stderr720p.String())
-			errChan <- fmt.Errorf("failed to transcode 720p: %v", err720)
+		defer close(publishing)
+		publisher.run(ctx, stopPublishing)
+	}()
+
+	// Record how long every rendition took and send a status update for every rendition that
+	// finished successfully. Renditions are transcoded concurrently, so each one is timed from the start.
+	start := time.Now()
+	transcodeErr := transcoder.Transcode(ctx, req, func(progress TranscodeProgress) {
+		metrics.ObserveSince(metrics.TranscodeDurationSeconds.WithLabelValues(progress.Rendition.Name), start)
+		if progress.Err != nil {
+			metrics.TranscodeFailures.WithLabelValues(progress.Rendition.Name).Inc()
 		} else {
-			SendStatusUpdateToClient(clientChanParam, fmt.Sprintf("T7-%s:OK", originalFilename))
+			SendStatusUpdateToClient(clientChanParam, jobStatus(progress.Rendition.StatusCode, originalFilename, name, "OK"))
 		}
-	}()
+	})
+	close(stopPublishing)
+	<-publishing
 
-	wg.Wait()      // Wait for both transcoding processes to complete
-	close(errChan) // Close the error channel after all goroutines are done
+	// Collect the files of the job's renditions that still have to be uploaded to the media
+	// repository: the finished playlists and any segment not published yet. A rendition that
+	// failed may not have an output directory.
+	_, walkSpan := tracing.Start(ctx, "output.walk", tracing.UploadID.String(originalFilename))
 
-	// Collect files to upload to GridFS
 	var filesToUpload []string
-
-	fileReadErr := filepath.Walk(outputfilePath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+	var fileReadErr error
+	for _, rendition := range renditions {
+		renditionFiles, err := listOutputFiles(filepath.Join(outputfilePath, rendition.Name, originalFilename))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			fileReadErr = fmt.Errorf("failed to list %s output: %v", rendition.Name, err)
+			break
 		}
-		if !info.IsDir() {
-			filesToUpload = append(filesToUpload, ".\\"+path) // Add each file to the list
+		for _, file := range renditionFiles {
+			if !publisher.isStored(file) {
+				filesToUpload = append(filesToUpload, file)
+			}
 		}
-		return nil
-	})
+	}
+
+	walkSpan.SetAttributes(tracing.FileCount.Int(len(filesToUpload)))
+	tracing.End(walkSpan, fileReadErr)
 
 	if fileReadErr != nil {
-		log.Fatalf("Error traversing directory: %v", fileReadErr)
+		return fmt.Errorf("failed to list transcoded files: %v", fileReadErr)
 	}
 
-	// Upload each file to GridFS
-	for _, filePath := range filesToUpload {
-		err := UploadFileToGridFS(dbClient, filePath, gridFSBucketName)
-		if err != nil {
-			log.Printf("Error uploading file %s: %v", filePath, err)
+	// Upload the files to the media repository. Files that are being stored are always finished,
+	// but no further files are started once ctx is cancelled.
+	if err := uploadMediaFiles(ctx, media, filesToUpload, output.UploadWorkers, output.UploadRetries); err != nil {
+		if ctx.Err() != nil {
+			return err
 		}
+		return fmt.Errorf("transcoded files missing from storage: %v", err)
 	}
 
-	// Combine errors from both transcoding processes
-	var combinedError error
-	for err := range errChan {
-		if combinedError == nil {
-			combinedError = err
-		} else {
-			combinedError = fmt.Errorf("%v; %v", combinedError, err)
+	return transcodeErr
+}
+
+// removeJobOutput deletes the local output directories of a job's renditions.
+func removeJobOutput(ctx context.Context, outputPath string, renditions []RenditionSpec, streamID string) {
+	for _, rendition := range renditions {
+		if err := os.RemoveAll(filepath.Join(outputPath, rendition.Name, streamID)); err != nil {
+			logging.FromContext(ctx).Warn("Failed to delete transcoded files", "rendition", rendition.Name, "error", err)
 		}
 	}
+}
 
-	return combinedError
+// listOutputFiles returns the files below dir in the form UploadMediaFile expects, so they are
+// stored under the names the HLS handlers look them up by.
+func listOutputFiles(dir string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, path) // Add each file to the list
+		}
+		return nil
+	})
+	return files, err
 }
@@ -0,0 +1,382 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"manhattan_tech_ventures/internal/repository"
+)
+
+// testRenditions is the ladder the worker pool tests transcode to.
+var testRenditions = []RenditionSpec{
+	{Name: "480p", Height: 480, StatusCode: "T4"},
+	{Name: "720p", Height: 720, StatusCode: "T7"},
+}
+
+// chdirTemp makes a new temporary directory the working directory for the rest of the test,
+// so the media files are stored under the same relative names as in production.
+func chdirTemp(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// statusClient registers a status stream client and returns its channel.
+func statusClient(t *testing.T) chan string {
+	t.Helper()
+	clientChan := make(chan string, 100)
+	AddClient(clientChan)
+	t.Cleanup(func() { RemoveClient(clientChan) })
+	return clientChan
+}
+
+// receivedEvents returns the status events sent to a client so far, without the TP event,
+// which is only sent when a playlist is published while the transcoder is still running.
+func receivedEvents(clientChan chan string) []string {
+	var events []string
+	for {
+		select {
+		case event := <-clientChan:
+			if !strings.HasPrefix(event, "TP-") {
+				events = append(events, event)
+			}
+		default:
+			return events
+		}
+	}
+}
+
+// runUploadJob uploads a source video, queues a job for it and runs it on a worker pool with
+// the given transcoder. It returns the ID of the video and the job's result.
+func runUploadJob(t *testing.T, repos *repository.Repositories, transcoder Transcoder, clientChan chan string) (string, error) {
+	t.Helper()
+	chdirTemp(t)
+	ctx := context.Background()
+
+	for _, dir := range []string{"uploads", "transcoded"} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	videoID, err := repository.NewID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join("uploads", videoID), []byte("source video"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := repos.Videos.Create(ctx, &repository.Video{ID: videoID, Filename: "talk.mp4", Status: repository.VideoStatusQueued}); err != nil {
+		t.Fatal(err)
+	}
+
+	jobs := make(chan Job, 10)
+	results := make(chan error, 10)
+	pool := NewWorkerPool(1, testRenditions, jobs, results, transcoder, repos, OutputOptions{UploadWorkers: 2})
+	pool.Start()
+	t.Cleanup(func() { pool.Shutdown(context.Background()) })
+
+	err = EnqueueJob(ctx, repos, jobs, Job{
+		UploadPath:     "uploads",
+		TranscodedPath: "transcoded",
+		Filename:       videoID,
+		Name:           "talk.mp4",
+		ClientChan:     clientChan,
+	})
+	if err != nil {
+		t.Fatalf("EnqueueJob: %v", err)
+	}
+
+	select {
+	case err = <-results:
+	case <-time.After(10 * time.Second):
+		t.Fatal("job did not finish")
+	}
+	return videoID, err
+}
+
+// checkJobOutcome checks the status of the only job and of the video it produced.
+func checkJobOutcome(t *testing.T, repos *repository.Repositories, videoID string, jobStatus string, videoStatus string) {
+	t.Helper()
+	ctx := context.Background()
+
+	records, err := repos.Jobs.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("got %d jobs, want 1", len(records))
+	}
+	if record := records[0]; record.VideoID != videoID || record.Status != jobStatus || record.Attempts != 1 {
+		t.Errorf("job is %+v, want status %s after 1 attempt for video %s", record, jobStatus, videoID)
+	}
+
+	video, err := repos.Videos.Get(ctx, videoID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if video.Status != videoStatus {
+		t.Errorf("video status is %s, want %s", video.Status, videoStatus)
+	}
+}
+
+// storedNames returns the names of the stored media files, sorted.
+func storedNames(t *testing.T, repos *repository.Repositories) []string {
+	t.Helper()
+	files, err := repos.Media.List(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, len(files))
+	for i, file := range files {
+		names[i] = file.Name
+	}
+	slices.Sort(names)
+	return names
+}
+
+// renditionFiles returns the names the fake transcoder's output of a rendition is stored under.
+func renditionFiles(rendition string, videoID string) []string {
+	prefix := "./transcoded/" + rendition + "/" + videoID
+	return []string{
+		prefix + "/m3u8/" + rendition + ".m3u8",
+		prefix + "/m3u8/" + rendition + "_iframes.m3u8",
+		prefix + "/ts/" + rendition + "_000.ts",
+		prefix + "/ts/" + rendition + "_001.ts",
+		prefix + "/ts/" + rendition + "_002.ts",
+	}
+}
+
+func TestWorkerPoolTranscodesUpload(t *testing.T) {
+	clientChan := statusClient(t)
+	transcoder := &FakeTranscoder{}
+	repos := repository.NewMemoryRepositories()
+	videoID, err := runUploadJob(t, repos, transcoder, clientChan)
+	if err != nil {
+		t.Fatalf("job failed: %v", err)
+	}
+
+	checkJobOutcome(t, repos, videoID, repository.JobStatusSucceeded, repository.VideoStatusReady)
+
+	want := append(renditionFiles("480p", videoID), renditionFiles("720p", videoID)...)
+	if got := storedNames(t, repos); !slices.Equal(got, want) {
+		t.Errorf("stored files are\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// The stored playlists are the finished VOD playlists, not the event playlists ffmpeg grows
+	playlist, err := readMediaFile(context.Background(), repos.Media, mediaPlaylistName("transcoded", testRenditions[0], videoID, "480p.m3u8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(playlist, "#EXT-X-PLAYLIST-TYPE:VOD") || !strings.HasSuffix(playlist, "#EXT-X-ENDLIST\n") {
+		t.Errorf("stored playlist is not a finished VOD playlist:\n%s", playlist)
+	}
+	if segments := parseMediaPlaylist(playlist); len(segments) != 3 {
+		t.Errorf("stored playlist lists %d segments, want 3", len(segments))
+	}
+
+	// The local output is deleted once it is stored
+	if _, err := os.Stat(filepath.Join("transcoded", "480p", videoID)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("local output of 480p was not deleted: %v", err)
+	}
+
+	if requests := transcoder.Requests(); len(requests) != 1 || requests[0].InputPath != filepath.Join("uploads", videoID) {
+		t.Errorf("transcoder got requests %+v, want one for %s", requests, videoID)
+	}
+
+	wantEvents := []string{
+		"TS-" + videoID + ":talk.mp4:OK",
+		"T4-" + videoID + ":talk.mp4:OK",
+		"T7-" + videoID + ":talk.mp4:OK",
+		"TC-" + videoID + ":talk.mp4:OK",
+	}
+	if got := receivedEvents(clientChan); !slices.Equal(got, wantEvents) {
+		t.Errorf("status events are %v, want %v", got, wantEvents)
+	}
+}
+
+func TestWorkerPoolFailsJobWithFailedRendition(t *testing.T) {
+	clientChan := statusClient(t)
+	transcoder := &FakeTranscoder{Fail: map[string]error{"720p": errors.New("encoder crashed")}}
+	repos := repository.NewMemoryRepositories()
+	videoID, err := runUploadJob(t, repos, transcoder, clientChan)
+	if err == nil || !strings.Contains(err.Error(), "encoder crashed") {
+		t.Fatalf("job returned %v, want the 720p failure", err)
+	}
+
+	checkJobOutcome(t, repos, videoID, repository.JobStatusFailed, repository.VideoStatusFailed)
+
+	// The rendition that succeeded is still stored
+	if got, want := storedNames(t, repos), renditionFiles("480p", videoID); !slices.Equal(got, want) {
+		t.Errorf("stored files are %v, want %v", got, want)
+	}
+
+	events := receivedEvents(clientChan)
+	if len(events) != 3 || events[0] != "TS-"+videoID+":talk.mp4:OK" || events[1] != "T4-"+videoID+":talk.mp4:OK" ||
+		!strings.HasPrefix(events[2], "TF-"+videoID+":talk.mp4:") {
+		t.Errorf("status events are %v, want TS, T4 and TF", events)
+	}
+}
+
+func TestWorkerPoolFailsJobWithoutSource(t *testing.T) {
+	clientChan := statusClient(t)
+	transcoder := &FakeTranscoder{}
+	repos := repository.NewMemoryRepositories()
+	videoID, err := runUploadJob(t, repos, &missingSource{transcoder}, clientChan)
+	if err == nil {
+		t.Fatal("job succeeded without a source file")
+	}
+
+	checkJobOutcome(t, repos, videoID, repository.JobStatusFailed, repository.VideoStatusFailed)
+	if names := storedNames(t, repos); len(names) != 0 {
+		t.Errorf("stored %v for a job that had no source", names)
+	}
+	if events := receivedEvents(clientChan); len(events) != 2 || !strings.HasPrefix(events[1], "TF-") {
+		t.Errorf("status events are %v, want TS and TF", events)
+	}
+}
+
+// missingSource deletes the source file before handing the request to its transcoder.
+type missingSource struct {
+	Transcoder
+}
+
+func (m *missingSource) Transcode(ctx context.Context, req TranscodeRequest, progress func(TranscodeProgress)) error {
+	if err := os.Remove(req.InputPath); err != nil {
+		return err
+	}
+	return m.Transcoder.Transcode(ctx, req, progress)
+}
+
+func TestWorkerPoolKeepsCancellationOfRunningJob(t *testing.T) {
+	clientChan := statusClient(t)
+	repos := repository.NewMemoryRepositories()
+	// The job is cancelled while it runs, long before the worker polls its record
+	transcoder := &cancellingTranscoder{Transcoder: &FakeTranscoder{}, repos: repos}
+	videoID, err := runUploadJob(t, repos, transcoder, clientChan)
+	if !errors.Is(err, errJobCancelled) {
+		t.Fatalf("job returned %v, want it cancelled", err)
+	}
+
+	records, err := repos.Jobs.List(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Status != repository.JobStatusCancelled {
+		t.Errorf("jobs are %+v, want the job cancelled", records)
+	}
+	if video, err := repos.Videos.Get(context.Background(), videoID); err != nil || video.Status != repository.VideoStatusFailed {
+		t.Errorf("video is %+v, %v; want it failed by the cancellation", video, err)
+	}
+	events := receivedEvents(clientChan)
+	if len(events) == 0 || events[len(events)-1] != "TF-"+videoID+":talk.mp4:"+errJobCancelled.Error() {
+		t.Errorf("status events are %v, want them to end with the cancellation", events)
+	}
+}
+
+// cancellingTranscoder cancels the running job with CancelJob before handing the request to
+// its transcoder.
+type cancellingTranscoder struct {
+	Transcoder
+	repos *repository.Repositories
+}
+
+func (c *cancellingTranscoder) Transcode(ctx context.Context, req TranscodeRequest, progress func(TranscodeProgress)) error {
+	records, err := c.repos.Jobs.List(ctx, repository.JobStatusRunning)
+	if err != nil || len(records) != 1 {
+		return fmt.Errorf("running jobs are %+v, %v; want one", records, err)
+	}
+	if err := CancelJob(ctx, c.repos, records[0].ID); err != nil {
+		return err
+	}
+	return c.Transcoder.Transcode(ctx, req, progress)
+}
+
+func TestWorkerPoolSkipsJobCancelledInQueue(t *testing.T) {
+	chdirTemp(t)
+	ctx := context.Background()
+	repos := repository.NewMemoryRepositories()
+	if err := repos.Videos.Create(ctx, &repository.Video{ID: "video", Filename: "talk.mp4", Status: repository.VideoStatusQueued}); err != nil {
+		t.Fatal(err)
+	}
+	record := &repository.JobRecord{ID: "job", VideoID: "video", Status: repository.JobStatusQueued}
+	if err := repos.Jobs.Create(ctx, record); err != nil {
+		t.Fatal(err)
+	}
+
+	// The job is cancelled after the worker took it from the queue, but before it started it
+	transcoder := &FakeTranscoder{}
+	jobs := make(chan Job, 1)
+	results := make(chan error, 1)
+	pool := NewWorkerPool(1, testRenditions, jobs, results, transcoder, repos, OutputOptions{})
+	if err := CancelJob(ctx, repos, "job"); err != nil {
+		t.Fatal(err)
+	}
+	pool.Start()
+	t.Cleanup(func() { pool.Shutdown(context.Background()) })
+	jobs <- Job{ID: "job", UploadPath: "uploads", TranscodedPath: "transcoded", Filename: "video", Name: "talk.mp4"}
+
+	select {
+	case err := <-results:
+		if err != nil {
+			t.Errorf("skipped job returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("job was not skipped")
+	}
+	if requests := transcoder.Requests(); len(requests) != 0 {
+		t.Errorf("cancelled job was transcoded: %+v", requests)
+	}
+	if job, err := repos.Jobs.Get(ctx, "job"); err != nil || job.Status != repository.JobStatusCancelled || job.Attempts != 0 {
+		t.Errorf("job is %+v, %v; want it cancelled without an attempt", job, err)
+	}
+}
+
+func TestRecoverJobsSkipsJobsQueuedMeanwhile(t *testing.T) {
+	ctx := context.Background()
+	repos := repository.NewMemoryRepositories()
+	for _, id := range []string{"left-running", "left-queued", "new"} {
+		status := repository.JobStatusQueued
+		if id == "left-running" {
+			status = repository.JobStatusRunning
+		}
+		if err := repos.Jobs.Create(ctx, &repository.JobRecord{ID: id, VideoID: "video-" + id, Status: status}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The new job was queued by an upload while recovery ran
+	trackJob("new")
+	t.Cleanup(func() {
+		for _, id := range []string{"left-running", "left-queued", "new"} {
+			untrackJob(id)
+		}
+	})
+
+	jobs := make(chan Job, 10)
+	if err := RecoverJobs(ctx, repos, jobs, "uploads", "transcoded"); err != nil {
+		t.Fatal(err)
+	}
+	close(jobs)
+	var queued []string
+	for job := range jobs {
+		queued = append(queued, job.ID)
+	}
+	if !slices.Equal(queued, []string{"left-running", "left-queued"}) {
+		t.Errorf("recovered jobs %v, want left-running and left-queued", queued)
+	}
+	if job, err := repos.Jobs.Get(ctx, "left-running"); err != nil || job.Status != repository.JobStatusQueued {
+		t.Errorf("job left running is %+v, %v; want it queued again", job, err)
+	}
+}
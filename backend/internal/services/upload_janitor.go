@@ -0,0 +1,312 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"manhattan_tech_ventures/internal/logging"
+	"manhattan_tech_ventures/internal/metrics"
+	"manhattan_tech_ventures/internal/repository"
+
+	"github.com/tus/tusd/v2/pkg/filelocker"
+	"github.com/tus/tusd/v2/pkg/filestore"
+)
+
+// terminateTimeout bounds how long terminating an upload waits for the request writing to it
+// to let go of its lock. tusd only checks for release requests every few seconds.
+const terminateTimeout = 30 * time.Second
+
+// terminateUpload deletes an upload of the tus filestore in dir the way a tus DELETE request
+// would. Any request still writing to the upload is asked to stop first; the client's next
+// request for it fails with 404.
+func terminateUpload(ctx context.Context, dir string, id string) error {
+	store := filestore.New(dir)
+	lock, err := filelocker.New(dir).NewLock(id)
+	if err != nil {
+		return fmt.Errorf("failed to create upload lock: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, terminateTimeout)
+	defer cancel()
+	if err := lock.Lock(ctx, func() {}); err != nil {
+		return fmt.Errorf("failed to lock upload: %v", err)
+	}
+	defer lock.Unlock()
+
+	upload, err := store.GetUpload(ctx, id)
+	if err != nil {
+		return fmt.Errorf("failed to find upload: %v", err)
+	}
+	if err := store.AsTerminatableUpload(upload).Terminate(ctx); err != nil {
+		return fmt.Errorf("failed to terminate upload: %v", err)
+	}
+	return nil
+}
+
+// uploadState is what the tus filestore knows about an upload.
+type uploadState struct {
+	ID           string    // Upload ID, also the name of its data file
+	Size         int64     // Declared size of the upload in bytes
+	Received     int64     // Bytes received so far
+	LastActivity time.Time // Time the upload was created or last received data
+	Complete     bool      // Whether all of the upload's data was received
+}
+
+// readUploadState reads the state of an upload from its info and data files in dir.
+func readUploadState(dir string, id string) (uploadState, error) {
+	infoPath := filepath.Join(dir, id+".info")
+	data, err := os.ReadFile(infoPath)
+	if err != nil {
+		return uploadState{}, err
+	}
+	var info struct {
+		Size           int64
+		SizeIsDeferred bool
+	}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return uploadState{}, fmt.Errorf("failed to parse %s: %v", infoPath, err)
+	}
+
+	state := uploadState{ID: id, Size: info.Size}
+	if stat, err := os.Stat(infoPath); err == nil {
+		state.LastActivity = stat.ModTime()
+	}
+	if stat, err := os.Stat(filepath.Join(dir, id)); err == nil {
+		state.Received = stat.Size()
+		if stat.ModTime().After(state.LastActivity) {
+			state.LastActivity = stat.ModTime()
+		}
+	}
+	state.Complete = !info.SizeIsDeferred && state.Received >= state.Size
+	return state, nil
+}
+
+// ExpireUploads is a middleware for the TUS handler that implements the tus expiration
+// extension, which tusd does not provide. Responses to requests creating, writing to or
+// checking an unfinished upload carry its Upload-Expires time: expiry after it last received
+// data, when the UploadJanitor deletes it. The extension is advertised in the Tus-Extension
+// header. An expiry of 0 disables the middleware.
+func ExpireUploads(uploadPath string, expiry time.Duration, next http.Handler) http.Handler {
+	if expiry <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&expiresWriter{ResponseWriter: w, request: r, uploadPath: uploadPath, expiry: expiry}, r)
+	})
+}
+
+// expiresWriter adds the headers of the tus expiration extension to a tusd response just
+// before its header is written.
+type expiresWriter struct {
+	http.ResponseWriter
+	request     *http.Request
+	uploadPath  string
+	expiry      time.Duration
+	wroteHeader bool
+}
+
+// WriteHeader adds the expiration headers and writes the response header.
+func (w *expiresWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	header := w.Header()
+
+	if extensions := header.Get("Tus-Extension"); extensions != "" {
+		header.Set("Tus-Extension", extensions+",expiration")
+	}
+
+	// The upload is named by the Location of a new upload and by the path otherwise
+	var id string
+	switch {
+	case w.request.Method == http.MethodPost && status == http.StatusCreated:
+		id = path.Base(header.Get("Location"))
+	case (w.request.Method == http.MethodPatch && status == http.StatusNoContent) ||
+		(w.request.Method == http.MethodHead && status == http.StatusOK):
+		id = strings.Trim(w.request.URL.Path, "/")
+	}
+	if id != "" && !strings.ContainsAny(id, `/\.`) {
+		if state, err := readUploadState(w.uploadPath, id); err == nil && !state.Complete {
+			header.Set("Upload-Expires", state.LastActivity.Add(w.expiry).UTC().Format(http.TimeFormat))
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write writes response body data, writing the header first if needed.
+func (w *expiresWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Unwrap returns the wrapped writer, so tusd can still control read and write deadlines.
+func (w *expiresWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// SweepReport sums up what one sweep of the UploadJanitor deleted.
+type SweepReport struct {
+	ExpiredUploads int   // Unfinished uploads deleted because they expired
+	Sources        int   // Source files of ready videos deleted after the retention period
+	ReclaimedBytes int64 // Disk space freed, in bytes
+}
+
+// UploadJanitor reclaims the disk space taken in the upload path by uploads that were
+// abandoned before they finished and, optionally, by the source files of videos that were
+// transcoded successfully. Sources are needed to cut clips and join videos, so they are kept
+// unless a retention period is set.
+type UploadJanitor struct {
+	UploadPath      string                   // Path the tus filestore keeps uploads in
+	Expiry          time.Duration            // Unfinished uploads that received no data for this long are deleted, 0 keeps them
+	SourceRetention time.Duration            // Sources of ready videos are deleted this long after the video became ready, 0 keeps them
+	Interval        time.Duration            // Time between sweeps
+	Repos           *repository.Repositories // Catalog and job queue, to find ready videos and the sources jobs still need
+}
+
+// Run sweeps the upload path every Interval until ctx is cancelled. It returns at once if
+// there is nothing to clean up.
+func (j *UploadJanitor) Run(ctx context.Context) {
+	if j.Expiry <= 0 && j.SourceRetention <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(j.Interval)
+	defer ticker.Stop()
+	for {
+		report, err := j.Sweep(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("Upload janitor sweep failed", "error", err)
+		}
+		if report.ExpiredUploads > 0 || report.Sources > 0 {
+			slog.Info("Upload janitor reclaimed space",
+				"expired_uploads", report.ExpiredUploads, "sources", report.Sources, "reclaimed_bytes", report.ReclaimedBytes)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sweep deletes the expired uploads and the sources past their retention once, reporting
+// what was deleted even when it stops early because of an error.
+func (j *UploadJanitor) Sweep(ctx context.Context) (SweepReport, error) {
+	var report SweepReport
+	if j.Expiry > 0 {
+		if err := j.sweepExpiredUploads(ctx, &report); err != nil {
+			return report, err
+		}
+	}
+	if j.SourceRetention > 0 {
+		if err := j.sweepSources(ctx, &report); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// sweepExpiredUploads deletes the unfinished uploads that received no data for Expiry.
+func (j *UploadJanitor) sweepExpiredUploads(ctx context.Context, report *SweepReport) error {
+	infos, err := filepath.Glob(filepath.Join(j.UploadPath, "*.info"))
+	if err != nil {
+		return fmt.Errorf("failed to list uploads: %v", err)
+	}
+
+	for _, infoPath := range infos {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		id := strings.TrimSuffix(filepath.Base(infoPath), ".info")
+		logger := slog.Default().With(logging.UploadIDKey, id)
+
+		state, err := readUploadState(j.UploadPath, id)
+		if err != nil {
+			logger.Warn("Failed to read upload", "error", err)
+			continue
+		}
+		if state.Complete || time.Since(state.LastActivity) < j.Expiry {
+			continue
+		}
+
+		if err := terminateUpload(ctx, j.UploadPath, id); err != nil {
+			logger.Warn("Failed to delete expired upload", "error", err)
+			continue
+		}
+		logger.Info("Deleted expired upload", "received_bytes", state.Received, "size", state.Size, "last_activity", state.LastActivity)
+		report.ExpiredUploads++
+		report.ReclaimedBytes += state.Received
+		metrics.JanitorFilesDeleted.WithLabelValues("expired_upload").Inc()
+		metrics.JanitorReclaimedBytes.WithLabelValues("expired_upload").Add(float64(state.Received))
+	}
+	return nil
+}
+
+// sweepSources deletes the source files of videos that have been ready for SourceRetention,
+// except those a queued or running job still has to read.
+func (j *UploadJanitor) sweepSources(ctx context.Context, report *SweepReport) error {
+	inUse := make(map[string]bool)
+	for _, status := range []string{repository.JobStatusQueued, repository.JobStatusRunning} {
+		records, err := j.Repos.Jobs.List(ctx, status)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			inUse[record.VideoID] = true
+			if record.Clip != nil {
+				inUse[record.Clip.ParentFilename] = true
+			}
+			if record.Concat != nil {
+				for _, source := range record.Concat.SourceFilenames {
+					inUse[source] = true
+				}
+			}
+		}
+	}
+
+	videos, err := j.Repos.Videos.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, video := range videos {
+		if video.Status != repository.VideoStatusReady || inUse[video.ID] || time.Since(video.UpdatedAt) < j.SourceRetention {
+			continue
+		}
+
+		sourcePath := filepath.Join(j.UploadPath, video.ID)
+		stat, err := os.Stat(sourcePath)
+		if errors.Is(err, os.ErrNotExist) {
+			continue // Already deleted by an earlier sweep
+		} else if err != nil {
+			slog.Warn("Failed to read video source", logging.UploadIDKey, video.ID, "error", err)
+			continue
+		}
+		if err := os.Remove(sourcePath); err != nil {
+			slog.Warn("Failed to delete video source", logging.UploadIDKey, video.ID, "error", err)
+			continue
+		}
+		// The upload's metadata is kept on the video record, so its info file can go as well
+		if err := os.Remove(sourcePath + ".info"); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("Failed to delete upload info", logging.UploadIDKey, video.ID, "error", err)
+		}
+
+		slog.Info("Deleted video source after retention period", logging.UploadIDKey, video.ID, "size", stat.Size())
+		report.Sources++
+		report.ReclaimedBytes += stat.Size()
+		metrics.JanitorFilesDeleted.WithLabelValues("source").Inc()
+		metrics.JanitorReclaimedBytes.WithLabelValues("source").Add(float64(stat.Size()))
+	}
+	return nil
+}
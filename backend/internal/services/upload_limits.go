@@ -0,0 +1,277 @@
+package service
+
+import (
+	"context"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"manhattan_tech_ventures/internal/config"
+	"manhattan_tech_ventures/internal/logging"
+	"manhattan_tech_ventures/internal/repository"
+
+	"github.com/tus/tusd/v2/pkg/handler"
+)
+
+// uploadIdleTimeout is how long an upload may go without receiving data before it stops counting
+// against its user's concurrent upload limit and quota, e.g. because the client gave up on it.
+const uploadIdleTimeout = 15 * time.Minute
+
+// Errors returned to tus clients whose upload is rejected at creation. The size limit itself
+// is enforced by tusd, which answers with handler.ErrMaxSizeExceeded.
+var (
+	errMissingFileInfo    = handler.NewError("ERR_MISSING_FILE_INFO", "filename or filetype metadata is required", http.StatusBadRequest)
+	errUnsupportedType    = handler.NewError("ERR_UNSUPPORTED_FILETYPE", "file type is not accepted", http.StatusUnsupportedMediaType)
+	errLengthRequired     = handler.NewError("ERR_UPLOAD_LENGTH_REQUIRED", "upload length must be declared when the upload is created", http.StatusBadRequest)
+	errQuotaExceeded      = handler.NewError("ERR_QUOTA_EXCEEDED", "upload exceeds the remaining storage quota", http.StatusRequestEntityTooLarge)
+	errTooManyUploads     = handler.NewError("ERR_TOO_MANY_UPLOADS", "too many uploads in progress", http.StatusTooManyRequests)
+	errQuotaCheckFailed   = handler.NewError("ERR_INTERNAL_SERVER_ERROR", "failed to check storage quota", http.StatusInternalServerError)
+	errIDGenerationFailed = handler.NewError("ERR_INTERNAL_SERVER_ERROR", "failed to create upload ID", http.StatusInternalServerError)
+)
+
+// UploadLimits checks new tus uploads against the configured limits before they are created.
+// Uploads that pass are reserved under their ID until they complete, are terminated or go
+// idle, so uploads created at the same time cannot overrun a user's limits together. Imports
+// reserve their size in the same ledger, so they count against the quota like uploads.
+type UploadLimits struct {
+	types       []string                   // Accepted MIME types; "video/*" accepts every video type
+	extensions  []string                   // Accepted file name extensions, lower case with the dot
+	quota       int64                      // Storage each user may use in bytes, 0 for no limit
+	concurrency int                        // Uploads each user may have in progress, 0 for no limit
+	users       *RequestUsers              // Names the user an upload is made for
+	videos      repository.VideoRepository // Catalog the storage used by finished uploads is summed from
+
+	mu     sync.Mutex
+	active map[string]*activeUpload // Uploads in progress, by upload ID
+}
+
+// activeUpload is an upload that was created and has not finished yet.
+type activeUpload struct {
+	owner      string    // User the upload counts against
+	size       int64     // Declared size of the upload in bytes
+	lastActive time.Time // Time the upload was created or last received data
+	importing  bool      // Whether it is an import, which is held until it finishes and not counted as an upload
+}
+
+// NewUploadLimits creates the upload limits of the configuration, shared by the tus handler
+// and the importer.
+func NewUploadLimits(conf config.Config, videos repository.VideoRepository) *UploadLimits {
+	extensions := make([]string, len(conf.UploadExtensions))
+	for i, extension := range conf.UploadExtensions {
+		extensions[i] = strings.ToLower(extension)
+	}
+	return &UploadLimits{
+		types:       conf.UploadTypes,
+		extensions:  extensions,
+		quota:       int64(conf.UploadQuotaMB) * 1024 * 1024,
+		concurrency: conf.UploadConcurrency,
+		users:       NewRequestUsers(conf),
+		videos:      videos,
+		active:      make(map[string]*activeUpload),
+	}
+}
+
+// owner returns the user a request is made for (see RequestUsers).
+func (l *UploadLimits) owner(r handler.HTTPRequest) string {
+	return l.users.User(r.Header, r.RemoteAddr)
+}
+
+// RequestUsers names the users requests are made for, so limits can be applied per user.
+// Clients can send any header they like, so the user header is only read from requests made
+// by a trusted proxy, such as an authenticating proxy that sets it; every other request is
+// made for the client's address.
+type RequestUsers struct {
+	header  string         // Request header naming the user, empty to always use the address
+	proxies []netip.Prefix // Addresses of the proxies trusted to set the header
+}
+
+// NewRequestUsers names users by the user header and trusted proxies of the configuration.
+func NewRequestUsers(conf config.Config) *RequestUsers {
+	proxies, _ := conf.TrustedProxyPrefixes() // Checked when the configuration was loaded
+	return &RequestUsers{header: conf.UploadUserHeader, proxies: proxies}
+}
+
+// User returns the user a request is made for: the value of the user header if the request
+// comes from a trusted proxy and carries it, and the client's address otherwise.
+func (u *RequestUsers) User(header http.Header, remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	if u.header == "" {
+		return host
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !slices.ContainsFunc(u.proxies, func(proxy netip.Prefix) bool { return proxy.Contains(addr.Unmap()) }) {
+		return host
+	}
+	if user := strings.TrimSpace(header.Get(u.header)); user != "" {
+		return user
+	}
+	return host
+}
+
+// ownerOf returns the user an upload was reserved for, falling back to the user of request r
+// when the upload is not reserved (e.g. because the server restarted while it was in progress).
+func (l *UploadLimits) ownerOf(id string, r handler.HTTPRequest) string {
+	l.mu.Lock()
+	upload, ok := l.active[id]
+	l.mu.Unlock()
+	if ok {
+		return upload.owner
+	}
+	return l.owner(r)
+}
+
+// checkType makes sure an upload declares a file name or type and that whatever it declares is
+// accepted. A generic "application/octet-stream" type, which browsers send for containers they
+// do not know, is left to the file name's extension.
+func (l *UploadLimits) checkType(metadata UploadMetadata) error {
+	if len(l.types) == 0 && len(l.extensions) == 0 {
+		return nil
+	}
+
+	fileType, _, _ := mime.ParseMediaType(metadata.FileType)
+	if fileType == "application/octet-stream" {
+		fileType = ""
+	}
+	if fileType == "" && metadata.Filename == "" {
+		return errMissingFileInfo
+	}
+	if fileType != "" && len(l.types) > 0 && !slices.ContainsFunc(l.types, func(allowed string) bool {
+		prefix, wildcard := strings.CutSuffix(strings.ToLower(allowed), "*")
+		return fileType == prefix || (wildcard && strings.HasPrefix(fileType, prefix))
+	}) {
+		return errUnsupportedType
+	}
+	if metadata.Filename != "" && len(l.extensions) > 0 && !slices.Contains(l.extensions, strings.ToLower(path.Ext(metadata.Filename))) {
+		return errUnsupportedType
+	}
+	return nil
+}
+
+// PreUploadCreate is the tus PreUploadCreateCallback. It rejects uploads of a type that is
+// not accepted, or that would take their user over the quota or the concurrent upload limit,
+// with a tus error. Accepted uploads are given their ID here so they can be reserved under it.
+func (l *UploadLimits) PreUploadCreate(hook handler.HookEvent) (handler.HTTPResponse, handler.FileInfoChanges, error) {
+	logger := logging.FromContext(hook.Context)
+	metadata := ParseUploadMetadata(hook.Upload.MetaData)
+	owner := l.owner(hook.HTTPRequest)
+
+	if err := l.checkType(metadata); err != nil {
+		logger.Info("Rejected upload", "reason", "file type", "filename", metadata.Filename, "filetype", metadata.FileType)
+		return handler.HTTPResponse{}, handler.FileInfoChanges{}, err
+	}
+	if hook.Upload.SizeIsDeferred && l.quota > 0 {
+		return handler.HTTPResponse{}, handler.FileInfoChanges{}, errLengthRequired
+	}
+
+	// Storage taken by finished uploads; read before locking, as it may take a round trip
+	var used int64
+	if l.quota > 0 {
+		var err error
+		if used, err = l.videos.StorageUsed(hook.Context, owner); err != nil {
+			logger.Error("Failed to read storage used", "owner", owner, "error", err)
+			return handler.HTTPResponse{}, handler.FileInfoChanges{}, errQuotaCheckFailed
+		}
+	}
+
+	id, err := repository.NewID()
+	if err != nil {
+		return handler.HTTPResponse{}, handler.FileInfoChanges{}, errIDGenerationFailed
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	var inProgress int
+	for uploadID, upload := range l.active {
+		switch {
+		case !upload.importing && now.Sub(upload.lastActive) > uploadIdleTimeout:
+			delete(l.active, uploadID)
+		case upload.owner == owner:
+			if !upload.importing {
+				inProgress++
+			}
+			used += upload.size
+		}
+	}
+
+	if l.concurrency > 0 && inProgress >= l.concurrency {
+		logger.Info("Rejected upload", "reason", "concurrency", "owner", owner, "in_progress", inProgress)
+		rejection := errTooManyUploads
+		rejection.HTTPResponse.Header = handler.HTTPHeader{"Retry-After": "60"}
+		return handler.HTTPResponse{}, handler.FileInfoChanges{}, rejection
+	}
+	if l.quota > 0 && used+hook.Upload.Size > l.quota {
+		logger.Info("Rejected upload", "reason", "quota", "owner", owner, "used", used, "size", hook.Upload.Size)
+		return handler.HTTPResponse{}, handler.FileInfoChanges{}, errQuotaExceeded
+	}
+
+	l.active[id] = &activeUpload{owner: owner, size: hook.Upload.Size, lastActive: now}
+	return handler.HTTPResponse{}, handler.FileInfoChanges{ID: id}, nil
+}
+
+// reserveImport checks that an import of size bytes keeps owner within the quota, counting the
+// storage of finished uploads and the size of every upload and import in progress, and reserves
+// the size under the ID of the imported video until it is released. An import that is already
+// reserved is checked again with its new size, once the size of its source is known.
+func (l *UploadLimits) reserveImport(ctx context.Context, id string, owner string, size int64) error {
+	if l.quota <= 0 {
+		return nil
+	}
+	logger := logging.FromContext(ctx)
+
+	// Storage taken by finished uploads; read before locking, as it may take a round trip
+	used, err := l.videos.StorageUsed(ctx, owner)
+	if err != nil {
+		logger.Error("Failed to read storage used", "owner", owner, "error", err)
+		return errQuotaCheckFailed
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for uploadID, upload := range l.active {
+		switch {
+		case uploadID == id:
+			// Its previous size is replaced
+		case !upload.importing && now.Sub(upload.lastActive) > uploadIdleTimeout:
+			delete(l.active, uploadID)
+		case upload.owner == owner:
+			used += upload.size
+		}
+	}
+
+	if used+size > l.quota {
+		logger.Info("Rejected import", "reason", "quota", "owner", owner, "used", used, "size", size)
+		return errQuotaExceeded
+	}
+	l.active[id] = &activeUpload{owner: owner, size: size, lastActive: now, importing: true}
+	return nil
+}
+
+// touch records that an upload received data.
+func (l *UploadLimits) touch(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if upload, ok := l.active[id]; ok {
+		upload.lastActive = time.Now()
+	}
+}
+
+// release ends the reservation of an upload or import that completed, failed or was terminated.
+func (l *UploadLimits) release(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.active, id)
+}
@@ -0,0 +1,42 @@
+package service
+
+import (
+	"net/http"
+	"testing"
+
+	"manhattan_tech_ventures/internal/config"
+)
+
+func TestRequestUsersTrustOnlyProxies(t *testing.T) {
+	conf := config.Default()
+	conf.UploadUserHeader = "X-User-ID"
+	conf.TrustedProxies = []string{"10.0.0.1", "192.168.0.0/16"}
+	users := NewRequestUsers(conf)
+	header := http.Header{"X-User-Id": []string{"alice"}}
+
+	tests := []struct {
+		name       string
+		header     http.Header
+		remoteAddr string
+		want       string
+	}{
+		{"trusted proxy", header, "10.0.0.1:4000", "alice"},
+		{"trusted proxy range", header, "192.168.3.4:4000", "alice"},
+		{"trusted proxy over IPv6", header, "[::ffff:10.0.0.1]:4000", "alice"},
+		{"trusted proxy without header", http.Header{}, "10.0.0.1:4000", "10.0.0.1"},
+		{"untrusted client", header, "10.0.0.2:4000", "10.0.0.2"},
+		{"address without port", header, "10.0.0.2", "10.0.0.2"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := users.User(test.header, test.remoteAddr); got != test.want {
+				t.Errorf("User = %q, want %q", got, test.want)
+			}
+		})
+	}
+
+	// Without a user header every user is named by their address
+	if got := NewRequestUsers(config.Default()).User(header, "10.0.0.1:4000"); got != "10.0.0.1" {
+		t.Errorf("default configuration names the user %q, want the address", got)
+	}
+}
@@ -0,0 +1,138 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// sniffLength is the number of bytes at the start of an upload that are needed to recognise
+// its container. Three MPEG-TS packets are the longest signature checked.
+const sniffLength = 3 * 188
+
+var (
+	// errNotVideo is reported for uploads whose first bytes are not those of a supported container.
+	errNotVideo = errors.New("upload is not a supported video container")
+
+	// errAlreadyRejected is reported when an upload that was found not to be a video is checked again.
+	errAlreadyRejected = errors.New("upload was already rejected")
+)
+
+// isVideoContainer reports whether head, the first bytes of a file, starts like one of the
+// video containers accepted for upload. head should hold sniffLength bytes unless the file is
+// shorter.
+func isVideoContainer(head []byte) bool {
+	switch {
+	case len(head) >= 8 && isQuickTimeAtom(head[4:8]): // MP4, MOV, M4V and 3GP
+		return true
+	case bytes.HasPrefix(head, []byte{0x1A, 0x45, 0xDF, 0xA3}): // Matroska and WebM (EBML header)
+		return true
+	case len(head) >= 12 && bytes.HasPrefix(head, []byte("RIFF")) && bytes.Equal(head[8:12], []byte("AVI ")):
+		return true
+	case bytes.HasPrefix(head, []byte("FLV\x01")):
+		return true
+	case bytes.HasPrefix(head, []byte{0x30, 0x26, 0xB2, 0x75, 0x8E, 0x66, 0xCF, 0x11}): // ASF (WMV)
+		return true
+	case bytes.HasPrefix(head, []byte{0x00, 0x00, 0x01, 0xBA}): // MPEG program stream pack header
+		return true
+	}
+	return hasSyncBytes(head, 0, 188) || hasSyncBytes(head, 4, 192)
+}
+
+// isQuickTimeAtom reports whether name is the type of an atom that starts ISO BMFF and
+// QuickTime files. Files written by older QuickTime versions have no ftyp atom.
+func isQuickTimeAtom(name []byte) bool {
+	switch string(name) {
+	case "ftyp", "moov", "mdat", "wide", "free", "skip", "pnot":
+		return true
+	}
+	return false
+}
+
+// hasSyncBytes reports whether head holds MPEG transport stream packets of the given size, each
+// starting with the 0x47 sync byte at offset within the packet (4 for M2TS timestamps). Every
+// packet head covers must have it, and at least one must.
+func hasSyncBytes(head []byte, offset int, packetSize int) bool {
+	found := false
+	for i := offset; i < len(head); i += packetSize {
+		if head[i] != 0x47 {
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
+// uploadSniffer checks the container signature of uploads as soon as their first bytes arrive,
+// so uploads that are clearly not videos can be stopped before the whole file is sent. The
+// filetype metadata a client declares is not trusted for this.
+type uploadSniffer struct {
+	uploadDir string // Directory the tus filestore keeps uploads in
+
+	mu      sync.Mutex
+	checked map[string]error // Outcome of the check of every upload checked so far; rejected uploads are never forgotten
+}
+
+// newUploadSniffer creates a sniffer for the uploads of a tus filestore.
+func newUploadSniffer(uploadDir string) *uploadSniffer {
+	return &uploadSniffer{uploadDir: uploadDir, checked: make(map[string]error)}
+}
+
+// check looks at the first bytes of an upload that has received offset of its size bytes. It
+// returns errNotVideo when they are not a video container, and nil when they are or when not
+// enough of the upload has arrived yet to tell. Every upload is only checked once: later calls
+// return nil, or errAlreadyRejected for an upload that was found not to be a video.
+func (s *uploadSniffer) check(id string, offset int64, size int64) (err error) {
+	need := int64(sniffLength)
+	if size > 0 && size < need {
+		need = size
+	}
+	if offset < need {
+		return nil
+	}
+
+	s.mu.Lock()
+	if result, done := s.checked[id]; done {
+		s.mu.Unlock()
+		if result != nil {
+			return errAlreadyRejected
+		}
+		return nil
+	}
+	s.checked[id] = nil
+	s.mu.Unlock()
+	defer func() {
+		if errors.Is(err, errNotVideo) {
+			s.mu.Lock()
+			s.checked[id] = err
+			s.mu.Unlock()
+		}
+	}()
+
+	file, err := os.Open(filepath.Join(s.uploadDir, id))
+	if err != nil {
+		return fmt.Errorf("failed to open upload: %v", err)
+	}
+	defer file.Close()
+
+	head := make([]byte, need)
+	if _, err := io.ReadFull(file, head); err != nil {
+		return fmt.Errorf("failed to read upload: %v", err)
+	}
+	if !isVideoContainer(head) {
+		return errNotVideo
+	}
+	return nil
+}
+
+// forget drops what the sniffer knows about an upload that completed or was terminated by
+// its client.
+func (s *uploadSniffer) forget(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.checked, id)
+}
@@ -1,18 +1,26 @@
 package service
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
-	"path/filepath"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"manhattan_tech_ventures/internal/config"
+	"manhattan_tech_ventures/internal/logging"
+	"manhattan_tech_ventures/internal/repository"
 	"manhattan_tech_ventures/internal/storage"
+	"manhattan_tech_ventures/internal/tracing"
 
 	"github.com/tus/tusd/v2/pkg/filelocker"
 	"github.com/tus/tusd/v2/pkg/filestore"
 	"github.com/tus/tusd/v2/pkg/handler"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 // UploadStatus represents the status of an upload, including the filename and its current status.
@@ -25,25 +33,108 @@ type UploadStatus struct {
 var (
 	// uploadStatusList keeps track of all upload statuses for reporting and monitoring purposes.
 	uploadStatusList []UploadStatus
+
+	// uploadStatusMu guards uploadStatusList, which is appended to from the tus event loops.
+	uploadStatusMu sync.Mutex
+
+	// uploadsStopped is set once the server starts shutting down, after which no new uploads are accepted.
+	uploadsStopped atomic.Bool
 )
 
-// HandleUpload initializes and handles the TUS upload process, including setting up the storage,
-// creating the handler, and managing the completion of uploads. It also integrates a worker pool
-// to process completed uploads.
-func HandleUpload(storageService storage.Storage, dbClient *mongo.Database) *handler.Handler {
+// recordUploadStatus appends an entry to the upload status list.
+func recordUploadStatus(filename string, status string) {
+	uploadStatusMu.Lock()
+	defer uploadStatusMu.Unlock()
+	uploadStatusList = append(uploadStatusList, UploadStatus{Filename: filename, Status: status})
+}
 
-	// Retrieve the base path for uploads from the local storage service
-	uploadDir := storageService.(*storage.LocalStorage).GetBasePath()
+// UploadMetadata is what a tus client told about an upload in its Upload-Metadata header when
+// it created it. Uppy sends the file name and type on its own and the web app sets them for
+// tus-js-client; the other fields are only there if the application added them.
+type UploadMetadata struct {
+	Filename    string            // Name of the file on the client, without any directories
+	FileType    string            // MIME type of the file as reported by the client
+	Title       string            // Title of the video
+	Description string            // Description of the video
+	Tags        []string          // Tags of the video, sent as a comma-separated list
+	ClientIDs   map[string]string // IDs the client attached to find the video again, e.g. "client_id" or "external_id"
+}
 
-	// Load configuration settings
-	conf := config.LoadConfig()
+// ParseUploadMetadata reads the metadata of a tus upload. The file name and type are taken
+// from the "filename" and "filetype" keys, falling back to "name" and "type" as sent by Uppy.
+// Every key ending in "_id" is kept as a client-provided ID.
+func ParseUploadMetadata(meta map[string]string) UploadMetadata {
+	metadata := UploadMetadata{
+		Filename:    cleanFilename(firstNonEmpty(meta["filename"], meta["name"])),
+		FileType:    strings.TrimSpace(firstNonEmpty(meta["filetype"], meta["type"])),
+		Title:       strings.TrimSpace(meta["title"]),
+		Description: strings.TrimSpace(meta["description"]),
+	}
+	for _, tag := range strings.Split(meta["tags"], ",") {
+		if tag = strings.TrimSpace(tag); tag != "" && !slices.Contains(metadata.Tags, tag) {
+			metadata.Tags = append(metadata.Tags, tag)
+		}
+	}
+	for key, value := range meta {
+		if value = strings.TrimSpace(value); strings.HasSuffix(key, "_id") && value != "" {
+			if metadata.ClientIDs == nil {
+				metadata.ClientIDs = make(map[string]string)
+			}
+			metadata.ClientIDs[key] = value
+		}
+	}
+	return metadata
+}
 
-	// Create channels for jobs and results to manage the worker pool
-	jobs := make(chan Job, 100)      // Buffered channel for jobs to process
-	results := make(chan error, 100) // Buffered channel for results from workers
+// cleanFilename strips the directories from a file name sent by a client, which may be a full
+// Windows or Unix path. It returns "" if no file name is left.
+func cleanFilename(name string) string {
+	name = path.Base(strings.ReplaceAll(strings.TrimSpace(name), `\`, "/"))
+	if name == "." || name == "/" {
+		return ""
+	}
+	return name
+}
 
-	// Start the worker pool to handle transcoding and uploading tasks
-	go WorkerPool(jobs, results)
+// firstNonEmpty returns the first of its arguments that is not empty.
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// StopAcceptingUploads makes UploadGate reject the creation of new uploads. Uploads that
+// are already in progress can still send their remaining data.
+func StopAcceptingUploads() {
+	uploadsStopped.Store(true)
+}
+
+// UploadGate is a middleware for the TUS handler that rejects requests creating new uploads
+// (POST) with 503 Service Unavailable once StopAcceptingUploads has been called. tus clients
+// treat this as a temporary error and retry, by which time another instance can take the upload.
+func UploadGate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && uploadsStopped.Load() {
+			w.Header().Set("Retry-After", "30")
+			http.Error(w, "Server is shutting down, not accepting new uploads", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// HandleUpload initializes and handles the TUS upload process, including setting up the storage,
+// creating the handler, and managing the completion of uploads. Completed uploads are registered
+// in the video catalog and queued on the jobs channel for the worker pool to process, using the
+// upload and output paths of the configuration. Uploads are checked against the size, type,
+// quota and concurrency limits when they are created.
+func HandleUpload(conf config.Config, storageService storage.Storage, repos *repository.Repositories, jobs chan<- Job, limits *UploadLimits) (*handler.Handler, error) {
+
+	// Retrieve the base path for uploads from the local storage service
+	uploadDir := storageService.(*storage.LocalStorage).GetBasePath()
 
 	// Set up file storage and locking mechanisms for TUS
 	store := filestore.New(uploadDir)   // Use filestore for TUS storage
@@ -54,63 +145,140 @@ func HandleUpload(storageService storage.Storage, dbClient *mongo.Database) *han
 	store.UseIn(composer)
 	locker.UseIn(composer)
 
+	// Uploads are stopped as soon as their first bytes show they are not videos
+	sniffer := newUploadSniffer(uploadDir)
+
+	// rejectUpload terminates an upload whose content is not a video and tells the client why
+	rejectUpload := func(event handler.HookEvent) {
+		filename := firstNonEmpty(ParseUploadMetadata(event.Upload.MetaData).Filename, event.Upload.ID)
+		logger := slog.Default().With(logging.UploadIDKey, event.Upload.ID)
+		logger.Warn("Rejecting upload", "filename", filename, "reason", errNotVideo)
+
+		if err := terminateUpload(context.Background(), uploadDir, event.Upload.ID); err != nil {
+			logger.Error("Failed to terminate rejected upload", "error", err)
+		}
+		limits.release(event.Upload.ID)
+		recordUploadStatus(filename, "Rejected")
+		SendStatusUpdateToClient(currClientChan, jobStatus("UC", event.Upload.ID, filename, errNotVideo.Error()))
+	}
+
+	// Browsers may read the expiration time ExpireUploads adds to responses
+	cors := handler.DefaultCorsConfig
+	cors.ExposeHeaders += ", Upload-Expires"
+
 	// Create a TUS handler with a configuration that includes the store composer
-	// and enables notification on completed uploads.
+	// and enables notifications on created, progressing, completed and terminated uploads.
 	tusHandler, err := handler.NewHandler(handler.Config{
-		BasePath:              "/files/", // Base path for handling file uploads
-		StoreComposer:         composer,  // Composer that includes file storage and locking
-		NotifyCompleteUploads: true,      // Enable notifications when uploads are complete
+		BasePath:                "/files/",                                 // Base path for handling file uploads
+		StoreComposer:           composer,                                  // Composer that includes file storage and locking
+		MaxSize:                 int64(conf.UploadMaxSizeMB) * 1024 * 1024, // Largest upload accepted, 0 for no limit
+		PreUploadCreateCallback: limits.PreUploadCreate,                    // Reject uploads that break the limits before they are created
+		NotifyCreatedUploads:    true,                                      // Enable notifications when uploads are created
+		NotifyUploadProgress:    true,                                      // Enable notifications while uploads receive data
+		NotifyCompleteUploads:   true,                                      // Enable notifications when uploads are complete
+		NotifyTerminatedUploads: true,                                      // Enable notifications when clients terminate uploads
+		Cors:                    &cors,                                     // Default CORS settings, exposing Upload-Expires
 	})
 
 	if err != nil {
-		log.Fatalf("unable to create handler: %s", err) // Log and terminate if the handler cannot be created
+		return nil, fmt.Errorf("unable to create handler: %v", err) // Report if the handler cannot be created
 	}
 
+	go func() {
+		// Update the upload status list to reflect the file is currently uploading
+		for event := range tusHandler.CreatedUploads {
+			filename := firstNonEmpty(ParseUploadMetadata(event.Upload.MetaData).Filename, event.Upload.ID)
+			recordUploadStatus(filename, "Uploading")
+		}
+	}()
+
+	go func() {
+		// Keep uploads that are receiving data from going idle, and check the content of new ones
+		for event := range tusHandler.UploadProgress {
+			limits.touch(event.Upload.ID)
+
+			err := sniffer.check(event.Upload.ID, event.Upload.Offset, event.Upload.Size)
+			if errors.Is(err, errNotVideo) {
+				go rejectUpload(event) // Waits for the request writing the upload to let go of it
+			} else if err != nil && !errors.Is(err, errAlreadyRejected) {
+				slog.Warn("Failed to check upload content", logging.UploadIDKey, event.Upload.ID, "error", err)
+			}
+		}
+	}()
+
+	go func() {
+		// Terminated uploads no longer count against their user's limits
+		for event := range tusHandler.TerminatedUploads {
+			limits.release(event.Upload.ID)
+			sniffer.forget(event.Upload.ID)
+		}
+	}()
+
 	go func() {
 		for event := range tusHandler.CompleteUploads {
-			uploadID := event.Upload.ID         // Get the unique ID of the completed upload
-			filename := filepath.Base(uploadID) // Extract the filename from the upload ID
+			uploadID := event.Upload.ID // Get the unique ID of the completed upload, also the name of the file in the upload path
+			metadata := ParseUploadMetadata(event.Upload.MetaData)
+			filename := firstNonEmpty(metadata.Filename, uploadID) // Name the client uploaded the file as
+
+			// Uploads that finished before their content was checked are checked now
+			err := sniffer.check(uploadID, event.Upload.Size, event.Upload.Size)
+			if errors.Is(err, errNotVideo) {
+				rejectUpload(event)
+				continue
+			} else if errors.Is(err, errAlreadyRejected) {
+				continue // Being terminated since its first bytes arrived
+			} else if err != nil {
+				slog.Warn("Failed to check upload content", logging.UploadIDKey, uploadID, "error", err)
+			}
+			sniffer.forget(uploadID)
+
+			// Start the trace that follows the upload through transcoding and storage
+			ctx, span := tracing.Start(context.Background(), "upload.complete",
+				tracing.UploadID.String(uploadID), tracing.FileSize.Int64(event.Upload.Size))
+			logger := slog.Default().With(logging.UploadIDKey, uploadID)
+			logger.Info("Upload completed", "size", event.Upload.Size, "filename", filename)
 
 			// Update the upload status list to reflect the file has been uploaded
-			uploadStatusList = append(uploadStatusList, UploadStatus{
-				Filename: filename,
-				Status:   "Uploaded",
-			})
+			recordUploadStatus(filename, "Uploaded")
+
+			// Register the upload in the video catalog so it can be looked up and clipped later
+			video := &repository.Video{
+				ID:          uploadID,
+				Filename:    filename,
+				FileType:    metadata.FileType,
+				Title:       metadata.Title,
+				Description: metadata.Description,
+				Tags:        metadata.Tags,
+				ClientIDs:   metadata.ClientIDs,
+				Owner:       limits.ownerOf(uploadID, event.HTTPRequest),
+				Size:        event.Upload.Size,
+				Status:      repository.VideoStatusQueued,
+			}
+			if err := repos.Videos.Create(ctx, video); err != nil {
+				logger.Error("Failed to register video", "error", err)
+			}
+
+			// The upload is now counted through its video, so its reservation can end
+			limits.release(uploadID)
 
 			// Send a status update to the client indicating the file has been uploaded
-			SendStatusUpdateToClient(currClientChan, fmt.Sprintf("UC-%s:OK", filename))
+			SendStatusUpdateToClient(currClientChan, jobStatus("UC", uploadID, filename, "OK"))
 
 			// Send a job to the worker pool for transcoding and further processing
-			jobs <- Job{
-				DBBucketName:   "media",                 // The GridFS bucket name in MongoDB
+			err = EnqueueJob(ctx, repos, jobs, Job{
 				UploadPath:     conf.UploadPath,         // Path where the uploaded file is stored
 				TranscodedPath: conf.TranscodedFilePath, // Path where the transcoded files will be stored
-				DBClient:       dbClient,                // MongoDB client used for interacting with GridFS
-				Filename:       filename,                // Name of the file to be processed
+				Filename:       uploadID,                // Name of the file to be processed
+				Name:           filename,                // Name shown in status updates
 				ClientChan:     currClientChan,          // Client channel for sending status updates
+			})
+			if err != nil {
+				logger.Error("Failed to queue transcode job", "error", err)
 			}
+			tracing.End(span, err)
 		}
 	}()
 
-	// Middleware to handle incoming TUS uploads
-	tusHandler.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-
-		// Extract the filename from the request query, defaulting to "unknown_filename" if not provided
-		filename := r.URL.Query().Get("filename")
-		if filename == "" {
-			filename = "unknown_filename"
-		}
-
-		// Update the upload status list to reflect the file is currently uploading
-		uploadStatusList = append(uploadStatusList, UploadStatus{
-			Filename: filename,
-			Status:   "Uploading",
-		})
-
-		// Serve the request through the TUS handler
-		tusHandler.ServeHTTP(w, r)
-	}))
-
 	// Return the configured TUS handler
-	return tusHandler
+	return tusHandler, nil
 }
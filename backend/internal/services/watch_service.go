@@ -0,0 +1,380 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"manhattan_tech_ventures/internal/logging"
+	"manhattan_tech_ventures/internal/metrics"
+	"manhattan_tech_ventures/internal/repository"
+	"manhattan_tech_ventures/internal/tracing"
+)
+
+const (
+	// watchRejectedDir is the subdirectory of the watch directory that files which cannot be
+	// ingested are moved to, each with a <name>.error file giving the reason.
+	watchRejectedDir = "rejected"
+
+	// watchCopyPrefix starts the names of files being copied from the watch directory into the
+	// upload path. Copies a crash left behind are deleted when the watcher starts.
+	watchCopyPrefix = ".watch-"
+)
+
+// watchSidecar is the optional JSON file next to a watched video, named <name>.json or, without
+// the video's extension, <stem>.json, that describes it.
+type watchSidecar struct {
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	Tags        []string `json:"tags"`
+}
+
+// watchedFile is what a scan of the watch directory saw of a file.
+type watchedFile struct {
+	size    int64     // Size of the file
+	modTime time.Time // Modification time of the file
+	since   time.Time // Time the file was first seen with this size and modification time
+}
+
+// WatchFolder ingests the video files other systems drop into a directory, e.g. an NFS share.
+// A file is taken once a <name>.done marker exists next to it or, unless markers are required,
+// once its size and modification time have not changed for SettleTime. It is moved into the
+// upload path, registered in the catalog with the title, description and tags of its sidecar,
+// if any, and queued for transcoding. At most Concurrency videos from the directory are queued
+// or transcoding at once; further files wait in the directory. Files that are not accepted
+// videos are moved to the rejected subdirectory.
+type WatchFolder struct {
+	Path           string                   // Directory that is watched
+	UploadPath     string                   // Path ingested source files are moved to
+	TranscodedPath string                   // Path jobs write their output to
+	Interval       time.Duration            // Time between scans
+	SettleTime     time.Duration            // How long a file without marker must stay unchanged
+	RequireDone    bool                     // Whether only files with a .done marker are taken
+	Concurrency    int                      // Videos from the directory queued or transcoding at once
+	Extensions     []string                 // Accepted file name extensions; empty accepts any
+	MaxSize        int64                    // Largest file accepted in bytes, 0 for no limit
+	Repos          *repository.Repositories // Catalog the videos are registered in
+	Jobs           chan<- Job               // Queue the transcode jobs are sent to
+
+	seen map[string]watchedFile // Files seen by the last scan, by name
+}
+
+// Run scans the watch directory every Interval until ctx is cancelled.
+func (w *WatchFolder) Run(ctx context.Context) {
+	if err := os.MkdirAll(filepath.Join(w.Path, watchRejectedDir), os.ModePerm); err != nil {
+		slog.Error("Failed to create watch directory", "path", w.Path, "error", err)
+		return
+	}
+	if copies, err := filepath.Glob(filepath.Join(w.UploadPath, watchCopyPrefix+"*")); err == nil {
+		for _, path := range copies {
+			os.Remove(path)
+		}
+	}
+	slog.Info("Watching directory for videos", "path", w.Path)
+
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+	for {
+		if err := w.Scan(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("Watch directory scan failed", "path", w.Path, "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Scan looks at the watch directory once and ingests the files that are complete, oldest
+// first, as far as Concurrency allows.
+func (w *WatchFolder) Scan(ctx context.Context) error {
+	entries, err := os.ReadDir(w.Path)
+	if err != nil {
+		return fmt.Errorf("failed to list watch directory: %v", err)
+	}
+	names := make(map[string]bool, len(entries))
+	stems := make(map[string]int, len(entries))
+	for _, entry := range entries {
+		names[entry.Name()] = true
+		stems[strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))]++
+	}
+
+	now := time.Now()
+	seen := make(map[string]watchedFile)
+	var complete []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || strings.HasPrefix(name, ".") || isWatchSidecar(name, names, stems) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue // Moved away since the directory was listed
+		}
+
+		file := watchedFile{size: info.Size(), modTime: info.ModTime(), since: now}
+		previous, ok := w.seen[name]
+		if ok && previous.size == file.size && previous.modTime.Equal(file.modTime) {
+			file.since = previous.since
+		}
+		seen[name] = file
+
+		switch {
+		case names[name+".done"]:
+			complete = append(complete, name)
+		case w.RequireDone:
+		case ok && now.Sub(file.since) >= w.SettleTime:
+			complete = append(complete, name)
+		}
+	}
+	w.seen = seen
+	if len(complete) == 0 {
+		return nil
+	}
+
+	running, err := w.running(ctx)
+	if err != nil {
+		return err
+	}
+	slices.SortFunc(complete, func(a, b string) int { return seen[a].modTime.Compare(seen[b].modTime) })
+	for _, name := range complete {
+		if running >= w.Concurrency {
+			slog.Debug("Watch directory files wait for running videos", "waiting", len(complete), "running", running)
+			break
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if w.ingest(ctx, name, seen[name].size) {
+			running++
+		}
+		delete(w.seen, name)
+	}
+	return nil
+}
+
+// isWatchSidecar reports whether name, a file in the watch directory, is the .done marker or
+// JSON sidecar of another file rather than a video. names holds the names of the files in the
+// directory and stems counts the files by name without extension.
+func isWatchSidecar(name string, names map[string]bool, stems map[string]int) bool {
+	if strings.HasSuffix(name, ".done") {
+		return true
+	}
+	stem, ok := strings.CutSuffix(name, ".json")
+	return ok && (names[stem] || stems[stem] > 1)
+}
+
+// running counts the videos ingested from the watch directory that are queued or transcoding.
+func (w *WatchFolder) running(ctx context.Context) (int, error) {
+	videos, err := w.Repos.Videos.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+	running := 0
+	for _, video := range videos {
+		if strings.HasPrefix(video.ImportURL, "file:") &&
+			(video.Status == repository.VideoStatusQueued || video.Status == repository.VideoStatusTranscoding) {
+			running++
+		}
+	}
+	return running, nil
+}
+
+// ingest moves a complete file from the watch directory into the upload path, registers it
+// and queues its transcode job. Files that cannot be ingested are rejected. It reports whether
+// a job was queued.
+func (w *WatchFolder) ingest(ctx context.Context, name string, size int64) bool {
+	sourcePath := filepath.Join(w.Path, name)
+	videoID, err := repository.NewID()
+	if err != nil {
+		slog.Error("Failed to create video", "file", sourcePath, "error", err)
+		return false
+	}
+	logger := slog.Default().With(logging.UploadIDKey, videoID)
+	ctx = logging.WithLogger(ctx, logger)
+	ctx, span := tracing.Start(ctx, "watch.ingest", tracing.UploadID.String(videoID), tracing.FileSize.Int64(size))
+
+	sidecar, sidecarPath, err := w.check(sourcePath, size)
+	if err != nil {
+		tracing.End(span, err)
+		w.reject(name, sidecarPath, err)
+		return false
+	}
+
+	if err := moveFile(sourcePath, filepath.Join(w.UploadPath, videoID), filepath.Join(w.UploadPath, watchCopyPrefix+videoID)); err != nil {
+		tracing.End(span, err)
+		logger.Error("Failed to move file from the watch directory", "file", sourcePath, "error", err)
+		return false
+	}
+	for _, marker := range []string{sourcePath + ".done", sidecarPath} {
+		if marker != "" {
+			if err := os.Remove(marker); err != nil && !errors.Is(err, os.ErrNotExist) {
+				logger.Warn("Failed to delete watch directory file", "file", marker, "error", err)
+			}
+		}
+	}
+
+	metadata := ParseUploadMetadata(map[string]string{
+		"filename":    name,
+		"title":       sidecar.Title,
+		"description": sidecar.Description,
+		"tags":        strings.Join(sidecar.Tags, ","),
+	})
+	video := &repository.Video{
+		ID:          videoID,
+		Filename:    metadata.Filename,
+		Title:       metadata.Title,
+		Description: metadata.Description,
+		Tags:        metadata.Tags,
+		Size:        size,
+		ImportURL:   watchFileURL(sourcePath),
+		Status:      repository.VideoStatusQueued,
+	}
+	if err := w.Repos.Videos.Create(ctx, video); err != nil {
+		logger.Error("Failed to register video", "error", err)
+	}
+	logger.Info("Ingested file from the watch directory", "file", sourcePath, "size", size)
+	metrics.WatchFiles.WithLabelValues("ingested").Inc()
+	SendStatusUpdateToClient(currClientChan, jobStatus("IC", videoID, name, "OK"))
+
+	err = EnqueueJob(ctx, w.Repos, w.Jobs, Job{
+		UploadPath:     w.UploadPath,
+		TranscodedPath: w.TranscodedPath,
+		Filename:       videoID,
+		Name:           name,
+		ClientChan:     currClientChan,
+	})
+	if err != nil {
+		logger.Error("Failed to queue transcode job", "error", err)
+	}
+	tracing.End(span, err)
+	return err == nil
+}
+
+// check makes sure a watched file is an accepted video and reads its sidecar. It returns the
+// path of the sidecar, or "" if there is none, also when the sidecar is invalid.
+func (w *WatchFolder) check(sourcePath string, size int64) (watchSidecar, string, error) {
+	var sidecar watchSidecar
+	sidecarPath := ""
+	stem := strings.TrimSuffix(sourcePath, filepath.Ext(sourcePath))
+	for _, candidate := range []string{sourcePath + ".json", stem + ".json"} {
+		if _, err := os.Stat(candidate); err == nil {
+			sidecarPath = candidate
+			break
+		}
+	}
+
+	if len(w.Extensions) > 0 && !slices.ContainsFunc(w.Extensions, func(extension string) bool {
+		return strings.EqualFold(extension, filepath.Ext(sourcePath))
+	}) {
+		return sidecar, sidecarPath, fmt.Errorf("extension %q is not accepted", filepath.Ext(sourcePath))
+	}
+	if w.MaxSize > 0 && size > w.MaxSize {
+		return sidecar, sidecarPath, fmt.Errorf("file is larger than the upload size limit")
+	}
+
+	file, err := os.Open(sourcePath)
+	if err != nil {
+		return sidecar, sidecarPath, err
+	}
+	defer file.Close()
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return sidecar, sidecarPath, fmt.Errorf("failed to read file: %v", err)
+	}
+	if !isVideoContainer(head[:n]) {
+		return sidecar, sidecarPath, errNotVideo
+	}
+
+	if sidecarPath != "" {
+		data, err := os.ReadFile(sidecarPath)
+		if err != nil {
+			return sidecar, sidecarPath, fmt.Errorf("failed to read sidecar: %v", err)
+		}
+		if err := json.Unmarshal(data, &sidecar); err != nil {
+			return sidecar, sidecarPath, fmt.Errorf("invalid sidecar %s: %v", filepath.Base(sidecarPath), err)
+		}
+	}
+	return sidecar, sidecarPath, nil
+}
+
+// reject moves a file that cannot be ingested, with its marker and sidecar, to the rejected
+// subdirectory and writes the reason next to it.
+func (w *WatchFolder) reject(name string, sidecarPath string, reason error) {
+	sourcePath := filepath.Join(w.Path, name)
+	rejectedDir := filepath.Join(w.Path, watchRejectedDir)
+	slog.Warn("Rejected file in the watch directory", "file", sourcePath, "reason", reason)
+	metrics.WatchFiles.WithLabelValues("rejected").Inc()
+
+	for _, path := range []string{sourcePath, sourcePath + ".done", sidecarPath} {
+		if path == "" {
+			continue
+		}
+		if err := os.Rename(path, filepath.Join(rejectedDir, filepath.Base(path))); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("Failed to move rejected file", "file", path, "error", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(rejectedDir, name+".error"), []byte(reason.Error()+"\n"), 0o644); err != nil {
+		slog.Warn("Failed to write rejection reason", "file", sourcePath, "error", err)
+	}
+}
+
+// moveFile moves the file at source to target. When it cannot simply be renamed, e.g. because
+// the watch directory is a network share, it is copied to temp next to target first, so target
+// only ever appears complete, and then deleted.
+func moveFile(source string, target string, temp string) error {
+	if err := os.Rename(source, target); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(temp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp, target)
+	}
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+	// Without deleting the source the file would be ingested again, so the copy is undone instead
+	in.Close()
+	if err := os.Remove(source); err != nil {
+		os.Remove(target)
+		return err
+	}
+	return nil
+}
+
+// watchFileURL returns the file URL a video ingested from path is recorded as imported from.
+func watchFileURL(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
@@ -0,0 +1,88 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// serviceName identifies the application in exported traces.
+const serviceName = "mtv-video-streaming"
+
+// Span attributes shared by the spans of the upload, job and playback flows. Every span
+// belonging to a video carries UploadID, so all of them can be found by the tus upload ID.
+var (
+	UploadID  = attribute.Key("upload.id")  // tus upload ID, also the video ID
+	JobID     = attribute.Key("job.id")     // ID of the job record
+	Rendition = attribute.Key("rendition")  // Name of a rendition, e.g. "720p"
+	FileName  = attribute.Key("file.name")  // Name of a media file
+	FileSize  = attribute.Key("file.size")  // Size of a file in bytes
+	FileCount = attribute.Key("file.count") // Number of files handled by an operation
+)
+
+// tracer creates every span of the application.
+var tracer = otel.Tracer("manhattan_tech_ventures")
+
+// Setup installs the global tracer provider. The exporter is "otlp" (OTLP over HTTP to
+// endpoint, e.g. "http://localhost:4318"), "stdout" (pretty-printed spans, for local debugging)
+// or "none", which leaves tracing disabled. The returned function flushes and stops the exporter.
+func Setup(ctx context.Context, exporter string, endpoint string) (func(context.Context) error, error) {
+	var spanExporter sdktrace.SpanExporter
+	var err error
+
+	switch exporter {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		spanExporter, err = otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	case "stdout":
+		spanExporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout), stdouttrace.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s trace exporter: %v", exporter, err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return provider.Shutdown, nil
+}
+
+// Start starts a span as a child of the span in ctx, if any.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// StartRequest starts a server span for an HTTP request, continuing the trace of the client
+// when the request carries trace context headers.
+func StartRequest(r *http.Request, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	return tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attrs...))
+}
+
+// End records err on span, if it is not nil, and ends the span.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
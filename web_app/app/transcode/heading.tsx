@@ -58,6 +58,10 @@ export default function Heading({ title }: HeaderProps) {
             // Create a new tus upload instance with the selected file
             const upload: tus.Upload = new tus.Upload(file, {
                 endpoint: 'http://localhost:8080/files/', // Tus server endpoint for file uploads
+                metadata: {
+                    filename: file.name, // Kept on the video so status updates show the user's own file name
+                    filetype: file.type
+                },
                 onError: function (error: Error) {
                     // Error handling for upload failures
                     console.error("Failed because: " + error.message);
@@ -98,6 +98,7 @@ export default function VideoList() {
             status = Status.UPLOAD_SUCCESS;
             break;
           case 'TS':
+          case 'TP': // Playable while still transcoding
             uploadSuccess.current = true;
             status = Status.TRANSCODE_STARTED;
             break;
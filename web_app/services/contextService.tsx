@@ -7,7 +7,8 @@ import React, { createContext, useContext, useEffect, useState, ReactNode } from
 export type StatusMessage = {
   message: 'OK' | string,   // The status message, which can be 'OK' or other strings indicating errors or other states
   fileId: string,          // The ID of the file related to this status message
-  statusCategory: 'UC' | 'TC' | 'T4' | 'T7' | 'TS' // Status categories representing different stages of upload and transcoding
+  fileName?: string,       // The name the file was uploaded as, for upload and transcoding updates
+  statusCategory: 'UC' | 'TC' | 'T4' | 'T7' | 'TS' | 'TP' // Status categories representing different stages of upload and transcoding
 }
 
 
@@ -36,11 +37,14 @@ export const SSEStatusProvider: React.FC<{ children: ReactNode }> = ({ children
       const statusMessage = newStatus?.split(':').pop(); // Extract the actual message part
       const statusType = newStatus?.split(':')[0].split('-')[0]; // Extract the status type (e.g., 'UC')
       const fileId = newStatus?.split(':')[0].split('-')[1]; // Extract the file ID associated with the message
+      const fields = newStatus?.split(':');
+      const fileName = fields && fields.length > 2 ? fields[1] : undefined; // Upload and transcoding updates carry the file name between the ID and the message
 
       // Construct a status message object based on the parsed data
       const statusObj: StatusMessage = {
         message: statusMessage,
         fileId: fileId,
+        fileName: fileName,
         statusCategory: statusType
       }
 